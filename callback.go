@@ -0,0 +1,152 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// callbackTimeout bounds each call the server makes to a client.
+const callbackTimeout = 10 * time.Second
+
+// callClient calls a procedure of an RPC program on a client host, as the
+// lock manager does to grant blocked locks. The port of the program is
+// found through Server.CallbackPort, or the portmapper of the host. It
+// returns the results of the call.
+func (s *Server) callClient(ctx context.Context, network, host string, prog, vers, proc uint32, args interface{}) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	var port int
+	var err error
+	if s.CallbackPort != nil {
+		port, err = s.CallbackPort(host, prog, vers)
+	} else {
+		port, err = getClientPort(ctx, network, host, prog, vers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("program %d version %d is not registered on %s", prog, vers, host)
+	}
+	return rpcCallTo(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)), prog, vers, proc, args)
+}
+
+// getClientPort asks the portmapper of a host for the port of a program.
+func getClientPort(ctx context.Context, network, host string, prog, vers uint32) (int, error) {
+	prot := uint32(IPProtoTCP)
+	if network == "udp" {
+		prot = IPProtoUDP
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(rpc.PmapPort))
+	res, err := rpcCallTo(ctx, network, addr, portmapServiceID, portmapVersion, uint32(PortmapProcGetPort), &portMapping{prog, vers, prot, 0})
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 4 {
+		return 0, ErrInputInvalid
+	}
+	return int(binary.BigEndian.Uint32(res)), nil
+}
+
+// rpcCallTo makes a single call with AUTH_NULL credentials over a new
+// connection to addr, and returns the results of an accepted reply.
+func rpcCallTo(ctx context.Context, network, addr string, prog, vers, proc uint32, args interface{}) ([]byte, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = nc.SetDeadline(deadline)
+	}
+
+	var xidBytes [4]byte
+	if _, err := rand.Read(xidBytes[:]); err != nil {
+		return nil, err
+	}
+	xid := binary.BigEndian.Uint32(xidBytes[:])
+	call := bytes.NewBuffer(nil)
+	if err := xdr.Write(call, &struct {
+		Xid     uint32
+		MsgType uint32
+		rpc.Header
+	}{xid, 0, rpc.Header{Rpcvers: 2, Prog: prog, Vers: vers, Proc: proc, Cred: rpc.AuthNull, Verf: rpc.AuthNull}}); err != nil {
+		return nil, err
+	}
+	if args != nil {
+		if err := xdr.Write(call, args); err != nil {
+			return nil, err
+		}
+	}
+
+	var reply []byte
+	if network == "udp" {
+		if _, err := nc.Write(call.Bytes()); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxDatagramSize)
+		n, err := nc.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		reply = buf[:n]
+	} else {
+		var marker [4]byte
+		binary.BigEndian.PutUint32(marker[:], uint32(call.Len())|1<<31)
+		if _, err := nc.Write(append(marker[:], call.Bytes()...)); err != nil {
+			return nil, err
+		}
+		if reply, _, err = readRecord(nc, DefaultMaxRecordSize); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return parseReply(reply, xid)
+}
+
+// parseReply checks that a reply accepts the call with xid, and returns its
+// results.
+func parseReply(reply []byte, xid uint32) ([]byte, error) {
+	r := bytes.NewReader(reply)
+	var head struct {
+		Xid       uint32
+		MsgType   uint32
+		ReplyStat uint32
+	}
+	if err := xdr.Read(r, &head); err != nil {
+		return nil, err
+	}
+	if head.Xid != xid || head.MsgType != 1 {
+		return nil, ErrInputInvalid
+	}
+	if head.ReplyStat != rpc.MsgAccepted {
+		return nil, errors.New("call was denied")
+	}
+	var verf rpc.Auth
+	if err := xdr.Read(r, &verf); err != nil {
+		return nil, err
+	}
+	stat, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if stat != uint32(ResponseCodeSuccess) {
+		return nil, fmt.Errorf("call was not accepted: %d", stat)
+	}
+	return reply[len(reply)-r.Len():], nil
+}
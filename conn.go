@@ -4,12 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/go-git/go-billy/v5"
 	xdr2 "github.com/rasky/go-xdr/xdr2"
 	"github.com/willscott/go-nfs-client/nfs/rpc"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
@@ -25,7 +29,8 @@ var (
 // ResponseCode is a combination of accept_stat and reject_stat.
 type ResponseCode uint32
 
-// ResponseCode Codes
+// ResponseCode Codes. They are sent as the accept_stat or reject_stat values
+// of rfc5531 by acceptStat and writeHeader.
 const (
 	ResponseCodeSuccess ResponseCode = iota
 	ResponseCodeProgUnavailable
@@ -34,34 +39,268 @@ const (
 	ResponseCodeSystemErr
 	ResponseCodeRPCMismatch
 	ResponseCodeAuthError
+	ResponseCodeProgMismatch
 )
 
+// acceptStat returns the accept_stat an accepted reply is sent with.
+func (c ResponseCode) acceptStat() uint32 {
+	switch c {
+	case ResponseCodeProgMismatch:
+		return 2
+	case ResponseCodeProcUnavailable:
+		return 3
+	case ResponseCodeGarbageArgs:
+		return 4
+	case ResponseCodeSystemErr:
+		return 5
+	}
+	return uint32(c)
+}
+
+// acceptedCode returns the ResponseCode of an accepted reply's accept_stat.
+func acceptedCode(acceptStat uint32) ResponseCode {
+	switch acceptStat {
+	case 2:
+		return ResponseCodeProgMismatch
+	case 3:
+		return ResponseCodeProcUnavailable
+	case 4:
+		return ResponseCodeGarbageArgs
+	case 5:
+		return ResponseCodeSystemErr
+	}
+	return ResponseCode(acceptStat)
+}
+
 type conn struct {
 	*Server
 	writeSerializer chan []byte
 	net.Conn
+	// datagram is set when the conn represents a peer of a packet listener;
+	// replies are then sent as single datagrams without record marking.
+	datagram bool
+	// portmapper is set for connections of a ServePortmapper listener, which
+	// answer the portmapper program alone.
+	portmapper bool
+	// slots bounds the number of requests executing for this connection.
+	slots    chan struct{}
+	inFlight sync.WaitGroup
+	// order sequences the requests for each file handle. The peers of a
+	// packet listener share one.
+	order      *handleOrder
+	writesDone chan struct{}
+	// tlsConn is the TLS session negotiated with STARTTLS, if any.
+	tlsConn *tls.Conn
+
+	// pending counts requests whose replies have not yet been written.
+	stateMu sync.Mutex
+	pending int
+	state   ConnState
+}
+
+// Close closes the underlying network connection.
+func (c *conn) Close() error {
+	return c.Conn.Close()
+}
+
+func (c *conn) setState(state ConnState) {
+	c.stateMu.Lock()
+	c.state = state
+	c.stateMu.Unlock()
+	if hook := c.Server.ConnState; hook != nil && !c.datagram {
+		hook(c.Conn, state)
+	}
+}
+
+// beginRequest and endRequest bracket the time from the first byte of a
+// request arriving until its reply is written, moving the connection between
+// active and idle, so that Shutdown does not close a connection whose request
+// is still being read.
+func (c *conn) beginRequest() {
+	c.stateMu.Lock()
+	c.pending++
+	first := c.pending == 1
+	c.stateMu.Unlock()
+	if first {
+		c.setState(StateActive)
+	}
+}
+
+func (c *conn) endRequest() {
+	c.stateMu.Lock()
+	c.pending--
+	last := c.pending == 0
+	c.stateMu.Unlock()
+	if last {
+		c.setState(StateIdle)
+	}
+}
+
+// idle reports whether the connection has no outstanding requests.
+func (c *conn) idle() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state == StateNew || c.state == StateIdle
 }
 
 func (c *conn) serve(ctx context.Context) {
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	c.writeSerializer = make(chan []byte, 1)
-	go c.serializeWrites(connCtx)
+	c.slots = make(chan struct{}, c.Server.maxConnRequests())
+	c.order = newHandleOrder()
+	c.startWrites(connCtx, cancel)
 
-	bio := bufio.NewReader(c.Conn)
+	bio := bufio.NewReader(c.transport())
 	for {
+		if err := c.awaitRequest(bio); err != nil {
+			if err != io.EOF {
+				Log.Debugf("error reading request: %v", err)
+			}
+			break
+		}
+		c.beginRequest()
 		w, err := c.readRequestHeader(connCtx, bio)
 		if err != nil {
-			if err == io.EOF {
-				// Clean close.
-				c.Close()
-				return
+			if isTimeout(err) {
+				Log.Infof("closing connection from %v: request not read within %v", c.RemoteAddr(), c.Server.ReadHeaderTimeout)
+				break
 			}
-			return
+			if err != io.EOF {
+				Log.Debugf("error reading request: %v", err)
+			}
+			break
 		}
 		Log.Tracef("request: %v", w.req)
-		err = c.handle(connCtx, w)
-		respErr := w.finish(connCtx)
+		if w.req.isTLSProbe() && c.Server.TLSConfig != nil && c.tlsConn == nil {
+			if bio.Buffered() > 0 {
+				Log.Debugf("request pipelined behind a STARTTLS probe")
+				break
+			}
+			if err := c.startTLS(connCtx, cancel, w); err != nil {
+				Log.Debugf("error starting tls: %v", err)
+				break
+			}
+			bio = bufio.NewReader(c.transport())
+			continue
+		}
+		if err := c.dispatch(connCtx, w); err != nil {
+			break
+		}
+	}
+
+	// let requests that are already running reply before closing.
+	c.stopWrites()
+	c.Close()
+	c.Server.removeConn(c)
+	c.setState(StateClosed)
+}
+
+// awaitRequest waits for the first byte of the next request, closing the
+// connection once it has been idle for IdleTimeout. The rest of the request
+// must then arrive within ReadHeaderTimeout.
+func (c *conn) awaitRequest(bio *bufio.Reader) error {
+	idle := c.Server.IdleTimeout
+	for {
+		// clear the ReadHeaderTimeout deadline of the previous request, even
+		// without an idle timeout.
+		deadline := time.Time{}
+		if idle > 0 {
+			deadline = time.Now().Add(idle)
+		}
+		_ = c.Conn.SetReadDeadline(deadline)
+		_, err := bio.Peek(1)
+		if err == nil {
+			break
+		}
+		if !isTimeout(err) {
+			return err
+		}
+		if !c.idle() {
+			// requests are still being answered.
+			continue
+		}
+		Log.Infof("closing connection from %v: idle for %v", c.RemoteAddr(), idle)
+		return err
+	}
+	if t := c.Server.ReadHeaderTimeout; t > 0 {
+		return c.Conn.SetReadDeadline(time.Now().Add(t))
+	}
+	return c.Conn.SetReadDeadline(time.Time{})
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// startWrites starts the goroutine sending replies queued on writeSerializer.
+// A failure to write cancels the connection's context.
+func (c *conn) startWrites(ctx context.Context, cancel context.CancelFunc) {
+	c.writeSerializer = make(chan []byte, 1)
+	c.writesDone = make(chan struct{})
+	go func() {
+		if err := c.serializeWrites(ctx); err != nil {
+			// unblock any requests still waiting to queue a reply.
+			cancel()
+		}
+		close(c.writesDone)
+	}()
+}
+
+// stopWrites waits for requests in flight to reply, and for their replies to
+// be written.
+func (c *conn) stopWrites() {
+	c.inFlight.Wait()
+	close(c.writeSerializer)
+	<-c.writesDone
+}
+
+// transport is the stream requests are read from and replies written to.
+func (c *conn) transport() net.Conn {
+	if c.tlsConn != nil {
+		return c.tlsConn
+	}
+	return c.Conn
+}
+
+// dispatch runs a request on its own goroutine once both the connection and
+// the server have capacity for it. Requests that change a file handle are run
+// in the order they were received relative to other requests for it. The
+// request was counted by beginRequest
+// as it began to arrive.
+func (c *conn) dispatch(ctx context.Context, w *Response) error {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := c.Server.acquireWorker(ctx); err != nil {
+		<-c.slots
+		return err
+	}
+	prev, done := c.sequence(w.req)
+
+	c.inFlight.Add(1)
+	go func() {
+		defer c.inFlight.Done()
+		defer func() { <-c.slots }()
+		defer c.Server.releaseWorker()
+		defer done()
+
+		for _, p := range prev {
+			select {
+			case <-p:
+			case <-ctx.Done():
+				c.endRequest()
+				return
+			}
+		}
+		err := c.handle(ctx, w)
+		respErr := w.finish(ctx)
+		if respErr != nil || w.dropped {
+			// the reply never reached the serializer.
+			c.endRequest()
+		}
 		if err != nil {
 			Log.Errorf("error handling req: %v", err)
 			// failure to handle at a level needing to close the connection.
@@ -71,23 +310,136 @@ func (c *conn) serve(ctx context.Context) {
 		if respErr != nil {
 			Log.Errorf("error sending response: %v", respErr)
 			c.Close()
-			return
 		}
+	}()
+	return nil
+}
+
+// handleOrder holds, for each file handle with requests in flight, the
+// requests later ones on the handle are ordered after.
+type handleOrder struct {
+	mu     sync.Mutex
+	queues map[string]*handleQueue
+}
+
+func newHandleOrder() *handleOrder {
+	return &handleOrder{queues: make(map[string]*handleQueue)}
+}
+
+// handleQueue orders the requests for one file handle. Requests that only
+// read run in parallel with each other, after the last request that changes
+// the handle, which in turn runs after every request before it.
+type handleQueue struct {
+	// write is closed once the last request changing the handle completes.
+	write chan struct{}
+	// reads are the read only requests dispatched since then.
+	reads []chan struct{}
+	// pending counts the requests for the handle that have not completed.
+	pending int
+}
+
+// sequence orders a request after earlier requests on the same file handle.
+// It returns the channels of the requests it must wait for, each closed once
+// that request completes, and a function to call when this request completes.
+func (c *conn) sequence(req *Request) ([]<-chan struct{}, func()) {
+	if AuthFlavor(req.Header.Cred.Flavor) == AuthFlavorRPCSECGSS {
+		// the arguments may be sealed until the call is handled.
+		return nil, func() {}
+	}
+	if req.Header.Prog == nlmServiceID {
+		// a lock request may wait on the file, which must not hold up
+		// reads and writes of it.
+		return nil, func() {}
+	}
+	key, ok := req.fileHandle()
+	if !ok {
+		return nil, func() {}
+	}
+	current := make(chan struct{})
+
+	o := c.order
+	o.mu.Lock()
+	q := o.queues[key]
+	if q == nil {
+		q = &handleQueue{}
+		o.queues[key] = q
+	}
+	var prev []<-chan struct{}
+	if q.write != nil {
+		prev = append(prev, q.write)
+	}
+	if req.readOnly() {
+		// forget reads that have completed, which later writes need not
+		// wait for.
+		reads := q.reads[:0]
+		for _, r := range q.reads {
+			select {
+			case <-r:
+			default:
+				reads = append(reads, r)
+			}
+		}
+		q.reads = append(reads, current)
+	} else {
+		for _, r := range q.reads {
+			prev = append(prev, r)
+		}
+		q.write, q.reads = current, nil
+	}
+	q.pending++
+	o.mu.Unlock()
+
+	return prev, func() {
+		close(current)
+		o.mu.Lock()
+		if q.pending--; q.pending == 0 {
+			delete(o.queues, key)
+		}
+		o.mu.Unlock()
 	}
 }
 
-func (c *conn) serializeWrites(ctx context.Context) {
+// readOnly reports whether a request leaves the objects it names unchanged,
+// so that it may run in parallel with other such requests for them.
+func (r *Request) readOnly() bool {
+	switch {
+	case r.Header.Prog == nfsServiceID && r.Header.Vers == nfsV2Version:
+		switch NFSv2Procedure(r.Header.Proc) {
+		case NFSv2ProcedureNull, NFSv2ProcedureGetAttr, NFSv2ProcedureRoot, NFSv2ProcedureLookup,
+			NFSv2ProcedureReadlink, NFSv2ProcedureRead, NFSv2ProcedureWriteCache,
+			NFSv2ProcedureReadDir, NFSv2ProcedureStatFS:
+			return true
+		}
+	case r.Header.Prog == nfsServiceID:
+		switch NFSProcedure(r.Header.Proc) {
+		case NFSProcedureNull, NFSProcedureGetAttr, NFSProcedureLookup, NFSProcedureAccess,
+			NFSProcedureReadlink, NFSProcedureRead, NFSProcedureReadDir, NFSProcedureReadDirPlus,
+			NFSProcedureFSStat, NFSProcedureFSInfo, NFSProcedurePathConf:
+			return true
+		}
+	case r.Header.Prog == nfsACLServiceID:
+		return ACLProcedure(r.Header.Proc) != ACLProcSetACL
+	}
+	return false
+}
+
+// serializeWrites writes queued replies in order. It returns nil once
+// writeSerializer is closed.
+func (c *conn) serializeWrites(ctx context.Context) error {
 	// todo: maybe don't need the extra buffer
-	writer := bufio.NewWriter(c.Conn)
+	writer := bufio.NewWriter(c.transport())
 	var fragmentBuf [4]byte
 	var fragmentInt uint32
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		case msg, ok := <-c.writeSerializer:
 			if !ok {
-				return
+				return nil
+			}
+			if t := c.Server.WriteTimeout; t > 0 {
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(t))
 			}
 			// prepend the fragmentation header
 			fragmentInt = uint32(len(msg))
@@ -95,34 +447,113 @@ func (c *conn) serializeWrites(ctx context.Context) {
 			binary.BigEndian.PutUint32(fragmentBuf[:], fragmentInt)
 			n, err := writer.Write(fragmentBuf[:])
 			if n < 4 || err != nil {
-				return
+				return io.ErrShortWrite
 			}
 			n, err = writer.Write(msg)
 			if err != nil {
-				return
+				return err
 			}
 			if n < len(msg) {
 				panic("todo: ensure writes complete fully.")
 			}
 			if err = writer.Flush(); err != nil {
-				return
+				if isTimeout(err) {
+					Log.Infof("closing connection from %v: reply not written within %v", c.RemoteAddr(), c.Server.WriteTimeout)
+				}
+				return err
 			}
+			c.endRequest()
 		}
 	}
 }
 
 // Handle a request. errors from this method indicate a failure to read or
 // write on the network stream, and trigger a disconnection of the connection.
-func (c *conn) handle(ctx context.Context, w *response) error {
-	handler := c.Server.handlerFor(w.req.Header.Prog, w.req.Header.Proc)
-	if handler == nil {
-		Log.Errorf("No handler for %d.%d", w.req.Header.Prog, w.req.Header.Proc)
+func (c *conn) handle(ctx context.Context, w *Response) error {
+	if w.req.truncated {
+		Log.Warnf("%v: record exceeds maximum size of %d bytes", w.req, c.Server.maxRecordSize())
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, &ResponseCodeGarbageArgsError{})
+	}
+	if (w.req.Header.Prog == portmapServiceID) != c.portmapper {
+		Log.Debugf("%v: program not served on this listener", w.req)
 		if err := w.drain(ctx); err != nil {
 			return err
 		}
-		return c.err(ctx, w, &ResponseCodeProcUnavailableError{})
+		return c.err(ctx, w, &ResponseCodeProgUnavailableError{})
 	}
-	appError := handler(ctx, w, c.Server.Handler)
+	ctx = c.withTLSState(ctx)
+	if w.req.Header.Prog == nfsServiceID && w.req.Header.Vers == nfsV2Version {
+		w.errorFmt = errorFormatterV2
+	} else if w.req.Header.Prog == nfsServiceID {
+		w.errorFmt = nfsErrorFormatter(w.req.Header.Proc)
+	} else if w.req.Header.Prog == nlmServiceID {
+		w.errorFmt = nlmErrorFormatter(w.req)
+	}
+	var creds *Credentials
+	var err error
+	if AuthFlavor(w.req.Header.Cred.Flavor) == AuthFlavorRPCSECGSS {
+		var done bool
+		if done, err = c.acceptGSS(ctx, w); done && err == nil {
+			return nil
+		} else if err == nil {
+			creds = c.gssCredentials(w.gss)
+		}
+	} else if creds, err = parseCredentials(w.req.Header.Cred); err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		err = &AuthError{AuthStatBadCred}
+	}
+	if err == nil {
+		w.req.creds = c.mapCredentials(w, creds)
+		err = c.authorizeExport(WithCredentials(ctx, w.req.creds), w)
+		ctx = WithCredentials(ctx, w.req.creds)
+	}
+	if err == nil {
+		err = c.checkExport(ctx, w)
+	}
+	if err == nil {
+		err = c.rateLimit(ctx, w)
+	}
+	if err != nil {
+		if drainErr := w.drain(ctx); drainErr != nil {
+			return drainErr
+		}
+		return c.err(ctx, w, err)
+	}
+	if key, ok := c.duplicateKey(w.req); ok {
+		reply, inProgress := c.Server.drc.begin(key)
+		switch {
+		case inProgress:
+			Log.Debugf("%v: dropping retransmission of a request in progress", w.req)
+			w.dropped = true
+			return nil
+		case reply != nil:
+			Log.Debugf("%v: replaying cached reply to retransmission", w.req)
+			return w.replay(reply)
+		}
+		if err := c.dispatchHandler(ctx, w); err != nil {
+			c.Server.drc.abandon(key)
+			return err
+		}
+		c.Server.drc.complete(key, w.writer.Bytes(), w.bodyStart)
+		return nil
+	}
+	return c.dispatchHandler(ctx, w)
+}
+
+// dispatchHandler runs the handler registered for a request.
+func (c *conn) dispatchHandler(ctx context.Context, w *Response) error {
+	handler, err := c.Server.handlerFor(w.req.Header.Rpcvers, w.req.Header.Prog, w.req.Header.Vers, w.req.Header.Proc)
+	if err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, err)
+	}
+	appError := c.Server.chain(handler)(ctx, w, c.Server.Handler)
 	if drainErr := w.drain(ctx); drainErr != nil {
 		return drainErr
 	}
@@ -140,7 +571,7 @@ func (c *conn) handle(ctx context.Context, w *response) error {
 	return nil
 }
 
-func (c *conn) err(ctx context.Context, w *response, err error) error {
+func (c *conn) err(ctx context.Context, w *Response, err error) error {
 	select {
 	case <-ctx.Done():
 		return nil
@@ -164,31 +595,115 @@ func (c *conn) err(ctx context.Context, w *response, err error) error {
 	return w.Write(body)
 }
 
-type request struct {
+// Request is an RPC call received by the server. Body holds the XDR encoded
+// procedure arguments, following the call header.
+type Request struct {
 	xid uint32
 	rpc.Header
 	Body io.Reader
+	// args holds the undecoded procedure arguments that Body reads from.
+	args []byte
+	// creds are the caller's credentials, parsed before dispatch.
+	creds *Credentials
+	// call holds the call header up to the end of the credential, which an
+	// RPCSEC_GSS verifier is computed over.
+	call []byte
+	// truncated is set when the record exceeded the server's maximum record
+	// size and Body holds only its leading bytes.
+	truncated bool
 }
 
-func (r *request) String() string {
-	if r.Header.Prog == nfsServiceID {
+func (r *Request) String() string {
+	if r.Header.Prog == nfsServiceID && r.Header.Vers == nfsV2Version {
+		return fmt.Sprintf("RPC #%d (nfs2.%s)", r.xid, NFSv2Procedure(r.Header.Proc))
+	} else if r.Header.Prog == nfsServiceID {
 		return fmt.Sprintf("RPC #%d (nfs.%s)", r.xid, NFSProcedure(r.Header.Proc))
 	} else if r.Header.Prog == mountServiceID {
 		return fmt.Sprintf("RPC #%d (mount.%s)", r.xid, MountProcedure(r.Header.Proc))
+	} else if r.Header.Prog == nlmServiceID {
+		return fmt.Sprintf("RPC #%d (nlm.%s)", r.xid, NLMProcedure(r.Header.Proc))
+	} else if r.Header.Prog == nfsACLServiceID {
+		return fmt.Sprintf("RPC #%d (nfsacl.%s)", r.xid, ACLProcedure(r.Header.Proc))
+	} else if r.Header.Prog == rquotaServiceID {
+		return fmt.Sprintf("RPC #%d (rquota.%s)", r.xid, RQuotaProcedure(r.Header.Proc))
+	} else if r.Header.Prog == nsmServiceID {
+		return fmt.Sprintf("RPC #%d (nsm.%s)", r.xid, NSMProcedure(r.Header.Proc))
 	}
 	return fmt.Sprintf("RPC #%d (%d.%d)", r.xid, r.Header.Prog, r.Header.Proc)
 }
 
-type response struct {
-	*conn
+// XID returns the transaction identifier the client assigned to the call.
+func (r *Request) XID() uint32 {
+	return r.xid
+}
+
+// fileHandle returns the file handle an NFS request operates on, which is the
+// leading argument of every procedure other than NULL. For NFSv2 it is the
+// handle of the Handler that the fixed size handle holds, and for NLM that of
+// the file locked. The arguments of RPCSEC_GSS calls must have been unsealed
+// by acceptGSS.
+func (r *Request) fileHandle() (string, bool) {
+	nfs := r.Header.Prog == nfsServiceID && r.Header.Vers == nfsVersion
+	nfs2 := r.Header.Prog == nfsServiceID && r.Header.Vers == nfsV2Version
+	acl := r.Header.Prog == nfsACLServiceID && r.Header.Vers == nfsACLVersion
+	if r.Header.Prog == nlmServiceID && r.Header.Vers == nlmVersion {
+		handle, ok := nlmFileHandle(NLMProcedure(r.Header.Proc), r.args)
+		return string(handle), ok
+	}
+	if !(nfs || nfs2 || acl) || r.Header.Proc == uint32(NFSProcedureNull) {
+		return "", false
+	}
+	if nfs2 {
+		var h FileHandleV2
+		if len(r.args) < len(h) {
+			return "", false
+		}
+		copy(h[:], r.args)
+		handle, err := h.handle()
+		if err != nil {
+			return "", false
+		}
+		return string(handle), true
+	}
+	handle, err := xdr.ReadOpaque(bytes.NewReader(r.args))
+	if err != nil {
+		return "", false
+	}
+	return string(handle), true
+}
+
+// Response accumulates the reply to a Request. Handlers write their results
+// with Write or WriteXDR; errors returned by a handler are sent instead if
+// nothing has been written.
+type Response struct {
+	conn      *conn
 	writer    *bytes.Buffer
 	responded bool
 	err       error
 	errorFmt  func(error) RPCError
-	req       *request
+	req       *Request
+	// the export a request's file handle belongs to, once resolved.
+	exportPolicy   exportPolicy
+	exportFound    bool
+	exportResolved bool
+	// the filesystem a request's file handle belongs to, once resolved.
+	handleFS         billy.Filesystem
+	handleFSResolved bool
+	// bodyStart is the offset of the procedure results in writer.
+	bodyStart int
+	// verf is the verifier sent with an accepted reply, AUTH_NULL if unset.
+	verf *rpc.Auth
+	// dropped is set when no reply should be sent, as for a retransmission
+	// of a request that is still being handled.
+	dropped bool
+	// succeeded is set when the reply accepts the call with success.
+	succeeded bool
+	// gss is the RPCSEC_GSS state of the call, if it used an established
+	// context.
+	gss *gssCall
 }
 
-func (w *response) writeXdrHeader() error {
+func (w *Response) writeXdrHeader() error {
 	err := xdr.Write(w.writer, &w.req.xid)
 	if err != nil {
 		return err
@@ -201,7 +716,7 @@ func (w *response) writeXdrHeader() error {
 	return nil
 }
 
-func (w *response) writeHeader(code ResponseCode) error {
+func (w *Response) writeHeader(code ResponseCode) error {
 	if w.responded {
 		return ErrAlreadySent
 	}
@@ -220,19 +735,36 @@ func (w *response) writeHeader(code ResponseCode) error {
 		return err
 	}
 
-	if status == rpc.MsgAccepted {
-		// Write opaque_auth header.
-		err = xdr.Write(w.writer, &rpc.AuthNull)
-		if err != nil {
+	if status == rpc.MsgDenied {
+		// reject_stat numbers RPC_MISMATCH and AUTH_ERROR from zero.
+		rejectStat := uint32(code - ResponseCodeRPCMismatch)
+		if err := xdr.Write(w.writer, &rejectStat); err != nil {
 			return err
 		}
+		w.bodyStart = w.writer.Len()
+		return nil
+	}
+
+	// Write opaque_auth header.
+	verf := &rpc.AuthNull
+	if w.verf != nil {
+		verf = w.verf
+	}
+	if err = xdr.Write(w.writer, verf); err != nil {
+		return err
 	}
 
-	return xdr.Write(w.writer, &code)
+	acceptStat := code.acceptStat()
+	if err := xdr.Write(w.writer, &acceptStat); err != nil {
+		return err
+	}
+	w.bodyStart = w.writer.Len()
+	w.succeeded = code == ResponseCodeSuccess
+	return nil
 }
 
 // Write a response to an xdr message
-func (w *response) Write(dat []byte) error {
+func (w *Response) Write(dat []byte) error {
 	if !w.responded {
 		if err := w.writeHeader(ResponseCodeSuccess); err != nil {
 			return err
@@ -250,8 +782,37 @@ func (w *response) Write(dat []byte) error {
 	return nil
 }
 
+// WriteXDR encodes v as XDR and writes it as part of a successful reply.
+func (w *Response) WriteXDR(v interface{}) error {
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, v); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
+
+// Request returns the call being answered.
+func (w *Response) Request() *Request {
+	return w.req
+}
+
+// Server returns the server the call was received by.
+func (w *Response) Server() *Server {
+	return w.conn.Server
+}
+
+// RemoteAddr returns the address of the client.
+func (w *Response) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the call was received on.
+func (w *Response) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
 // drain reads the rest of the request frame if not consumed by the handler.
-func (w *response) drain(ctx context.Context) error {
+func (w *Response) drain(ctx context.Context) error {
 	if reader, ok := w.req.Body.(*io.LimitedReader); ok {
 		if reader.N == 0 {
 			return nil
@@ -266,7 +827,16 @@ func (w *response) drain(ctx context.Context) error {
 	return io.ErrUnexpectedEOF
 }
 
-func (w *response) finish(ctx context.Context) error {
+func (w *Response) finish(ctx context.Context) error {
+	if w.dropped {
+		return nil
+	}
+	if err := w.sealGSS(); err != nil {
+		return err
+	}
+	if w.conn.datagram {
+		return w.sendDatagram(ctx)
+	}
 	select {
 	case w.conn.writeSerializer <- w.writer.Bytes():
 		return nil
@@ -275,26 +845,21 @@ func (w *response) finish(ctx context.Context) error {
 	}
 }
 
-func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *response, err error) {
-	fragment, err := xdr.ReadUint32(reader)
+func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *Response, err error) {
+	record, truncated, err := readRecord(reader, c.Server.maxRecordSize())
 	if err != nil {
-		if xdrErr, ok := err.(*xdr2.UnmarshalError); ok {
-			if xdrErr.Err == io.EOF {
-				return nil, io.EOF
-			}
-		}
 		return nil, err
 	}
-	if fragment&(1<<31) == 0 {
-		Log.Warnf("Warning: haven't implemented fragment reconstruction.\n")
-		return nil, ErrInputInvalid
-	}
-	reqLen := fragment - uint32(1<<31)
-	if reqLen < 40 {
+	return c.parseRequest(record, truncated)
+}
+
+// parseRequest decodes the RPC call header at the start of a complete record.
+func (c *conn) parseRequest(record []byte, truncated bool) (w *Response, err error) {
+	if len(record) < 40 {
 		return nil, ErrInputInvalid
 	}
 
-	r := io.LimitedReader{R: reader, N: int64(reqLen)}
+	r := io.LimitedReader{R: bytes.NewReader(record), N: int64(len(record))}
 
 	xid, err := xdr.ReadUint32(&r)
 	if err != nil {
@@ -308,16 +873,18 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 		return nil, ErrInputInvalid
 	}
 
-	req := request{
-		xid,
-		rpc.Header{},
-		&r,
+	req := Request{
+		xid:       xid,
+		Body:      &r,
+		truncated: truncated,
 	}
 	if err = xdr.Read(&r, &req.Header); err != nil {
 		return nil, err
 	}
+	req.call = record[:32+(len(req.Header.Cred.Body)+3)&^3]
+	req.args = record[len(record)-int(r.N):]
 
-	w = &response{
+	w = &Response{
 		conn:     c,
 		req:      &req,
 		errorFmt: basicErrorFormatter,
@@ -326,3 +893,51 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 	}
 	return w, nil
 }
+
+// readRecord reads one record-marked RPC message, reassembling it from as many
+// fragments as the sender used. Bytes beyond max are read and discarded so that
+// the stream stays aligned, and the record is reported as truncated.
+func readRecord(reader io.Reader, max uint32) (record []byte, truncated bool, err error) {
+	buf := bytes.Buffer{}
+	first := true
+	for {
+		fragment, err := xdr.ReadUint32(reader)
+		if err != nil {
+			if xdrErr, ok := err.(*xdr2.UnmarshalError); ok && xdrErr.Err == io.EOF {
+				if first {
+					return nil, false, io.EOF
+				}
+				return nil, false, io.ErrUnexpectedEOF
+			}
+			return nil, false, err
+		}
+		first = false
+		last := fragment&(1<<31) != 0
+		fragLen := int64(fragment &^ (1 << 31))
+
+		keep := int64(max) - int64(buf.Len())
+		if keep > fragLen {
+			keep = fragLen
+		}
+		if keep > 0 {
+			if n, err := io.CopyN(&buf, reader, keep); err != nil {
+				if err == io.EOF && n < keep {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, false, err
+			}
+		}
+		if fragLen > keep {
+			truncated = true
+			if _, err := io.CopyN(io.Discard, reader, fragLen-keep); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, false, err
+			}
+		}
+		if last {
+			return buf.Bytes(), truncated, nil
+		}
+	}
+}
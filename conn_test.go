@@ -0,0 +1,645 @@
+package nfs_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// rpcCall builds an RPC call message with AUTH_NULL credentials and the
+// given argument bytes.
+func rpcCall(xid, prog, vers, proc uint32, args []byte) []byte {
+	msg := make([]byte, 40, 40+len(args))
+	binary.BigEndian.PutUint32(msg[0:], xid)
+	binary.BigEndian.PutUint32(msg[4:], 0) // call
+	binary.BigEndian.PutUint32(msg[8:], 2) // rpc version
+	binary.BigEndian.PutUint32(msg[12:], prog)
+	binary.BigEndian.PutUint32(msg[16:], vers)
+	binary.BigEndian.PutUint32(msg[20:], proc)
+	// cred and verf are AUTH_NULL with empty bodies.
+	return append(msg, args...)
+}
+
+// writeFragments sends msg as a record split into fragments of at most size bytes.
+func writeFragments(t *testing.T, w io.Writer, msg []byte, size int) {
+	t.Helper()
+	for len(msg) > 0 {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		marker := uint32(n)
+		if n == len(msg) {
+			marker |= 1 << 31
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], marker)
+		if _, err := w.Write(append(hdr[:], msg[:n]...)); err != nil {
+			t.Fatal(err)
+		}
+		msg = msg[n:]
+	}
+}
+
+// readReply reads a single-fragment reply and returns its xid and accept_stat.
+func readReply(t *testing.T, r io.Reader) (uint32, uint32) {
+	t.Helper()
+	xid, stat, _ := readReplyBody(t, r)
+	return xid, stat
+}
+
+// readReplyBody reads a single-fragment reply and returns its xid, accept_stat
+// and result body.
+func readReplyBody(t *testing.T, r io.Reader) (uint32, uint32, []byte) {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body) < 24 {
+		t.Fatalf("short reply: %x", body)
+	}
+	if replyStat := binary.BigEndian.Uint32(body[8:]); replyStat != 0 {
+		t.Fatalf("reply was denied: %x", body)
+	}
+	return binary.BigEndian.Uint32(body[0:]), binary.BigEndian.Uint32(body[20:]), body[24:]
+}
+
+func serveMem(t *testing.T, srv *nfs.Server) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	srv.Handler = helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024)
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestFragmentedRecord(t *testing.T) {
+	c := serveMem(t, &nfs.Server{})
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(7, 100003, 3, 0, nil), 12)
+	if xid, stat := readReply(t, r); xid != 7 || stat != 0 {
+		t.Fatalf("unexpected reply to fragmented call: xid %d stat %d", xid, stat)
+	}
+}
+
+func TestOversizedRecord(t *testing.T) {
+	c := serveMem(t, &nfs.Server{ServerOptions: nfs.ServerOptions{MaxRecordSize: 1024}})
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(8, 100003, 3, 0, bytes.Repeat([]byte{0}, 4096)), 1500)
+	if xid, stat := readReply(t, r); xid != 8 || stat != 4 {
+		t.Fatalf("expected garbage args for oversized record: xid %d stat %d", xid, stat)
+	}
+
+	// the connection remains usable after the rejection.
+	writeFragments(t, c, rpcCall(9, 100003, 3, 0, nil), 100)
+	if xid, stat := readReply(t, r); xid != 9 || stat != 0 {
+		t.Fatalf("unexpected reply after oversized record: xid %d stat %d", xid, stat)
+	}
+}
+
+// blockingFS stalls Lstat of one file, once armed, until released.
+type blockingFS struct {
+	billy.Filesystem
+	path    string
+	armed   atomic.Bool
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingFS) Lstat(filename string) (os.FileInfo, error) {
+	if filename == b.path && b.armed.Load() {
+		select {
+		case b.blocked <- struct{}{}:
+		default:
+		}
+		<-b.release
+	}
+	return b.Filesystem.Lstat(filename)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/slow", "/fast"} {
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	fs := &blockingFS{Filesystem: mem, path: "slow", blocked: make(chan struct{}, 1), release: make(chan struct{})}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024))
+	}()
+
+	c, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var mounter nfsc.Mount
+	mounter.Client = c
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, slowFH, err := target.Lookup("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fastFH, err := target.Lookup("/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.armed.Store(true)
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := target.GetAttr(slowFH)
+		slowDone <- err
+	}()
+	<-fs.blocked
+
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := target.GetAttr(fastFH)
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was blocked behind a slow request on another handle")
+	}
+
+	close(fs.release)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOrder(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fs := &blockingFS{Filesystem: mem, path: "slow", blocked: make(chan struct{}, 1), release: make(chan struct{})}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024))
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	root := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	writeFragments(t, c, rpcCall(2, 100003, 3, uint32(nfs.NFSProcedureLookup), append(xdrOpaque(root), xdrOpaque([]byte("slow"))...)), 1<<20)
+	_, stat, res = readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("lookup failed: %d %x", stat, res)
+	}
+	fh := xdrOpaque(res[8 : 8+binary.BigEndian.Uint32(res[4:])])
+
+	fs.armed.Store(true)
+	writeFragments(t, c, rpcCall(3, 100003, 3, uint32(nfs.NFSProcedureGetAttr), fh), 1<<20)
+	<-fs.blocked
+	fs.armed.Store(false)
+
+	// reads of the handle run alongside each other.
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	writeFragments(t, c, rpcCall(4, 100003, 3, uint32(nfs.NFSProcedureGetAttr), fh), 1<<20)
+	if xid, stat, _ := readReplyBody(t, r); xid != 4 || stat != 0 {
+		t.Fatalf("unexpected reply while a read is blocked: %d %d", xid, stat)
+	}
+	// a change to it waits for the reads before it.
+	writeFragments(t, c, rpcCall(5, 100003, 3, uint32(nfs.NFSProcedureSetAttr), append(fh, xdrUint32s(0, 0, 0, 0, 0, 0, 0)...)), 1<<20)
+	time.Sleep(100 * time.Millisecond)
+	close(fs.release)
+	for _, want := range []uint32{3, 5} {
+		if xid, stat, _ := readReplyBody(t, r); xid != want || stat != 0 {
+			t.Fatalf("reply %d was answered out of order: %d %d", want, xid, stat)
+		}
+	}
+}
+
+// xdrOpaque encodes b as a variable length XDR opaque.
+func xdrOpaque(b []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	out = append(out, b...)
+	for len(out)%4 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// udpCall sends one call as a datagram and returns the accept_stat and
+// result body of the reply.
+func udpCall(t *testing.T, c net.Conn, msg []byte) (uint32, []byte) {
+	t.Helper()
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 65536)
+	n, err := c.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = reply[:n]
+	if len(reply) < 24 || binary.BigEndian.Uint32(reply[0:]) != binary.BigEndian.Uint32(msg[0:]) {
+		t.Fatalf("unexpected reply: %x", reply)
+	}
+	return binary.BigEndian.Uint32(reply[20:]), reply[24:]
+}
+
+func TestServePacketHandleOrder(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fs := &blockingFS{Filesystem: mem, path: "slow", blocked: make(chan struct{}, 1), release: make(chan struct{})}
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		_ = (&nfs.Server{Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)}).ServePacket(pc)
+	}()
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stat, res := udpCall(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))))
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	root := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	stat, res = udpCall(t, c, rpcCall(2, 100003, 3, uint32(nfs.NFSProcedureLookup), append(xdrOpaque(root), xdrOpaque([]byte("slow"))...)))
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("lookup failed: %d %x", stat, res)
+	}
+	fh := xdrOpaque(res[8 : 8+binary.BigEndian.Uint32(res[4:])])
+
+	fs.armed.Store(true)
+	if _, err := c.Write(rpcCall(3, 100003, 3, uint32(nfs.NFSProcedureGetAttr), fh)); err != nil {
+		t.Fatal(err)
+	}
+	<-fs.blocked
+	fs.armed.Store(false)
+	// a change to the handle waits for the read before it, as over TCP.
+	if _, err := c.Write(rpcCall(4, 100003, 3, uint32(nfs.NFSProcedureSetAttr), append(fh, xdrUint32s(0, 0, 0, 0, 0, 0, 0)...))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(fs.release)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []uint32{3, 4} {
+		reply := make([]byte, 65536)
+		n, err := c.Read(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xid := binary.BigEndian.Uint32(reply[:n]); xid != want {
+			t.Fatalf("reply %d was answered out of order: %d", want, xid)
+		}
+	}
+}
+
+func TestServePacket(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	srv := &nfs.Server{Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024)}
+	go func() {
+		_ = srv.ServePacket(pc)
+	}()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if stat, _ := udpCall(t, c, rpcCall(1, 100003, 3, 0, nil)); stat != 0 {
+		t.Fatalf("null call failed: %d", stat)
+	}
+
+	stat, res := udpCall(t, c, rpcCall(2, 100005, 3, 1, xdrOpaque([]byte("/"))))
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fhLen := binary.BigEndian.Uint32(res[4:])
+	fh := res[8 : 8+fhLen]
+
+	stat, res = udpCall(t, c, rpcCall(3, 100003, 3, uint32(nfs.NFSProcedureFSInfo), xdrOpaque(fh)))
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("fsinfo failed: %d %x", stat, res)
+	}
+	// skip the post_op_attr to reach rtmax.
+	res = res[4:]
+	if binary.BigEndian.Uint32(res) == 1 {
+		res = res[4+84:]
+	} else {
+		res = res[4:]
+	}
+	if rtmax := binary.BigEndian.Uint32(res); rtmax > 65507 {
+		t.Fatalf("rtmax %d does not fit in a datagram", rtmax)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fs := &blockingFS{Filesystem: mem, path: "slow", blocked: make(chan struct{}, 1), release: make(chan struct{})}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closed atomic.Bool
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		ConnState: func(_ net.Conn, state nfs.ConnState) {
+			if state == nfs.StateClosed {
+				closed.Store(true)
+			}
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	c, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fh, err := target.Lookup("/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.armed.Store(true)
+	reqDone := make(chan error, 1)
+	go func() {
+		_, err := target.GetAttr(fh)
+		reqDone <- err
+	}()
+	<-fs.blocked
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- srv.Shutdown(context.Background())
+	}()
+	if err := <-served; err != nfs.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed from Serve, got %v", err)
+	}
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown returned while a request was in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(fs.release)
+	if err := <-reqDone; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !closed.Load() {
+		t.Fatal("connection was not reported closed")
+	}
+}
+
+func TestShutdownPartialRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan nfs.ConnState, 8)
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024),
+		ConnState: func(_ net.Conn, state nfs.ConnState) {
+			states <- state
+		},
+	}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var record bytes.Buffer
+	writeFragments(t, &record, rpcCall(1, 100003, 3, 0, nil), 1<<20)
+	if _, err := c.Write(record.Bytes()[:10]); err != nil {
+		t.Fatal(err)
+	}
+	for active := false; !active; {
+		select {
+		case state := <-states:
+			active = state == nfs.StateActive
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection with a request arriving is not active")
+		}
+	}
+	// the connection is not idle while a request is arriving on it.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown with a request arriving returned %v", err)
+	}
+	if _, err := c.Write(record.Bytes()[10:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, stat := readReply(t, c); stat != 0 {
+		t.Fatalf("request read during shutdown failed: %d", stat)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuplicateRequestCache(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024))
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+
+	remove := rpcCall(2, 100003, 3, uint32(nfs.NFSProcedureRemove), append(xdrOpaque(fh), xdrOpaque([]byte("victim"))...))
+	for i := 0; i < 2; i++ {
+		writeFragments(t, c, remove, 1<<20)
+		xid, stat, res := readReplyBody(t, r)
+		if xid != 2 || stat != 0 {
+			t.Fatalf("unexpected reply: xid %d stat %d", xid, stat)
+		}
+		if status := binary.BigEndian.Uint32(res); status != 0 {
+			t.Fatalf("attempt %d of remove failed with status %d", i, status)
+		}
+	}
+
+	// a new request with the same arguments is run again.
+	writeFragments(t, c, rpcCall(3, 100003, 3, uint32(nfs.NFSProcedureRemove), append(xdrOpaque(fh), xdrOpaque([]byte("victim"))...)), 1<<20)
+	if _, _, res := readReplyBody(t, r); binary.BigEndian.Uint32(res) == 0 {
+		t.Fatal("remove of a missing file succeeded")
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	srv := &nfs.Server{ServerOptions: nfs.ServerOptions{
+		MaxConnsPerIP:     1,
+		ReadHeaderTimeout: 100 * time.Millisecond,
+	}}
+	c := serveMem(t, srv)
+	r := bufio.NewReader(c)
+	writeFragments(t, c, rpcCall(1, 100003, 3, 0, nil), 100)
+	if xid, stat := readReply(t, r); xid != 1 || stat != 0 {
+		t.Fatalf("unexpected reply: xid %d stat %d", xid, stat)
+	}
+
+	// a second connection from the same address is closed.
+	second, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection over the limit was not closed: %v", err)
+	}
+
+	// a request that stalls part way is abandoned.
+	if _, err := c.Write([]byte{0x80, 0, 0, 40, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("stalled connection was not closed: %v", err)
+	}
+}
+
+func TestReadHeaderTimeoutBetweenRequests(t *testing.T) {
+	srv := &nfs.Server{ServerOptions: nfs.ServerOptions{
+		ReadHeaderTimeout: 50 * time.Millisecond,
+	}}
+	c := serveMem(t, srv)
+	r := bufio.NewReader(c)
+	writeFragments(t, c, rpcCall(1, 100003, 3, 0, nil), 100)
+	if xid, stat := readReply(t, r); xid != 1 || stat != 0 {
+		t.Fatalf("unexpected reply: xid %d stat %d", xid, stat)
+	}
+
+	// without an IdleTimeout, a connection may wait between requests for
+	// longer than ReadHeaderTimeout.
+	time.Sleep(200 * time.Millisecond)
+	writeFragments(t, c, rpcCall(2, 100003, 3, 0, nil), 100)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if xid, stat := readReply(t, r); xid != 2 || stat != 0 {
+		t.Fatalf("unexpected reply: xid %d stat %d", xid, stat)
+	}
+}
@@ -0,0 +1,81 @@
+package nfs
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// CreationPolicy controls the owner and mode of the objects clients create
+// in an export.
+type CreationPolicy struct {
+	// Umask is cleared from the mode of every new object.
+	Umask os.FileMode
+	// FileMode and DirMode are the modes of new files and directories when
+	// the client sets none. Zero means 0666 and 0777 respectively.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// SetOwner gives new objects the uid of a caller with AUTH_UNIX
+	// credentials. Their group is the caller's, unless the directory they
+	// are created in has the setgid bit, in which case they take its group
+	// and new directories are made setgid too, as on System V.
+	SetOwner bool
+	// BSDGroups gives new objects the group of their directory regardless
+	// of its setgid bit, as on BSD. Only used with SetOwner.
+	BSDGroups bool
+}
+
+// creationAttrs fills in attrs the mode and owner that an object of type ft
+// created in the directory at dir takes under the CreationPolicy of its
+// export. It is only used for objects that do not exist yet. Attributes the
+// client set are kept, except that the umask always applies and that, under a
+// policy or with CheckPermissions, only root may choose the owner, as with
+// knfsd. It reports whether a new directory should be made setgid.
+func (w *Response) creationAttrs(fs billy.Filesystem, dir []string, attrs *SetFileAttributes, ft FileType) (setgid bool) {
+	export, ok := w.export()
+	var policy *CreationPolicy
+	if ok {
+		policy = export.creation
+	}
+	if (policy != nil || w.checkingPermissions()) && !callerOf(w).root() {
+		attrs.SetUID, attrs.SetGID = nil, nil
+	}
+	if policy == nil {
+		return false
+	}
+
+	if ft != FileTypeLink {
+		mode := policy.FileMode
+		if ft == FileTypeDirectory {
+			mode = policy.DirMode
+		}
+		if mode == 0 {
+			mode = 0666
+			if ft == FileTypeDirectory {
+				mode = 0777
+			}
+		}
+		mode = attrs.Mode(mode) &^ policy.Umask
+		m := uint32(mode.Perm())
+		attrs.SetMode = &m
+	}
+
+	creds := w.req.creds
+	if !policy.SetOwner || !creds.HasIdentity() {
+		return false
+	}
+	if attrs.SetUID == nil {
+		uid := creds.UID
+		attrs.SetUID = &uid
+	}
+	parent := tryStat(fs, dir)
+	inherit := parent != nil && (policy.BSDGroups || parent.Mode()&os.ModeSetgid != 0)
+	if attrs.SetGID == nil {
+		gid := creds.GID
+		if inherit {
+			gid = parent.GID
+		}
+		attrs.SetGID = &gid
+	}
+	return ft == FileTypeDirectory && parent != nil && parent.Mode()&os.ModeSetgid != 0
+}
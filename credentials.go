@@ -0,0 +1,183 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// maxAuthUnixGroups is the number of supplementary groups AUTH_UNIX carries.
+const maxAuthUnixGroups = 16
+
+// Credentials identify the caller of a request. For AUTH_NULL only Flavor
+// is set. For RPCSEC_GSS, Principal is set, and the uid and gids are those
+// Server.MapPrincipal gives it.
+type Credentials struct {
+	Flavor AuthFlavor
+	// Stamp is an arbitrary id the client generated.
+	Stamp       uint32
+	MachineName string
+	UID         uint32
+	GID         uint32
+	// GIDs are the caller's supplementary groups.
+	GIDs []uint32
+	// Principal is the name the caller authenticated as with RPCSEC_GSS.
+	Principal string
+	// mapped is set when the ids of a principal are known.
+	mapped bool
+}
+
+// HasIdentity reports whether the credentials name a uid and gid.
+func (c *Credentials) HasIdentity() bool {
+	return c != nil && (c.Flavor == AuthFlavorUnix || c.mapped)
+}
+
+// InGroup reports whether gid is the caller's primary or a supplementary group.
+func (c *Credentials) InGroup(gid uint32) bool {
+	if !c.HasIdentity() {
+		return false
+	}
+	if c.GID == gid {
+		return true
+	}
+	for _, g := range c.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// authUnixBody is the XDR form of AUTH_UNIX credentials (rfc5531 appendix A).
+type authUnixBody struct {
+	Stamp       uint32
+	MachineName string
+	UID         uint32
+	GID         uint32
+	GIDs        []uint32
+}
+
+// parseCredentials decodes the credentials of a call. Flavors other than
+// AUTH_NULL and AUTH_UNIX are returned with only their flavor set.
+func parseCredentials(auth rpc.Auth) (*Credentials, error) {
+	creds := &Credentials{Flavor: AuthFlavor(auth.Flavor)}
+	if creds.Flavor != AuthFlavorUnix {
+		return creds, nil
+	}
+	var body authUnixBody
+	r := bytes.NewReader(auth.Body)
+	if err := xdr.Read(r, &body); err != nil {
+		return nil, err
+	}
+	if len(body.MachineName) > 255 || len(body.GIDs) > maxAuthUnixGroups || r.Len() != 0 {
+		return nil, errors.New("malformed AUTH_UNIX credentials")
+	}
+	creds.Stamp = body.Stamp
+	creds.MachineName = body.MachineName
+	creds.UID = body.UID
+	creds.GID = body.GID
+	creds.GIDs = body.GIDs
+	return creds, nil
+}
+
+type credentialsKey struct{}
+
+// WithCredentials returns a context carrying the caller's credentials.
+func WithCredentials(ctx context.Context, creds *Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// CredentialsFromContext returns the credentials of the caller of the request
+// a context belongs to.
+func CredentialsFromContext(ctx context.Context) (*Credentials, bool) {
+	creds, ok := ctx.Value(credentialsKey{}).(*Credentials)
+	return creds, ok && creds != nil
+}
+
+// Credentials returns the caller's credentials, once the request has been
+// accepted for dispatch.
+func (r *Request) Credentials() *Credentials {
+	return r.creds
+}
+
+// CredentialsMapper is an optional interface for handlers that rewrite the
+// identity of callers, as to squash root. MapCredentials is given the
+// credentials of each call and the filesystem its file handle belongs to, or
+// nil for calls without one. The credentials it returns are those seen by
+// permission checks and by the rest of the request.
+type CredentialsMapper interface {
+	MapCredentials(billy.Filesystem, *Credentials) *Credentials
+}
+
+// mapCredentials applies the CredentialsMapper of the server's handler.
+func (c *conn) mapCredentials(w *Response, creds *Credentials) *Credentials {
+	m, ok := c.Server.Handler.(CredentialsMapper)
+	if !ok {
+		return creds
+	}
+	if mapped := m.MapCredentials(w.filesystem(), creds); mapped != nil {
+		return mapped
+	}
+	return creds
+}
+
+// ContextChangeHandler is an optional interface for handlers whose
+// billy.Change depends on the caller. When implemented, ChangeContext is used
+// in place of Change, with the caller's credentials in the context.
+type ContextChangeHandler interface {
+	ChangeContext(context.Context, billy.Filesystem) billy.Change
+}
+
+// ContextFilesystem is an optional interface for filesystems that act on
+// behalf of the caller. WithContext returns a view of the filesystem used for
+// the filesystem calls of a single request, with the caller's credentials in
+// the context.
+type ContextFilesystem interface {
+	WithContext(context.Context) billy.Filesystem
+}
+
+// requestFS is the view of a ContextFilesystem used for one request. The
+// filesystem it was derived from identifies it to the Handler.
+type requestFS struct {
+	billy.Filesystem
+	base billy.Filesystem
+}
+
+// Capabilities implements billy.Capable.
+func (r *requestFS) Capabilities() billy.Capability {
+	return billy.Capabilities(r.Filesystem)
+}
+
+// fromHandle resolves a file handle, binding the filesystem to the request
+// context if it is a ContextFilesystem.
+func fromHandle(ctx context.Context, userHandle Handler, fh []byte) (billy.Filesystem, []string, error) {
+	fs, path, err := userHandle.FromHandle(fh)
+	if err != nil {
+		return fs, path, err
+	}
+	if cfs, ok := fs.(ContextFilesystem); ok {
+		return &requestFS{Filesystem: cfs.WithContext(ctx), base: fs}, path, nil
+	}
+	return fs, path, nil
+}
+
+// baseFS returns the filesystem a Handler knows, for handle and change
+// operations.
+func baseFS(fs billy.Filesystem) billy.Filesystem {
+	if r, ok := fs.(*requestFS); ok {
+		return r.base
+	}
+	return fs
+}
+
+// changeFor returns the billy.Change for a filesystem on behalf of the caller.
+func changeFor(ctx context.Context, userHandle Handler, fs billy.Filesystem) billy.Change {
+	if ch, ok := userHandle.(ContextChangeHandler); ok {
+		return ch.ChangeContext(ctx, baseFS(fs))
+	}
+	return userHandle.Change(baseFS(fs))
+}
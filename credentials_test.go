@@ -0,0 +1,253 @@
+package nfs_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// callerFS records the uid of the caller creating each file.
+type callerFS struct {
+	billy.Filesystem
+	uid    uint32
+	opened chan uint32
+}
+
+func (c *callerFS) WithContext(ctx context.Context) billy.Filesystem {
+	view := &callerFS{Filesystem: c.Filesystem, opened: c.opened}
+	if creds, ok := nfs.CredentialsFromContext(ctx); ok {
+		view.uid = creds.UID
+	}
+	return view
+}
+
+func (c *callerFS) Create(filename string) (billy.File, error) {
+	select {
+	case c.opened <- c.uid:
+	default:
+	}
+	return c.Filesystem.Create(filename)
+}
+
+// callerHandler records the credentials seen by Mount and Change.
+type callerHandler struct {
+	nfs.Handler
+	mounted chan *nfs.Credentials
+	changed chan *nfs.Credentials
+}
+
+func (h *callerHandler) Mount(ctx context.Context, c net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	creds, _ := nfs.CredentialsFromContext(ctx)
+	h.mounted <- creds
+	return h.Handler.Mount(ctx, c, req)
+}
+
+func (h *callerHandler) ChangeContext(ctx context.Context, fs billy.Filesystem) billy.Change {
+	creds, _ := nfs.CredentialsFromContext(ctx)
+	select {
+	case h.changed <- creds:
+	default:
+	}
+	return h.Handler.Change(fs)
+}
+
+func TestCredentials(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+	fs := &callerFS{Filesystem: mem, opened: make(chan uint32, 1)}
+	handler := &callerHandler{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		mounted: make(chan *nfs.Credentials, 1),
+		changed: make(chan *nfs.Credentials, 1),
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+
+	c, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.NewAuthUnix("client", 1001, 100).Auth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := <-handler.mounted; !creds.HasIdentity() || creds.UID != 1001 || creds.GID != 100 || creds.MachineName != "client" {
+		t.Fatalf("mount saw credentials %+v", creds)
+	}
+
+	if _, err := target.Create("/file", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if uid := <-fs.opened; uid != 1001 {
+		t.Fatalf("filesystem saw uid %d", uid)
+	}
+	if creds := <-handler.changed; creds.UID != 1001 {
+		t.Fatalf("change saw credentials %+v", creds)
+	}
+}
+
+// unixOnlyHandler offers its exports to AUTH_UNIX callers only.
+type unixOnlyHandler struct {
+	nfs.Handler
+}
+
+func (h unixOnlyHandler) Mount(ctx context.Context, c net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, fs, _ := h.Handler.Mount(ctx, c, req)
+	return status, fs, []nfs.AuthFlavor{nfs.AuthFlavorUnix}
+}
+
+func TestExportFlavors(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(unixOnlyHandler{helpers.NewNullAuthHandler(mem)}, 1024))
+	}()
+
+	client, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	mounter := nfsc.Mount{Client: client}
+	target, err := mounter.Mount("/", rpc.NewAuthUnix("client", 1001, 100).Auth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.FSInfo(); err != nil {
+		t.Fatalf("call with the export's flavor failed: %v", err)
+	}
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writeFragments(t, c, rpcCall(1, 100003, 3, uint32(nfs.NFSProcedureGetAttr), xdrOpaque(fh)), 1<<20)
+	if !readTooWeak(t, c) {
+		t.Fatal("AUTH_NULL call was not refused")
+	}
+}
+
+// readTooWeak reads a reply and reports whether it refuses the call with
+// AUTH_TOOWEAK.
+func readTooWeak(t *testing.T, r io.Reader) bool {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	// MSG_DENIED, AUTH_ERROR, AUTH_TOOWEAK.
+	want := []uint32{1, 1, 1, uint32(nfs.AuthStatTooWeak)}
+	if len(reply) != 4+4*len(want) {
+		return false
+	}
+	for i, v := range want {
+		if binary.BigEndian.Uint32(reply[4+4*i:]) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// resolvingHandler names the export of its filesystems to servers that did
+// not mount it.
+type resolvingHandler struct {
+	unixOnlyHandler
+}
+
+func (resolvingHandler) ExportOf(fs billy.Filesystem) (string, []nfs.AuthFlavor, bool) {
+	return "/", []nfs.AuthFlavor{nfs.AuthFlavorUnix}, true
+}
+
+func TestExportWithoutMount(t *testing.T) {
+	// handles obtained from one server are used on another that never saw
+	// their export mounted.
+	handleFrom := func(handler nfs.Handler) []byte {
+		target := mountAs(t, &nfs.Server{Handler: handler}, 1001, 100)
+		_, fh, err := target.Lookup("/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fh
+	}
+	dial := func(srv *nfs.Server) net.Conn {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	newMem := func() billy.Filesystem {
+		mem := memfs.New()
+		// File needs to exist in the root for memfs to acknowledge the root exists.
+		r, _ := mem.Create("/test")
+		r.Close()
+		return mem
+	}
+
+	// with per export policies configured, an unknown export is refused.
+	handler := helpers.NewCachingHandler(unixOnlyHandler{helpers.NewNullAuthHandler(newMem())}, 1024)
+	fh := handleFrom(handler)
+	c := dial(&nfs.Server{Handler: handler, RequireTLS: func(string) bool { return false }})
+	writeFragments(t, c, rpcUnixCall(1, 100003, 3, uint32(nfs.NFSProcedureGetAttr), 1001, 100, xdrOpaque(fh)), 1<<20)
+	if !readTooWeak(t, c) {
+		t.Fatal("call for an export that was not mounted was not refused")
+	}
+
+	// a handler resolving the export has its flavors enforced.
+	handler = helpers.NewCachingHandler(resolvingHandler{unixOnlyHandler{helpers.NewNullAuthHandler(newMem())}}, 1024)
+	fh = handleFrom(handler)
+	c = dial(&nfs.Server{Handler: handler})
+	writeFragments(t, c, rpcCall(2, 100003, 3, uint32(nfs.NFSProcedureGetAttr), xdrOpaque(fh)), 1<<20)
+	if !readTooWeak(t, c) {
+		t.Fatal("AUTH_NULL call for a resolved export was not refused")
+	}
+	writeFragments(t, c, rpcUnixCall(3, 100003, 3, uint32(nfs.NFSProcedureGetAttr), 1001, 100, xdrOpaque(fh)), 1<<20)
+	if _, stat, res := readReplyBody(t, c); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("AUTH_UNIX call for a resolved export failed: %d %x", stat, res)
+	}
+}
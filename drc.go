@@ -0,0 +1,158 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+const (
+	// DefaultDuplicateCacheSize is the number of replies kept for
+	// retransmitted requests when Server.DuplicateCacheSize is zero.
+	DefaultDuplicateCacheSize = 1024
+	// DefaultDuplicateCacheTTL is how long replies are kept for retransmitted
+	// requests when Server.DuplicateCacheTTL is zero.
+	DefaultDuplicateCacheTTL = 2 * time.Minute
+)
+
+// drcKey identifies a request for the duplicate request cache. The client is
+// identified by host alone, as it may reconnect from a new port before
+// retransmitting; the checksum of the arguments guards against xid reuse.
+// RPCSEC_GSS retransmissions have a new sequence number, and are matched by
+// their unsealed arguments, which do not include it.
+type drcKey struct {
+	client string
+	xid    uint32
+	prog   uint32
+	vers   uint32
+	proc   uint32
+	sum    uint32
+}
+
+type drcEntry struct {
+	// reply is nil while the original request is still being handled.
+	reply   *drcReply
+	created time.Time
+}
+
+// drcReply is the reply to a request, with the offset of its results.
+type drcReply struct {
+	data      []byte
+	bodyStart int
+}
+
+// duplicateCache remembers the replies to recent non-idempotent requests,
+// so that a retransmission after a lost reply does not run the operation
+// a second time.
+type duplicateCache struct {
+	mu      sync.Mutex
+	entries *lru.Cache[drcKey, *drcEntry]
+	ttl     time.Duration
+}
+
+func newDuplicateCache(size int, ttl time.Duration) *duplicateCache {
+	if size == 0 {
+		size = DefaultDuplicateCacheSize
+	}
+	if ttl == 0 {
+		ttl = DefaultDuplicateCacheTTL
+	}
+	entries, err := lru.New[drcKey, *drcEntry](size)
+	if err != nil {
+		return nil
+	}
+	return &duplicateCache{entries: entries, ttl: ttl}
+}
+
+// begin records the start of a request. If the request has been seen before,
+// it returns the cached reply, or a nil reply with inProgress set if the
+// original has not completed yet.
+func (d *duplicateCache) begin(key drcKey) (reply *drcReply, inProgress bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries.Get(key); ok && time.Since(e.created) < d.ttl {
+		return e.reply, e.reply == nil
+	}
+	d.entries.Add(key, &drcEntry{created: time.Now()})
+	return nil, false
+}
+
+// complete stores the reply to a request started with begin, whose results
+// start at bodyStart.
+func (d *duplicateCache) complete(key drcKey, reply []byte, bodyStart int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries.Peek(key); ok {
+		e.reply = &drcReply{append([]byte{}, reply...), bodyStart}
+	}
+}
+
+// abandon forgets a request that did not produce a reply.
+func (d *duplicateCache) abandon(key drcKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries.Remove(key)
+}
+
+// duplicateKey returns the cache key for a request, and whether the request
+// is one whose replies should be cached.
+func (c *conn) duplicateKey(req *Request) (drcKey, bool) {
+	if c.Server.drc == nil || !nonIdempotent(req.Header.Prog, req.Header.Vers, req.Header.Proc) {
+		return drcKey{}, false
+	}
+	return drcKey{
+		client: remoteIP(c.Conn),
+		xid:    req.xid,
+		prog:   req.Header.Prog,
+		vers:   req.Header.Vers,
+		proc:   req.Header.Proc,
+		sum:    crc32.ChecksumIEEE(req.args),
+	}, true
+}
+
+// nonIdempotent reports whether repeating a procedure can change its result.
+func nonIdempotent(prog, vers, proc uint32) bool {
+	if prog == nfsServiceID && vers == nfsV2Version {
+		switch NFSv2Procedure(proc) {
+		case NFSv2ProcedureSetAttr, NFSv2ProcedureCreate, NFSv2ProcedureRemove,
+			NFSv2ProcedureRename, NFSv2ProcedureLink, NFSv2ProcedureSymlink,
+			NFSv2ProcedureMkDir, NFSv2ProcedureRmDir:
+			return true
+		}
+		return false
+	}
+	if prog != nfsServiceID || vers != nfsVersion {
+		return false
+	}
+	switch NFSProcedure(proc) {
+	case NFSProcedureSetAttr, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove,
+		NFSProcedureRmDir, NFSProcedureRename, NFSProcedureLink:
+		return true
+	}
+	return false
+}
+
+// replay answers a retransmission with the reply cached for the original
+// request. An accepted reply to an RPCSEC_GSS call is given the verifier of
+// the retransmission's sequence number, and its results are sealed for it
+// when sent.
+func (w *Response) replay(reply *drcReply) error {
+	w.writer.Reset()
+	accepted := len(reply.data) >= 12 && binary.BigEndian.Uint32(reply.data[8:]) == uint32(rpc.MsgAccepted)
+	if w.gss == nil || !accepted {
+		w.writer.Write(reply.data)
+		w.responded = true
+		return nil
+	}
+	code := acceptedCode(binary.BigEndian.Uint32(reply.data[reply.bodyStart-4:]))
+	if err := w.writeHeader(code); err != nil {
+		return err
+	}
+	w.writer.Write(reply.data[reply.bodyStart:])
+	return nil
+}
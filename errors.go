@@ -91,7 +91,7 @@ func (a *AuthError) Error() string {
 // MarshalBinary sends the specific auth status
 func (a *AuthError) MarshalBinary() (data []byte, err error) {
 	var resp [4]byte
-	binary.LittleEndian.PutUint32(resp[:], uint32(a.AuthStat))
+	binary.BigEndian.PutUint32(resp[:], uint32(a.AuthStat))
 	return resp[:], nil
 }
 
@@ -113,11 +113,53 @@ func (r *RPCMismatchError) Error() string {
 // MarshalBinary sends the specific rpc mismatch range
 func (r *RPCMismatchError) MarshalBinary() (data []byte, err error) {
 	var resp [8]byte
-	binary.LittleEndian.PutUint32(resp[0:4], uint32(r.Low))
-	binary.LittleEndian.PutUint32(resp[4:8], uint32(r.High))
+	binary.BigEndian.PutUint32(resp[0:4], uint32(r.Low))
+	binary.BigEndian.PutUint32(resp[4:8], uint32(r.High))
 	return resp[:], nil
 }
 
+// ProgMismatchError is an RPCError reporting the range of versions of a
+// program that the server supports.
+type ProgMismatchError struct {
+	Low  uint32
+	High uint32
+}
+
+// Code for ProgMismatchError is ResponseCodeProgMismatch
+func (p *ProgMismatchError) Code() ResponseCode {
+	return ResponseCodeProgMismatch
+}
+
+func (p *ProgMismatchError) Error() string {
+	return fmt.Sprintf("Program Mismatch: Expected version between %d and %d.", p.Low, p.High)
+}
+
+// MarshalBinary sends the supported version range
+func (p *ProgMismatchError) MarshalBinary() (data []byte, err error) {
+	var resp [8]byte
+	binary.BigEndian.PutUint32(resp[0:4], p.Low)
+	binary.BigEndian.PutUint32(resp[4:8], p.High)
+	return resp[:], nil
+}
+
+// ResponseCodeProgUnavailableError is an RPCError
+type ResponseCodeProgUnavailableError struct {
+}
+
+// Code for ResponseCodeProgUnavailableError
+func (r *ResponseCodeProgUnavailableError) Code() ResponseCode {
+	return ResponseCodeProgUnavailable
+}
+
+func (r *ResponseCodeProgUnavailableError) Error() string {
+	return "The requested program is not served"
+}
+
+// MarshalBinary - this error has no associated body
+func (r *ResponseCodeProgUnavailableError) MarshalBinary() (data []byte, err error) {
+	return []byte{}, nil
+}
+
 // ResponseCodeProcUnavailableError is an RPCError
 type ResponseCodeProcUnavailableError struct {
 }
@@ -136,6 +178,24 @@ func (r *ResponseCodeProcUnavailableError) MarshalBinary() (data []byte, err err
 	return []byte{}, nil
 }
 
+// ResponseCodeGarbageArgsError is an RPCError
+type ResponseCodeGarbageArgsError struct {
+}
+
+// Code for ResponseCodeGarbageArgsError
+func (r *ResponseCodeGarbageArgsError) Code() ResponseCode {
+	return ResponseCodeGarbageArgs
+}
+
+func (r *ResponseCodeGarbageArgsError) Error() string {
+	return "The procedure arguments could not be decoded"
+}
+
+// MarshalBinary - this error has no associated body
+func (r *ResponseCodeGarbageArgsError) MarshalBinary() (data []byte, err error) {
+	return []byte{}, nil
+}
+
 // ResponseCodeSystemError is an RPCError
 type ResponseCodeSystemError struct {
 }
@@ -246,3 +306,21 @@ func statusFromWriteError(err error) NFSStatus {
 	}
 	return NFSStatusIO
 }
+
+// nfsErrorFormatter returns the formatter matching the failure result of an
+// NFS procedure, so that errors raised before its handler runs are encoded
+// as the client expects.
+func nfsErrorFormatter(proc uint32) func(error) RPCError {
+	switch NFSProcedure(proc) {
+	case NFSProcedureAccess, NFSProcedureLookup, NFSProcedureRead, NFSProcedureReadlink,
+		NFSProcedureReadDir, NFSProcedureReadDirPlus:
+		return opAttrErrorFormatter
+	case NFSProcedureSetAttr, NFSProcedureWrite, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir,
+		NFSProcedureLink, NFSProcedureCommit:
+		return wccDataErrorFormatter
+	case NFSProcedureRename:
+		return errFormatterWithBody(doubleWccErrorBody[:])
+	}
+	return basicErrorFormatter
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	nfs "github.com/willscott/go-nfs"
+	"golang.org/x/sys/unix"
+)
+
+// The extended attributes in which Linux keeps POSIX ACLs, and the version
+// of their format.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+	aclXattrVersion = 2
+	aclUndefinedID  = ^uint32(0)
+)
+
+func aclXattr(def bool) string {
+	if def {
+		return aclDefaultXattr
+	}
+	return aclAccessXattr
+}
+
+// aclError reports filesystems without ACLs as not supporting them.
+func aclError(err error) error {
+	if errors.Is(err, unix.ENOTSUP) {
+		return &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusNotSupp, WrappedErr: err}
+	}
+	return err
+}
+
+// GetACL reads the access or default ACL of a file from its xattrs, those of
+// a symbolic link being its own rather than its target's.
+func (fs COS) GetACL(path string, def bool) ([]nfs.ACLEntry, error) {
+	p := fs.Join(fs.Root(), path)
+	for {
+		size, err := unix.Lgetxattr(p, aclXattr(def), nil)
+		if errors.Is(err, unix.ENODATA) {
+			return nil, nil
+		} else if err != nil {
+			return nil, aclError(err)
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(p, aclXattr(def), buf)
+		if errors.Is(err, unix.ERANGE) {
+			// the ACL grew since its size was read.
+			continue
+		} else if errors.Is(err, unix.ENODATA) {
+			return nil, nil
+		} else if err != nil {
+			return nil, aclError(err)
+		}
+		return decodeACLXattr(buf[:n])
+	}
+}
+
+// SetACL writes the access or default ACL of a file to its xattrs.
+func (fs COS) SetACL(path string, def bool, acl []nfs.ACLEntry) error {
+	p := fs.Join(fs.Root(), path)
+	if acl == nil {
+		if err := unix.Lremovexattr(p, aclXattr(def)); err != nil && !errors.Is(err, unix.ENODATA) {
+			return aclError(err)
+		}
+		return nil
+	}
+	return aclError(unix.Lsetxattr(p, aclXattr(def), encodeACLXattr(acl), 0))
+}
+
+// decodeACLXattr parses the little-endian posix_acl_xattr format: a version
+// followed by entries of a 16 bit tag and permissions and a 32 bit id.
+func decodeACLXattr(data []byte) ([]nfs.ACLEntry, error) {
+	if len(data) < 4 || len(data)%8 != 4 || binary.LittleEndian.Uint32(data) != aclXattrVersion {
+		return nil, unix.EINVAL
+	}
+	acl := make([]nfs.ACLEntry, 0, len(data)/8)
+	for p := data[4:]; len(p) > 0; p = p[8:] {
+		e := nfs.ACLEntry{
+			Tag:  nfs.ACLTag(binary.LittleEndian.Uint16(p)),
+			Perm: uint32(binary.LittleEndian.Uint16(p[2:])),
+		}
+		if e.Tag == nfs.ACLUser || e.Tag == nfs.ACLGroup {
+			e.ID = binary.LittleEndian.Uint32(p[4:])
+		}
+		acl = append(acl, e)
+	}
+	return acl, nil
+}
+
+func encodeACLXattr(acl []nfs.ACLEntry) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, aclXattrVersion)
+	for _, e := range acl {
+		id := aclUndefinedID
+		if e.Tag == nfs.ACLUser || e.Tag == nfs.ACLGroup {
+			id = e.ID
+		}
+		data = binary.LittleEndian.AppendUint16(data, uint16(e.Tag))
+		data = binary.LittleEndian.AppendUint16(data, uint16(e.Perm))
+		data = binary.LittleEndian.AppendUint32(data, id)
+	}
+	return data
+}
@@ -0,0 +1,265 @@
+package nfs
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// exportPolicy holds the restrictions recorded for an export when it is
+// mounted, which apply to every later request on its file handles.
+type exportPolicy struct {
+	fs         billy.Filesystem
+	dirpath    string
+	requireTLS bool
+	creation   *CreationPolicy
+	// flavors are the security flavors calls may use, or nil for any.
+	flavors []AuthFlavor
+}
+
+// allowsFlavor reports whether calls with credentials of flavor f may use
+// the export. An export offering AUTH_NULL requires no authentication, and
+// so accepts any flavor.
+func (p exportPolicy) allowsFlavor(f AuthFlavor) bool {
+	return p.flavors == nil || containsFlavor(p.flavors, AuthFlavorNull) || containsFlavor(p.flavors, f)
+}
+
+func containsFlavor(flavors []AuthFlavor, f AuthFlavor) bool {
+	for _, allowed := range flavors {
+		if allowed == f {
+			return true
+		}
+	}
+	return false
+}
+
+// strictestFlavors returns the flavors allowed by both a and b.
+func strictestFlavors(a, b []AuthFlavor) []AuthFlavor {
+	if a == nil || containsFlavor(a, AuthFlavorNull) {
+		return b
+	}
+	if b == nil || containsFlavor(b, AuthFlavorNull) {
+		return a
+	}
+	both := []AuthFlavor{}
+	for _, f := range a {
+		if containsFlavor(b, f) {
+			both = append(both, f)
+		}
+	}
+	return both
+}
+
+// exportTable holds the policy of each mounted export, keyed by filesystem.
+type exportTable struct {
+	mu       sync.RWMutex
+	policies []exportPolicy
+}
+
+// set records the policy of an export. A filesystem mounted through several
+// dirpaths keeps the strictest of their restrictions, and the first creation
+// policy given for it.
+func (t *exportTable) set(policy exportPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.policies {
+		if sameFilesystem(p.fs, policy.fs) {
+			policy.requireTLS = policy.requireTLS || p.requireTLS
+			policy.flavors = strictestFlavors(policy.flavors, p.flavors)
+			if p.creation != nil {
+				policy.creation = p.creation
+			}
+			t.policies[i] = policy
+			return
+		}
+	}
+	t.policies = append(t.policies, policy)
+}
+
+// restricted reports whether any recorded export requires TLS or limits the
+// flavors calls may use.
+func (t *exportTable) restricted() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, p := range t.policies {
+		if p.requireTLS || !p.allowsFlavor(AuthFlavorUnix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *exportTable) empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.policies) == 0
+}
+
+func (t *exportTable) lookup(fs billy.Filesystem) (exportPolicy, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, p := range t.policies {
+		if sameFilesystem(p.fs, fs) {
+			return p, true
+		}
+	}
+	return exportPolicy{}, false
+}
+
+// mountedAt returns the filesystems of the exports last mounted at dirpath.
+func (t *exportTable) mountedAt(dirpath string) []billy.Filesystem {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var found []billy.Filesystem
+	for _, p := range t.policies {
+		if p.dirpath == dirpath {
+			found = append(found, p.fs)
+		}
+	}
+	return found
+}
+
+// sameFilesystem compares filesystems without panicking on dynamic types
+// that are not comparable, including structs wrapping such types.
+func sameFilesystem(a, b billy.Filesystem) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		return false
+	}
+	if ta == nil || ta.Kind() == reflect.Pointer {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// export returns the policy of the export a request's file handle belongs
+// to, resolving it once per request.
+func (w *Response) export() (exportPolicy, bool) {
+	if !w.exportResolved {
+		w.exportResolved = true
+		w.exportPolicy, w.exportFound = w.lookupExport()
+	}
+	return w.exportPolicy, w.exportFound
+}
+
+func (w *Response) lookupExport() (exportPolicy, bool) {
+	s := w.conn.Server
+	resolver, resolves := s.Handler.(ExportResolver)
+	if s.exports.empty() && !resolves {
+		return exportPolicy{}, false
+	}
+	fs := w.filesystem()
+	if fs == nil {
+		return exportPolicy{}, false
+	}
+	if policy, ok := s.exports.lookup(fs); ok || !resolves {
+		return policy, ok
+	}
+	dirpath, flavors, ok := resolver.ExportOf(fs)
+	if !ok {
+		return exportPolicy{}, false
+	}
+	s.exports.set(s.newExportPolicy(fs, dirpath, flavors))
+	return s.exports.lookup(fs)
+}
+
+// newExportPolicy returns the policy of the export at dirpath, offering
+// flavors, under the settings of the server.
+func (s *Server) newExportPolicy(fs billy.Filesystem, dirpath string, flavors []AuthFlavor) exportPolicy {
+	policy := exportPolicy{fs: fs, dirpath: dirpath, requireTLS: s.RequireTLS != nil && s.RequireTLS(dirpath)}
+	if len(flavors) > 0 {
+		policy.flavors = append([]AuthFlavor{}, flavors...)
+	}
+	if s.CreationPolicy != nil {
+		policy.creation = s.CreationPolicy(dirpath)
+	}
+	return policy
+}
+
+// filesystem returns the filesystem a request's file handle belongs to, or
+// nil for requests without a valid handle, resolving it once per request.
+func (w *Response) filesystem() billy.Filesystem {
+	if !w.handleFSResolved {
+		w.handleFSResolved = true
+		if fh, ok := w.req.fileHandle(); ok {
+			// invalid handles are left to the procedure handler to report.
+			if fs, _, err := w.conn.Server.Handler.FromHandle([]byte(fh)); err == nil {
+				w.handleFS = fs
+			}
+		}
+	}
+	return w.handleFS
+}
+
+// ExportAuthorizer is an optional interface for handlers that decide, for
+// each call with a file handle, whether the client may use the export the
+// handle belongs to and with which identity, as by host, source port or
+// squash options. AuthorizeExport is given the filesystem of the handle and
+// the caller's credentials, after any CredentialsMapper. It returns the
+// credentials for the rest of the request, or an error to refuse the call
+// with, such as an *AuthError or *NFSStatusError.
+type ExportAuthorizer interface {
+	AuthorizeExport(ctx context.Context, conn net.Conn, fs billy.Filesystem, creds *Credentials) (*Credentials, error)
+}
+
+// ExportResolver is an optional interface for handlers that can tell the
+// dirpath of the export a filesystem belongs to, and the flavors Mount offers
+// for it. The server uses it to enforce the policy of an export whose file
+// handles are used without a MOUNT it has seen, as after a restart. Without
+// it, such handles are refused once the server has RequireTLS set or has
+// recorded an export that requires TLS or limits flavors.
+type ExportResolver interface {
+	ExportOf(fs billy.Filesystem) (dirpath string, flavors []AuthFlavor, ok bool)
+}
+
+// authorizeExport applies the ExportAuthorizer of the server's handler.
+func (c *conn) authorizeExport(ctx context.Context, w *Response) error {
+	a, ok := c.Server.Handler.(ExportAuthorizer)
+	if !ok {
+		return nil
+	}
+	fs := w.filesystem()
+	if fs == nil {
+		return nil
+	}
+	creds, err := a.AuthorizeExport(ctx, c, fs, w.req.creds)
+	if err != nil {
+		Log.Debugf("%v: refused by export: %v", w.req, err)
+		return err
+	}
+	if creds != nil {
+		w.req.creds = creds
+	}
+	return nil
+}
+
+// checkExport enforces the policy of the export a request's file handle
+// belongs to, before the procedure handler runs.
+func (c *conn) checkExport(ctx context.Context, w *Response) error {
+	policy, ok := w.export()
+	if !ok {
+		// the policy of an export that was not mounted is unknown.
+		if w.filesystem() != nil && (c.Server.RequireTLS != nil || c.Server.exports.restricted()) {
+			Log.Debugf("%v: refusing request for an export that was not mounted", w.req)
+			return &AuthError{AuthStatTooWeak}
+		}
+		return nil
+	}
+	if policy.requireTLS && c.tlsConn == nil {
+		Log.Debugf("%v: refusing cleartext request for an export requiring tls", w.req)
+		return &AuthError{AuthStatTooWeak}
+	}
+	if w.gss != nil {
+		if !policy.allowsFlavor(AuthFlavorRPCSECGSS) && !policy.allowsFlavor(w.gss.pseudoFlavor()) {
+			Log.Debugf("%v: refusing rpcsec_gss service %d not allowed by export %s", w.req, w.gss.service, policy.dirpath)
+			return &AuthError{AuthStatTooWeak}
+		}
+	} else if flavor := AuthFlavor(w.req.Header.Cred.Flavor); !policy.allowsFlavor(flavor) {
+		Log.Debugf("%v: refusing flavor %d not allowed by export %s", w.req, flavor, policy.dirpath)
+		return &AuthError{AuthStatTooWeak}
+	}
+	return nil
+}
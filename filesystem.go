@@ -13,3 +13,29 @@ type FSStat struct {
 	// CacheHint is called "invarsec" in the nfs standard
 	CacheHint time.Duration
 }
+
+// QuotaType is whether a quota limits a user or a group.
+type QuotaType uint32
+
+// QuotaType Codes
+const (
+	QuotaUser  QuotaType = 0
+	QuotaGroup QuotaType = 1
+)
+
+// Quota describes the disk quota of a user or group on a file system. Zero
+// limits mean no limit.
+type Quota struct {
+	// Active reports whether the limits are enforced.
+	Active         bool
+	HardLimitBytes uint64
+	SoftLimitBytes uint64
+	UsedBytes      uint64
+	HardLimitFiles uint64
+	SoftLimitFiles uint64
+	UsedFiles      uint64
+	// BytesGrace and FilesGrace are the time left before a soft limit that
+	// has been exceeded is enforced like the hard limit.
+	BytesGrace time.Duration
+	FilesGrace time.Duration
+}
@@ -0,0 +1,387 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// GSSMechanism is a GSS-API mechanism, such as Kerberos V5, with which
+// clients establish RPCSEC_GSS contexts (rfc2203).
+type GSSMechanism interface {
+	// NewContext returns the acceptor side of a new security context.
+	NewContext() GSSContext
+}
+
+// GSSContext is the acceptor side of one GSS-API security context.
+type GSSContext interface {
+	// Accept processes a context token from the client, as
+	// gss_accept_sec_context does. It returns the token to send back, and
+	// whether the context is established or needs more tokens. A *GSSError
+	// reports the GSS status codes to send the client.
+	Accept(token []byte) (reply []byte, established bool, err error)
+	// Principal is the authenticated name of the client, once established.
+	Principal() string
+	// GetMIC and VerifyMIC compute and check integrity checksums.
+	GetMIC(msg []byte) ([]byte, error)
+	VerifyMIC(msg, mic []byte) error
+	// Wrap and Unwrap protect messages with integrity and confidentiality.
+	Wrap(msg []byte) ([]byte, error)
+	Unwrap(msg []byte) ([]byte, error)
+}
+
+// GSSError carries the major and minor GSS-API status of a failure.
+type GSSError struct {
+	Major uint32
+	Minor uint32
+}
+
+func (e *GSSError) Error() string {
+	return fmt.Sprintf("gss failure: major %#x minor %d", e.Major, e.Minor)
+}
+
+// GSS-API major status codes sent in context creation replies (rfc2744).
+const (
+	GSSComplete       uint32 = 0
+	GSSContinueNeeded uint32 = 1
+	GSSFailure        uint32 = 13 << 16
+)
+
+// GSSService is the protection applied to the calls of an RPCSEC_GSS
+// context.
+type GSSService uint32
+
+// GSSService values
+const (
+	GSSServiceNone      GSSService = 1
+	GSSServiceIntegrity GSSService = 2
+	GSSServicePrivacy   GSSService = 3
+)
+
+// RPCSEC_GSS control procedures.
+const (
+	gssProcData         uint32 = 0
+	gssProcInit         uint32 = 1
+	gssProcContinueInit uint32 = 2
+	gssProcDestroy      uint32 = 3
+)
+
+const (
+	// gssMaxSeq bounds the sequence numbers of a context.
+	gssMaxSeq = 0x80000000
+	// gssSeqWindow is the number of sequence numbers that may arrive out of
+	// order.
+	gssSeqWindow = 128
+	// gssMaxContexts bounds the contexts kept, dropping the least recently
+	// used.
+	gssMaxContexts = 1024
+	// gssMaxPending bounds the contexts whose creation has not completed,
+	// which unauthenticated clients can start, so that they cannot evict
+	// established contexts.
+	gssMaxPending = 64
+)
+
+// gssCred is the RPCSEC_GSS credential of a call.
+type gssCred struct {
+	Version uint32
+	Proc    uint32
+	Seq     uint32
+	Service GSSService
+	Handle  []byte
+}
+
+// gssInitRes is the result of a context creation call.
+type gssInitRes struct {
+	Handle    []byte
+	Major     uint32
+	Minor     uint32
+	SeqWindow uint32
+	Token     []byte
+}
+
+// gssContext is a context established with a client.
+type gssContext struct {
+	GSSContext
+	established atomic.Bool
+
+	mu sync.Mutex
+	// last is the highest sequence number received, and seen records which
+	// of the gssSeqWindow numbers up to it have been.
+	last uint32
+	seen [gssSeqWindow]bool
+	any  bool
+}
+
+// acceptSeq records the sequence number of a call, reporting false for
+// replays and for calls that have fallen behind the window.
+func (g *gssContext) acceptSeq(seq uint32) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case !g.any:
+		g.any = true
+		g.last = seq
+	case seq > g.last:
+		for s, n := g.last+1, 0; s <= seq && n < gssSeqWindow; s, n = s+1, n+1 {
+			g.seen[s%gssSeqWindow] = false
+		}
+		g.last = seq
+	case g.last-seq >= gssSeqWindow || g.seen[seq%gssSeqWindow]:
+		return false
+	}
+	g.seen[seq%gssSeqWindow] = true
+	return true
+}
+
+// gssCall is the RPCSEC_GSS state of a call being handled.
+type gssCall struct {
+	ctx     *gssContext
+	seq     uint32
+	service GSSService
+}
+
+// pseudoFlavor is the Kerberos V5 pseudo-flavor of the call's service.
+func (g *gssCall) pseudoFlavor() AuthFlavor {
+	switch g.service {
+	case GSSServiceIntegrity:
+		return AuthFlavorKrb5i
+	case GSSServicePrivacy:
+		return AuthFlavorKrb5p
+	}
+	return AuthFlavorKrb5
+}
+
+// acceptGSS processes the RPCSEC_GSS credential of a call. Context creation
+// is answered here, and done is set. Otherwise the call is verified, its
+// arguments unwrapped, and the reply arranged to be protected by the same
+// service; done is set if the call is to be dropped.
+func (c *conn) acceptGSS(ctx context.Context, w *Response) (done bool, err error) {
+	mech := c.Server.GSSMechanism
+	if mech == nil || c.Server.gssContexts == nil || c.Server.gssPending == nil {
+		return false, &AuthError{AuthStatBadCred}
+	}
+	var cred gssCred
+	r := bytes.NewReader(w.req.Header.Cred.Body)
+	if err := xdr.Read(r, &cred); err != nil || cred.Version != 1 || r.Len() != 0 {
+		return false, &AuthError{AuthStatBadCred}
+	}
+	contexts := c.Server.gssContexts
+
+	switch cred.Proc {
+	case gssProcInit, gssProcContinueInit:
+		var gctx *gssContext
+		if cred.Proc == gssProcInit {
+			gctx = &gssContext{GSSContext: mech.NewContext()}
+		} else if existing, ok := c.Server.gssPending.Get(string(cred.Handle)); ok {
+			gctx = existing
+		} else {
+			return false, &AuthError{AuthStatRPCGSSCredProblem}
+		}
+		return true, c.gssInit(ctx, w, gctx, cred)
+	case gssProcData, gssProcDestroy:
+	default:
+		return false, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+
+	gctx, ok := contexts.Get(string(cred.Handle))
+	if !ok || !gctx.established.Load() {
+		return false, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	if err := gctx.VerifyMIC(w.req.call, w.req.Header.Verf.Body); err != nil {
+		Log.Debugf("%v: bad rpcsec_gss verifier: %v", w.req, err)
+		return false, &AuthError{AuthStatBadVerifier}
+	}
+	if cred.Seq >= gssMaxSeq {
+		return false, &AuthError{AuthStatRPCGSSCTXProblem}
+	}
+	if !gctx.acceptSeq(cred.Seq) {
+		Log.Debugf("%v: dropping call with replayed rpcsec_gss sequence number %d", w.req, cred.Seq)
+		w.dropped = true
+		return true, nil
+	}
+	mic, err := gctx.GetMIC(xdrUint32(cred.Seq))
+	if err != nil {
+		return false, &AuthError{AuthStatRPCGSSCTXProblem}
+	}
+	w.verf = &rpc.Auth{Flavor: uint32(AuthFlavorRPCSECGSS), Body: mic}
+	w.gss = &gssCall{ctx: gctx, seq: cred.Seq, service: cred.Service}
+	if cred.Proc == gssProcDestroy {
+		if w.req.Header.Proc != 0 {
+			return false, &AuthError{AuthStatRPCGSSCredProblem}
+		}
+		contexts.Remove(string(cred.Handle))
+	}
+
+	switch cred.Service {
+	case GSSServiceNone:
+	case GSSServiceIntegrity, GSSServicePrivacy:
+		args, err := w.gss.unseal(bytes.NewReader(w.req.args))
+		if err != nil {
+			Log.Debugf("%v: %v", w.req, err)
+			return false, &ResponseCodeGarbageArgsError{}
+		}
+		if err := w.drain(ctx); err != nil {
+			return false, err
+		}
+		w.req.args = args
+		w.req.Body = &io.LimitedReader{R: bytes.NewReader(args), N: int64(len(args))}
+	default:
+		return false, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	return false, nil
+}
+
+// gssInit answers a context creation call.
+func (c *conn) gssInit(ctx context.Context, w *Response, gctx *gssContext, cred gssCred) error {
+	if w.req.Header.Proc != 0 {
+		return &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	token, err := xdr.ReadOpaque(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	if err := w.drain(ctx); err != nil {
+		return err
+	}
+
+	res := gssInitRes{SeqWindow: gssSeqWindow}
+	reply, established, err := gctx.Accept(token)
+	var gssErr *GSSError
+	switch {
+	case errors.As(err, &gssErr):
+		res.Major, res.Minor = gssErr.Major, gssErr.Minor
+	case err != nil:
+		res.Major = GSSFailure
+	case !established:
+		res.Major = GSSContinueNeeded
+	}
+	res.Token = reply
+
+	contexts, pending := c.Server.gssContexts, c.Server.gssPending
+	if err == nil {
+		handle := cred.Handle
+		if cred.Proc == gssProcInit {
+			handle = make([]byte, 16)
+			if _, err := rand.Read(handle); err != nil {
+				return err
+			}
+		}
+		res.Handle = handle
+		gctx.established.Store(established)
+		if established {
+			// only a context whose creation completed joins the others.
+			pending.Remove(string(handle))
+			contexts.Add(string(handle), gctx)
+			mic, err := gctx.GetMIC(xdrUint32(gssSeqWindow))
+			if err != nil {
+				return err
+			}
+			w.verf = &rpc.Auth{Flavor: uint32(AuthFlavorRPCSECGSS), Body: mic}
+		} else {
+			pending.Add(string(handle), gctx)
+		}
+	} else {
+		Log.Debugf("%v: rpcsec_gss context creation failed: %v", w.req, err)
+		if cred.Proc == gssProcContinueInit {
+			pending.Remove(string(cred.Handle))
+		}
+	}
+
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	return w.WriteXDR(&res)
+}
+
+// unseal reads the integrity or privacy protected arguments of a call.
+func (g *gssCall) unseal(body io.Reader) ([]byte, error) {
+	var data []byte
+	if g.service == GSSServiceIntegrity {
+		databody, err := xdr.ReadOpaque(body)
+		if err != nil {
+			return nil, err
+		}
+		checksum, err := xdr.ReadOpaque(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.ctx.VerifyMIC(databody, checksum); err != nil {
+			return nil, fmt.Errorf("bad rpcsec_gss argument checksum: %w", err)
+		}
+		data = databody
+	} else {
+		wrapped, err := xdr.ReadOpaque(body)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = g.ctx.Unwrap(wrapped); err != nil {
+			return nil, fmt.Errorf("cannot unwrap rpcsec_gss arguments: %w", err)
+		}
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != g.seq {
+		return nil, errors.New("rpcsec_gss argument sequence number does not match")
+	}
+	return data[4:], nil
+}
+
+// sealGSS protects the results of a successful reply with the service of the
+// call.
+func (w *Response) sealGSS() error {
+	if w.gss == nil || w.gss.service == GSSServiceNone || !w.succeeded {
+		return nil
+	}
+	reply := w.writer.Bytes()
+	databody := append(xdrUint32(w.gss.seq), reply[w.bodyStart:]...)
+	sealed := bytes.NewBuffer(append([]byte{}, reply[:w.bodyStart]...))
+	if w.gss.service == GSSServiceIntegrity {
+		checksum, err := w.gss.ctx.GetMIC(databody)
+		if err != nil {
+			return err
+		}
+		if err := xdr.Write(sealed, databody); err != nil {
+			return err
+		}
+		if err := xdr.Write(sealed, checksum); err != nil {
+			return err
+		}
+	} else {
+		wrapped, err := w.gss.ctx.Wrap(databody)
+		if err != nil {
+			return err
+		}
+		if err := xdr.Write(sealed, wrapped); err != nil {
+			return err
+		}
+	}
+	w.writer = sealed
+	return nil
+}
+
+// gssCredentials returns the credentials of a caller with an established
+// context, mapping its principal to an identity through Server.MapPrincipal.
+func (c *conn) gssCredentials(call *gssCall) *Credentials {
+	creds := &Credentials{
+		Flavor:    AuthFlavorRPCSECGSS,
+		Principal: call.ctx.Principal(),
+	}
+	if c.Server.MapPrincipal != nil {
+		if uid, gid, gids, ok := c.Server.MapPrincipal(creds.Principal); ok {
+			creds.UID, creds.GID, creds.GIDs = uid, gid, gids
+			creds.mapped = true
+		}
+	}
+	return creds
+}
+
+func xdrUint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
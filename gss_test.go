@@ -0,0 +1,324 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+// testMech is a GSS mechanism in which the client's first token is its
+// principal, checksums are HMACs keyed by the principal, and wrapping
+// prefixes a checksum to the message with its bytes inverted.
+type testMech struct{}
+
+func (testMech) NewContext() nfs.GSSContext { return &testGSSContext{} }
+
+type testGSSContext struct {
+	principal string
+}
+
+func (c *testGSSContext) Accept(token []byte) ([]byte, bool, error) {
+	if len(token) == 0 {
+		return nil, false, &nfs.GSSError{Major: nfs.GSSFailure}
+	}
+	if string(token) == "more" {
+		// a token that leaves the context half established.
+		return []byte("again"), false, nil
+	}
+	c.principal = string(token)
+	return []byte("welcome"), true, nil
+}
+
+func (c *testGSSContext) Principal() string { return c.principal }
+
+func (c *testGSSContext) GetMIC(msg []byte) ([]byte, error) {
+	return testMIC(c.principal, msg), nil
+}
+
+func (c *testGSSContext) VerifyMIC(msg, mic []byte) error {
+	if !hmac.Equal(mic, testMIC(c.principal, msg)) {
+		return errors.New("bad mic")
+	}
+	return nil
+}
+
+func (c *testGSSContext) Wrap(msg []byte) ([]byte, error) {
+	return testWrap(c.principal, msg), nil
+}
+
+func (c *testGSSContext) Unwrap(msg []byte) ([]byte, error) {
+	return testUnwrap(c.principal, msg)
+}
+
+func testMIC(key string, msg []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func testWrap(key string, msg []byte) []byte {
+	wrapped := testMIC(key, msg)
+	for _, b := range msg {
+		wrapped = append(wrapped, ^b)
+	}
+	return wrapped
+}
+
+func testUnwrap(key string, msg []byte) ([]byte, error) {
+	if len(msg) < sha256.Size {
+		return nil, errors.New("short token")
+	}
+	plain := make([]byte, 0, len(msg)-sha256.Size)
+	for _, b := range msg[sha256.Size:] {
+		plain = append(plain, ^b)
+	}
+	if !hmac.Equal(msg[:sha256.Size], testMIC(key, plain)) {
+		return nil, errors.New("bad mic")
+	}
+	return plain, nil
+}
+
+// gssClient makes raw RPCSEC_GSS calls as principal.
+type gssClient struct {
+	t         *testing.T
+	c         net.Conn
+	principal string
+	handle    []byte
+}
+
+func xdrUint32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// send writes a call with an RPCSEC_GSS credential for gproc, sealing args
+// with service.
+func (g *gssClient) send(xid, prog, vers, proc, gproc, seq, service uint32, args []byte) {
+	cred := append(xdrUint32s(1, gproc, seq, service), xdrOpaque(g.handle)...)
+	msg := append(xdrUint32s(xid, 0, 2, prog, vers, proc, 6), xdrOpaque(cred)...)
+	if gproc == 1 {
+		msg = append(msg, xdrUint32s(0, 0)...)
+	} else {
+		msg = append(append(msg, xdrUint32s(6)...), xdrOpaque(testMIC(g.principal, msg))...)
+	}
+	databody := append(xdrUint32s(seq), args...)
+	switch service {
+	case 2:
+		args = append(xdrOpaque(databody), xdrOpaque(testMIC(g.principal, databody))...)
+	case 3:
+		args = xdrOpaque(testWrap(g.principal, databody))
+	}
+	writeFragments(g.t, g.c, append(msg, args...), 1<<20)
+}
+
+// receive reads a reply, checking its verifier is a checksum of seq and
+// unsealing its results.
+func (g *gssClient) receive(seq, service uint32) (xid uint32, res []byte) {
+	g.t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(g.c, hdr[:]); err != nil {
+		g.t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	if _, err := io.ReadFull(g.c, body); err != nil {
+		g.t.Fatal(err)
+	}
+	r := bytes.NewReader(body)
+	var head [5]uint32
+	if err := binary.Read(r, binary.BigEndian, &head); err != nil || head[2] != 0 || head[3] != 6 {
+		g.t.Fatalf("unexpected reply: %x", body)
+	}
+	verf := make([]byte, head[4])
+	r.Read(verf)
+	if !bytes.Equal(verf, testMIC(g.principal, xdrUint32s(seq))) {
+		g.t.Fatalf("bad reply verifier: %x", body)
+	}
+	var stat uint32
+	if err := binary.Read(r, binary.BigEndian, &stat); err != nil || stat != 0 {
+		g.t.Fatalf("call was not accepted: %x", body)
+	}
+	res, _ = io.ReadAll(r)
+	switch service {
+	case 2:
+		n := binary.BigEndian.Uint32(res)
+		databody, checksum := res[4:4+n], res[4+(n+3)&^3+4:]
+		if !bytes.Equal(checksum, testMIC(g.principal, databody)) {
+			g.t.Fatalf("bad reply checksum: %x", body)
+		}
+		res = databody
+	case 3:
+		plain, err := testUnwrap(g.principal, res[4:4+binary.BigEndian.Uint32(res)])
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		res = plain
+	}
+	if service != 1 {
+		if binary.BigEndian.Uint32(res) != seq {
+			g.t.Fatalf("reply sequence number mismatch: %x", res)
+		}
+		res = res[4:]
+	}
+	return head[0], res
+}
+
+// principalHandler records the credentials seen by Mount.
+type principalHandler struct {
+	nfs.Handler
+	mounted chan *nfs.Credentials
+}
+
+func (h *principalHandler) Mount(ctx context.Context, c net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	creds, _ := nfs.CredentialsFromContext(ctx)
+	h.mounted <- creds
+	status, fs, _ := h.Handler.Mount(ctx, c, req)
+	return status, fs, []nfs.AuthFlavor{nfs.AuthFlavorKrb5i, nfs.AuthFlavorKrb5p}
+}
+
+func TestRPCSECGSS(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+	handler := &principalHandler{helpers.NewNullAuthHandler(mem), make(chan *nfs.Credentials, 1)}
+	srv := &nfs.Server{
+		Handler:      helpers.NewCachingHandler(handler, 1024),
+		GSSMechanism: testMech{},
+		MapPrincipal: func(principal string) (uint32, uint32, []uint32, bool) {
+			return 1000, 100, nil, principal == "alice@EXAMPLE.COM"
+		},
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	g := &gssClient{t: t, c: c, principal: "alice@EXAMPLE.COM"}
+
+	// establish a context.
+	g.send(1, 100003, 3, 0, 1, 0, 1, xdrOpaque([]byte(g.principal)))
+	_, res := g.receive(128, 1)
+	g.handle = res[4 : 4+binary.BigEndian.Uint32(res)]
+	rest := res[4+(len(g.handle)+3)&^3:]
+	if major, window := binary.BigEndian.Uint32(rest), binary.BigEndian.Uint32(rest[8:]); major != 0 || window != 128 {
+		t.Fatalf("context not established: %x", res)
+	}
+
+	// mount, as the principal's mapped identity.
+	g.send(2, 100005, 3, 1, 0, 1, 1, xdrOpaque([]byte("/")))
+	_, res = g.receive(1, 1)
+	if status := binary.BigEndian.Uint32(res); status != 0 {
+		t.Fatalf("mount failed: %x", res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	creds := <-handler.mounted
+	if creds.Principal != g.principal || !creds.HasIdentity() || creds.UID != 1000 || creds.GID != 100 {
+		t.Fatalf("unexpected credentials for mount: %+v", creds)
+	}
+
+	// fsinfo, with integrity and then privacy.
+	for seq, service := range map[uint32]uint32{2: 2, 3: 3} {
+		g.send(seq+1, 100003, 3, uint32(nfs.NFSProcedureFSInfo), 0, seq, service, xdrOpaque(fh))
+		_, res = g.receive(seq, service)
+		if status := binary.BigEndian.Uint32(res); status != 0 {
+			t.Fatalf("fsinfo with service %d failed: %x", service, res)
+		}
+	}
+
+	// a replayed sequence number is dropped.
+	g.send(5, 100003, 3, uint32(nfs.NFSProcedureFSInfo), 0, 3, 2, xdrOpaque(fh))
+	g.send(6, 100003, 3, uint32(nfs.NFSProcedureFSInfo), 0, 4, 2, xdrOpaque(fh))
+	if xid, _ := g.receive(4, 2); xid != 6 {
+		t.Fatalf("replayed call was answered")
+	}
+
+	// the export requires integrity at least.
+	g.send(7, 100003, 3, uint32(nfs.NFSProcedureFSInfo), 0, 5, 1, xdrOpaque(fh))
+	if !readTooWeak(t, c) {
+		t.Fatal("call without integrity was not refused")
+	}
+
+	// a retransmission, with a new sequence number, is answered from the
+	// duplicate request cache and protected for that sequence number.
+	remove := append(xdrOpaque(fh), xdrOpaque([]byte("test"))...)
+	for seq := uint32(6); seq < 8; seq++ {
+		g.send(8, 100003, 3, uint32(nfs.NFSProcedureRemove), 0, seq, 2, remove)
+		if _, res := g.receive(seq, 2); binary.BigEndian.Uint32(res) != 0 {
+			t.Fatalf("remove with sequence number %d failed: %x", seq, res)
+		}
+	}
+}
+
+func TestRPCSECGSSPendingContexts(t *testing.T) {
+	srv := &nfs.Server{
+		Handler:      helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024),
+		GSSMechanism: testMech{},
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	g := &gssClient{t: t, c: c, principal: "alice@EXAMPLE.COM"}
+	g.send(1, 100003, 3, 0, 1, 0, 1, xdrOpaque([]byte(g.principal)))
+	_, res := g.receive(128, 1)
+	g.handle = res[4 : 4+binary.BigEndian.Uint32(res)]
+
+	// many contexts whose creation is never completed.
+	flood := &gssClient{t: t, c: c}
+	var pending []byte
+	for xid := uint32(2); xid < 2+1100; xid++ {
+		flood.send(xid, 100003, 3, 0, 1, 0, 1, xdrOpaque([]byte("more")))
+		_, stat, res := readReplyBody(t, c)
+		if stat != 0 || binary.BigEndian.Uint32(res[4+(binary.BigEndian.Uint32(res)+3)&^3:]) != uint32(nfs.GSSContinueNeeded) {
+			t.Fatalf("unexpected reply to a partial context creation: %d %x", stat, res)
+		}
+		pending = res[4 : 4+binary.BigEndian.Uint32(res)]
+	}
+
+	// the established context is still usable.
+	g.send(2000, 100003, 3, 0, 0, 1, 1, nil)
+	if xid, _ := g.receive(1, 1); xid != 2000 {
+		t.Fatalf("unexpected reply %d", xid)
+	}
+	// and the most recent creation can be completed.
+	bob := &gssClient{t: t, c: c, principal: "bob@EXAMPLE.COM", handle: pending}
+	bob.send(2001, 100003, 3, 0, 2, 0, 1, xdrOpaque([]byte(bob.principal)))
+	if xid, _ := bob.receive(128, 1); xid != 2001 {
+		t.Fatalf("unexpected reply %d", xid)
+	}
+	bob.send(2002, 100003, 3, 0, 0, 1, 1, nil)
+	if xid, _ := bob.receive(1, 1); xid != 2002 {
+		t.Fatalf("unexpected reply %d", xid)
+	}
+}
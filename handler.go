@@ -33,6 +33,29 @@ type Handler interface {
 	HandleLimit() int
 }
 
+// ExportLister is an optional interface for handlers that can list the
+// exports clients may mount, as reported by MOUNTPROC_EXPORT (showmount -e).
+type ExportLister interface {
+	Exports(context.Context) []Export
+}
+
+// Export describes an export to clients. Groups are the hosts or netgroups
+// that may mount it; none means any.
+type Export struct {
+	Dirpath string
+	Groups  []string
+}
+
+// QuotaHandler is an optional interface for handlers that report the disk
+// quotas of users and groups, which clients read with quota(1) through the
+// remote quota protocol. Like FSStat, it is given the filesystem of an
+// export, here the one the client mounted at the path it names.
+type QuotaHandler interface {
+	// Quota returns the quota of the user or group id on a filesystem, or
+	// nil if it has none.
+	Quota(ctx context.Context, fs billy.Filesystem, kind QuotaType, id uint32) (*Quota, error)
+}
+
 // UnixChange extends the billy `Change` interface with support for special files.
 type UnixChange interface {
 	billy.Change
@@ -1,9 +1,11 @@
 package helpers
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"io/fs"
+	"net"
 	"reflect"
 	"sync"
 
@@ -204,3 +206,57 @@ func (c *CachingHandler) DataForVerifier(path string, id uint64) []fs.FileInfo {
 	}
 	return nil
 }
+
+// ChangeContext passes the request context to the wrapped handler when it
+// implements nfs.ContextChangeHandler.
+func (c *CachingHandler) ChangeContext(ctx context.Context, fs billy.Filesystem) billy.Change {
+	if ch, ok := c.Handler.(nfs.ContextChangeHandler); ok {
+		return ch.ChangeContext(ctx, fs)
+	}
+	return c.Handler.Change(fs)
+}
+
+// AuthorizeExport passes calls to the wrapped handler when it implements
+// nfs.ExportAuthorizer.
+func (c *CachingHandler) AuthorizeExport(ctx context.Context, conn net.Conn, fs billy.Filesystem, creds *nfs.Credentials) (*nfs.Credentials, error) {
+	if a, ok := c.Handler.(nfs.ExportAuthorizer); ok {
+		return a.AuthorizeExport(ctx, conn, fs, creds)
+	}
+	return creds, nil
+}
+
+// ExportOf resolves exports with the wrapped handler when it implements
+// nfs.ExportResolver.
+func (c *CachingHandler) ExportOf(fs billy.Filesystem) (string, []nfs.AuthFlavor, bool) {
+	if r, ok := c.Handler.(nfs.ExportResolver); ok {
+		return r.ExportOf(fs)
+	}
+	return "", nil, false
+}
+
+// Exports lists the exports of the wrapped handler when it implements
+// nfs.ExportLister.
+func (c *CachingHandler) Exports(ctx context.Context) []nfs.Export {
+	if l, ok := c.Handler.(nfs.ExportLister); ok {
+		return l.Exports(ctx)
+	}
+	return nil
+}
+
+// Quota reports the quotas of the wrapped handler when it implements
+// nfs.QuotaHandler.
+func (c *CachingHandler) Quota(ctx context.Context, fs billy.Filesystem, kind nfs.QuotaType, id uint32) (*nfs.Quota, error) {
+	if q, ok := c.Handler.(nfs.QuotaHandler); ok {
+		return q.Quota(ctx, fs, kind, id)
+	}
+	return nil, nil
+}
+
+// MapCredentials passes callers' credentials to the wrapped handler when it
+// implements nfs.CredentialsMapper.
+func (c *CachingHandler) MapCredentials(fs billy.Filesystem, creds *nfs.Credentials) *nfs.Credentials {
+	if m, ok := c.Handler.(nfs.CredentialsMapper); ok {
+		return m.MapCredentials(fs, creds)
+	}
+	return creds
+}
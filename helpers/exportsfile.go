@@ -0,0 +1,236 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultExportOptions are the options exports(5) gives a host for which
+// none are listed: ro, secure, root_squash, anonuid=65534, anongid=65534
+// and sec=sys.
+var DefaultExportOptions = ExportOptions{
+	ReadOnly:   true,
+	Secure:     true,
+	RootSquash: true,
+	Flavors:    []nfs.AuthFlavor{nfs.AuthFlavorUnix},
+}
+
+// ignoredExportOptions are exports(5) options that do not apply to this
+// server, and are accepted without effect.
+var ignoredExportOptions = map[string]bool{
+	"sync": true, "async": true, "wdelay": true, "no_wdelay": true,
+	"subtree_check": true, "no_subtree_check": true, "hide": true, "nohide": true,
+	"crossmnt": true, "secure_locks": true, "insecure_locks": true,
+	"auth_nlm": true, "no_auth_nlm": true, "acl": true, "no_acl": true,
+	"mountpoint": true, "mp": true, "fsid": true, "refer": true, "replicas": true,
+	"pnfs": true, "no_pnfs": true, "security_label": true,
+}
+
+// ParseExports reads exports in the format of /etc/exports:
+//
+//	/srv/share  10.0.0.0/8(rw,no_root_squash) *.example.com(ro) -sync
+//
+// Each line names a dirpath, optionally quoted, followed by hosts each with
+// their options in parentheses. Options following a '-' are the defaults of
+// the hosts after them on the line. Hosts without options get
+// DefaultExportOptions, and options a host does not list take their default.
+// Lines naming the same dirpath add hosts to the same export. The filesystem
+// of each export is obtained from open.
+func ParseExports(r io.Reader, open func(dirpath string) (billy.Filesystem, error)) ([]ExportConfig, error) {
+	var exports []ExportConfig
+	index := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	line, lineno := "", 0
+	for scanner.Scan() {
+		lineno++
+		text := scanner.Text()
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		dirpath, clients, err := parseExportLine(line)
+		line = ""
+		if err != nil {
+			return nil, fmt.Errorf("exports line %d: %w", lineno, err)
+		}
+		if dirpath == "" {
+			continue
+		}
+		if i, ok := index[dirpath]; ok {
+			exports[i].Clients = append(exports[i].Clients, clients...)
+			continue
+		}
+		fs, err := open(dirpath)
+		if err != nil {
+			return nil, fmt.Errorf("exports line %d: %w", lineno, err)
+		}
+		index[dirpath] = len(exports)
+		exports = append(exports, ExportConfig{Dirpath: dirpath, Filesystem: fs, Clients: clients})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// parseExportLine parses one logical line of an exports file, returning an
+// empty dirpath for blank lines and comments.
+func parseExportLine(line string) (string, []ExportClient, error) {
+	fields, err := splitExportLine(line)
+	if err != nil || len(fields) == 0 {
+		return "", nil, err
+	}
+	dirpath := fields[0]
+	if !strings.HasPrefix(dirpath, "/") {
+		return "", nil, fmt.Errorf("%q is not an absolute path", dirpath)
+	}
+	defaults := DefaultExportOptions
+	var clients []ExportClient
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "-") {
+			if err := applyExportOptions(&defaults, field[1:]); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		host, opts := field, ""
+		if i := strings.IndexByte(field, '('); i >= 0 {
+			if !strings.HasSuffix(field, ")") {
+				return "", nil, fmt.Errorf("unterminated options in %q", field)
+			}
+			host, opts = field[:i], field[i+1:len(field)-1]
+		}
+		if host == "" {
+			host = "*"
+		}
+		client := ExportClient{Host: host, ExportOptions: defaults}
+		if err := applyExportOptions(&client.ExportOptions, opts); err != nil {
+			return "", nil, err
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 0 {
+		// an export without hosts is open to any, with the defaults.
+		clients = append(clients, ExportClient{Host: "*", ExportOptions: defaults})
+	}
+	return dirpath, clients, nil
+}
+
+// splitExportLine splits a line into whitespace separated fields, dropping
+// comments. A field may be double quoted, and \ooo octal escapes are
+// decoded, so that paths may contain spaces.
+func splitExportLine(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '"':
+			quoted = !quoted
+			inField = true
+		case ch == '#' && !quoted:
+			i = len(line)
+		case (ch == ' ' || ch == '\t') && !quoted:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		case ch == '\\' && i+3 < len(line) && isOctal(line[i+1:i+4]):
+			v, _ := strconv.ParseUint(line[i+1:i+4], 8, 8)
+			field.WriteByte(byte(v))
+			inField = true
+			i += 3
+		default:
+			field.WriteByte(ch)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func isOctal(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return len(s) == 3
+}
+
+// applyExportOptions sets the comma separated options in list.
+func applyExportOptions(o *ExportOptions, list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, opt := range strings.Split(list, ",") {
+		name, value, hasValue := strings.Cut(opt, "=")
+		switch name {
+		case "ro":
+			o.ReadOnly = true
+		case "rw":
+			o.ReadOnly = false
+		case "secure":
+			o.Secure = true
+		case "insecure":
+			o.Secure = false
+		case "root_squash":
+			o.RootSquash = true
+		case "no_root_squash":
+			o.RootSquash = false
+		case "all_squash":
+			o.AllSquash = true
+		case "no_all_squash":
+			o.AllSquash = false
+		case "anonuid", "anongid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || !hasValue {
+				return fmt.Errorf("invalid %s %q", name, value)
+			}
+			anon := uint32(id)
+			if name == "anonuid" {
+				o.AnonUID = &anon
+			} else {
+				o.AnonGID = &anon
+			}
+		case "sec":
+			flavors := []nfs.AuthFlavor{}
+			for _, sec := range strings.Split(value, ":") {
+				f, ok := exportSecFlavors[sec]
+				if !ok {
+					return fmt.Errorf("unknown security flavor %q", sec)
+				}
+				flavors = append(flavors, f)
+			}
+			o.Flavors = flavors
+		default:
+			if !ignoredExportOptions[name] {
+				return fmt.Errorf("unknown option %q", opt)
+			}
+		}
+	}
+	return nil
+}
+
+// exportSecFlavors are the flavors named by the sec option.
+var exportSecFlavors = map[string]nfs.AuthFlavor{
+	"none":  nfs.AuthFlavorNull,
+	"sys":   nfs.AuthFlavorUnix,
+	"krb5":  nfs.AuthFlavorKrb5,
+	"krb5i": nfs.AuthFlavorKrb5i,
+	"krb5p": nfs.AuthFlavorKrb5p,
+}
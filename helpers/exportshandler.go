@@ -0,0 +1,382 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/willscott/go-nfs"
+)
+
+// ExportConfig is one export of an ExportsHandler.
+type ExportConfig struct {
+	// Dirpath is the path clients mount the export by.
+	Dirpath    string
+	Filesystem billy.Filesystem
+	// Clients are the hosts that may mount the export, each with the options
+	// it is given. The first matching a client applies.
+	Clients []ExportClient
+}
+
+// ExportClient is a set of hosts and the options they are given, as in an
+// exports(5) entry.
+type ExportClient struct {
+	// Host is "*" for any host, an IP address, a CIDR network such as
+	// 10.0.0.0/8, or a hostname matched against the forward-confirmed
+	// reverse lookup of the client's address, which may contain the
+	// wildcards * and ?.
+	Host string
+	ExportOptions
+}
+
+// ExportOptions are the options of an export for a set of hosts. The zero
+// value is permissive, unlike the defaults of exports(5), which
+// ParseExports applies.
+type ExportOptions struct {
+	// ReadOnly refuses changes to the export.
+	ReadOnly bool
+	// Secure requires calls to come from a port below 1024.
+	Secure bool
+	// RootSquash and AllSquash treat callers with uid 0, or every caller,
+	// as the anonymous user with AnonUID and AnonGID, 65534 if unset.
+	RootSquash bool
+	AllSquash  bool
+	AnonUID    *uint32
+	AnonGID    *uint32
+	// Flavors are the authentication flavors callers may use. None means
+	// any.
+	Flavors []nfs.AuthFlavor
+}
+
+// NewExportsHandler creates a handler serving each of exports at its
+// dirpath.
+func NewExportsHandler(exports []ExportConfig) (*ExportsHandler, error) {
+	h := &ExportsHandler{
+		exports:   make([]*exportEntry, 0, len(exports)),
+		hostnames: expirable.NewLRU[string, []string](1024, nil, time.Minute),
+	}
+	for _, e := range exports {
+		if e.Filesystem == nil {
+			return nil, fmt.Errorf("export %s has no filesystem", e.Dirpath)
+		}
+		dirpath := path.Clean("/" + e.Dirpath)
+		for _, existing := range h.exports {
+			if existing.Dirpath == dirpath {
+				return nil, fmt.Errorf("export %s is listed twice", dirpath)
+			}
+		}
+		entry := &exportEntry{ExportConfig: e}
+		entry.Dirpath = dirpath
+		entry.Clients = append([]ExportClient{}, e.Clients...)
+		for _, c := range e.Clients {
+			if c.Host == "" {
+				return nil, fmt.Errorf("export %s has a client without a host", dirpath)
+			}
+			if strings.HasPrefix(c.Host, "@") {
+				return nil, fmt.Errorf("export %s: netgroups are not supported", dirpath)
+			}
+			if _, network, err := net.ParseCIDR(c.Host); err == nil {
+				entry.networks = append(entry.networks, network)
+			} else {
+				entry.networks = append(entry.networks, nil)
+			}
+			entry.filesystems = append(entry.filesystems, &exportFS{e.Filesystem, entry, len(entry.filesystems)})
+		}
+		h.exports = append(h.exports, entry)
+	}
+	return h, nil
+}
+
+// ExportsHandler serves several filesystems, each at its own dirpath and
+// with options for the hosts that may mount it, like the exports(5) of a
+// kernel server. Wrap it with NewCachingHandler for file handles.
+//
+// The filesystem of an export is presented to the server separately for each
+// of its client entries, so file handles carry the export and entry they were
+// issued for, and a handle is only honoured for clients that entry matches.
+type ExportsHandler struct {
+	exports []*exportEntry
+	// hostnames caches the reverse lookups of client addresses.
+	hostnames *expirable.LRU[string, []string]
+}
+
+type exportEntry struct {
+	ExportConfig
+	// networks holds the parsed network of each client given in CIDR form.
+	networks []*net.IPNet
+	// filesystems holds the filesystem presented for each client entry.
+	filesystems []*exportFS
+}
+
+// exportFS is the filesystem of an export as seen by the clients matching
+// one of its entries. Each entry has a single exportFS, so that the
+// filesystems of handles issued for it compare equal without being walked.
+type exportFS struct {
+	billy.Filesystem
+	export *exportEntry
+	client int
+}
+
+// Capabilities implements billy.Capable, removing write capabilities from
+// read-only exports.
+func (f *exportFS) Capabilities() billy.Capability {
+	caps := billy.Capabilities(f.Filesystem)
+	if f.options().ReadOnly {
+		caps &^= billy.WriteCapability | billy.ReadAndWriteCapability | billy.TruncateCapability
+	}
+	return caps
+}
+
+// WithContext implements nfs.ContextFilesystem when the export's filesystem
+// does.
+func (f *exportFS) WithContext(ctx context.Context) billy.Filesystem {
+	if cfs, ok := f.Filesystem.(nfs.ContextFilesystem); ok {
+		return &exportFS{cfs.WithContext(ctx), f.export, f.client}
+	}
+	return f
+}
+
+// GetACL implements nfs.ACLChange when the export's filesystem does.
+func (f *exportFS) GetACL(path string, def bool) ([]nfs.ACLEntry, error) {
+	if ac, ok := f.Filesystem.(nfs.ACLChange); ok {
+		return ac.GetACL(path, def)
+	}
+	return nil, errACLNotSupported
+}
+
+// SetACL implements nfs.ACLChange when the export's filesystem does.
+func (f *exportFS) SetACL(path string, def bool, acl []nfs.ACLEntry) error {
+	if ac, ok := f.Filesystem.(nfs.ACLChange); ok {
+		return ac.SetACL(path, def, acl)
+	}
+	return errACLNotSupported
+}
+
+func (f *exportFS) options() *ExportOptions {
+	return &f.export.Clients[f.client].ExportOptions
+}
+
+// flavors are the flavors offered to the clients of the export's entry.
+func (f *exportFS) flavors() []nfs.AuthFlavor {
+	if flavors := f.options().Flavors; len(flavors) > 0 {
+		return flavors
+	}
+	return []nfs.AuthFlavor{nfs.AuthFlavorUnix, nfs.AuthFlavorNull}
+}
+
+// Mount gives clients the export at the requested dirpath, if one of its
+// entries matches them.
+func (h *ExportsHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	dirpath := path.Clean("/" + string(req.Dirpath))
+	for _, e := range h.exports {
+		if e.Dirpath != dirpath {
+			continue
+		}
+		client, ok := h.match(ctx, e, conn.RemoteAddr())
+		if !ok {
+			nfs.Log.Debugf("refusing mount of %s by %v: host not allowed", dirpath, conn.RemoteAddr())
+			return nfs.MountStatusErrAcces, nil, nil
+		}
+		fs := e.filesystems[client]
+		opts := fs.options()
+		if opts.Secure && !securePort(conn.RemoteAddr()) {
+			nfs.Log.Debugf("refusing mount of %s by %v: insecure port", dirpath, conn.RemoteAddr())
+			return nfs.MountStatusErrAcces, nil, nil
+		}
+		return nfs.MountStatusOk, fs, fs.flavors()
+	}
+	return nfs.MountStatusErrNoEnt, nil, nil
+}
+
+// ExportOf implements nfs.ExportResolver.
+func (h *ExportsHandler) ExportOf(fs billy.Filesystem) (string, []nfs.AuthFlavor, bool) {
+	efs, ok := fs.(*exportFS)
+	if !ok {
+		return "", nil, false
+	}
+	return efs.export.Dirpath, efs.flavors(), true
+}
+
+// AuthorizeExport implements nfs.ExportAuthorizer, refusing calls from
+// clients the entry a file handle was issued for does not match, or from an
+// insecure port or with a flavor the entry does not allow, and squashing
+// callers as configured.
+func (h *ExportsHandler) AuthorizeExport(ctx context.Context, conn net.Conn, fs billy.Filesystem, creds *nfs.Credentials) (*nfs.Credentials, error) {
+	efs, ok := fs.(*exportFS)
+	if !ok {
+		return creds, nil
+	}
+	if client, ok := h.match(ctx, efs.export, conn.RemoteAddr()); !ok || client != efs.client {
+		return nil, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusAccess, WrappedErr: os.ErrPermission}
+	}
+	opts := efs.options()
+	if opts.Secure && !securePort(conn.RemoteAddr()) {
+		return nil, &nfs.AuthError{AuthStat: nfs.AuthStatTooWeak}
+	}
+	if len(opts.Flavors) > 0 && !allowsFlavor(opts.Flavors, creds) {
+		return nil, &nfs.AuthError{AuthStat: nfs.AuthStatTooWeak}
+	}
+	if creds.HasIdentity() && (opts.AllSquash || opts.RootSquash && creds.UID == 0) {
+		squashed := *creds
+		squashed.UID = anonID(opts.AnonUID)
+		squashed.GID = anonID(opts.AnonGID)
+		squashed.GIDs = nil
+		return &squashed, nil
+	}
+	return creds, nil
+}
+
+// Exports implements nfs.ExportLister.
+func (h *ExportsHandler) Exports(ctx context.Context) []nfs.Export {
+	exports := make([]nfs.Export, 0, len(h.exports))
+	for _, e := range h.exports {
+		export := nfs.Export{Dirpath: e.Dirpath}
+		for _, c := range e.Clients {
+			export.Groups = append(export.Groups, c.Host)
+		}
+		exports = append(exports, export)
+	}
+	return exports
+}
+
+// Change provides an interface for updating file attributes, unless the
+// export is read-only.
+func (h *ExportsHandler) Change(fs billy.Filesystem) billy.Change {
+	efs, ok := fs.(*exportFS)
+	if !ok || efs.options().ReadOnly {
+		return nil
+	}
+	if c, ok := efs.Filesystem.(billy.Change); ok {
+		return c
+	}
+	return nil
+}
+
+// FSStat provides information about a filesystem.
+func (h *ExportsHandler) FSStat(ctx context.Context, f billy.Filesystem, s *nfs.FSStat) error {
+	return nil
+}
+
+// ToHandle handled by CachingHandler
+func (h *ExportsHandler) ToHandle(f billy.Filesystem, s []string) []byte {
+	return []byte{}
+}
+
+// FromHandle handled by CachingHandler
+func (h *ExportsHandler) FromHandle([]byte) (billy.Filesystem, []string, error) {
+	return nil, []string{}, nil
+}
+
+// InvalidateHandle handled by CachingHandler
+func (h *ExportsHandler) InvalidateHandle(billy.Filesystem, []byte) error {
+	return nil
+}
+
+// HandleLimit handled by CachingHandler
+func (h *ExportsHandler) HandleLimit() int {
+	return -1
+}
+
+// match returns the index of the first client entry of an export matching
+// addr.
+func (h *ExportsHandler) match(ctx context.Context, e *exportEntry, addr net.Addr) (int, bool) {
+	host := addr.String()
+	if ip, _, err := net.SplitHostPort(host); err == nil {
+		host = ip
+	}
+	ip := net.ParseIP(host)
+	var names []string
+	for i, c := range e.Clients {
+		switch {
+		case c.Host == "*":
+			return i, true
+		case e.networks[i] != nil:
+			if ip != nil && e.networks[i].Contains(ip) {
+				return i, true
+			}
+		case net.ParseIP(c.Host) != nil:
+			if ip != nil && ip.Equal(net.ParseIP(c.Host)) {
+				return i, true
+			}
+		default:
+			if names == nil {
+				names = h.lookup(ctx, host)
+			}
+			for _, name := range names {
+				if ok, _ := path.Match(strings.ToLower(c.Host), name); ok {
+					return i, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the names of a client address, in lower case and without
+// a trailing dot. Only names that resolve back to the address are returned,
+// as whoever controls the reverse zone of an address may claim any name.
+func (h *ExportsHandler) lookup(ctx context.Context, host string) []string {
+	if names, ok := h.hostnames.Get(host); ok {
+		return names
+	}
+	names := []string{}
+	found, err := net.DefaultResolver.LookupAddr(ctx, host)
+	if err != nil && !isNotFound(err) {
+		// do not cache failures that may be transient.
+		return names
+	}
+	ip := net.ParseIP(host)
+	for _, name := range found {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil && !isNotFound(err) {
+			return []string{}
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				names = append(names, strings.ToLower(strings.TrimSuffix(name, ".")))
+				break
+			}
+		}
+	}
+	h.hostnames.Add(host, names)
+	return names
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// securePort reports whether addr has a port below 1024, as only privileged
+// processes may bind.
+func securePort(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port < 1024
+	case *net.UDPAddr:
+		return a.Port < 1024
+	}
+	return false
+}
+
+// allowsFlavor reports whether a caller's flavor is among flavors. An
+// RPCSEC_GSS caller is allowed by any of the Kerberos pseudo-flavors, the
+// server checking the service they require, and AUTH_NULL allows any flavor.
+func allowsFlavor(flavors []nfs.AuthFlavor, creds *nfs.Credentials) bool {
+	for _, f := range flavors {
+		switch {
+		case f == nfs.AuthFlavorNull, f == creds.Flavor:
+			return true
+		case creds.Flavor == nfs.AuthFlavorRPCSECGSS && (f == nfs.AuthFlavorKrb5 || f == nfs.AuthFlavorKrb5i || f == nfs.AuthFlavorKrb5p):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,386 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/file"
+)
+
+// IdentityMapper translates uids and gids between those of clients and
+// those of the server, as for clients in another directory domain.
+type IdentityMapper interface {
+	ServerUID(clientUID uint32) uint32
+	ServerGID(clientGID uint32) uint32
+	ClientUID(serverUID uint32) uint32
+	ClientGID(serverGID uint32) uint32
+}
+
+// IdentityOptions are the identity export options of an IdentityHandler,
+// named as in exports(5).
+type IdentityOptions struct {
+	// RootSquash treats callers with uid 0 as the anonymous user.
+	RootSquash bool
+	// AllSquash treats every caller as the anonymous user.
+	AllSquash bool
+	// AnonUID and AnonGID are the server uid and gid of the anonymous user,
+	// 65534 if unset.
+	AnonUID *uint32
+	AnonGID *uint32
+	// Mapper, if set, translates the ids of callers and of file owners.
+	Mapper IdentityMapper
+}
+
+// NewIdentityHandler wraps a handler to squash or translate the identity of
+// callers.
+func NewIdentityHandler(h nfs.Handler, opts IdentityOptions) nfs.Handler {
+	return &IdentityHandler{Handler: h, IdentityOptions: opts}
+}
+
+// IdentityHandler applies root_squash, all_squash and identity mapping to the
+// exports of the handler it wraps.
+//
+// Callers are squashed before permissions are checked. When a Mapper is set,
+// filesystems are presented to the server with owners in client ids, so that
+// they compare with the callers' credentials; the client ids of chown are
+// translated to server ids, as are the credentials passed to the wrapped
+// handler and to filesystems implementing nfs.ContextFilesystem.
+type IdentityHandler struct {
+	nfs.Handler
+	IdentityOptions
+}
+
+// MapCredentials squashes callers as configured.
+func (h *IdentityHandler) MapCredentials(fs billy.Filesystem, creds *nfs.Credentials) *nfs.Credentials {
+	if !creds.HasIdentity() || !(h.AllSquash || h.RootSquash && creds.UID == 0) {
+		return creds
+	}
+	squashed := *creds
+	squashed.UID = h.clientUID(anonID(h.AnonUID))
+	squashed.GID = h.clientGID(anonID(h.AnonGID))
+	squashed.GIDs = nil
+	return &squashed
+}
+
+// anonID is the id of the anonymous user, or nobody if it is unset.
+func anonID(id *uint32) uint32 {
+	if id == nil {
+		return 65534
+	}
+	return *id
+}
+
+// Mount passes the mount request to the wrapped handler with the server
+// identity of the caller.
+func (h *IdentityHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, fs, auths := h.Handler.Mount(h.serverContext(ctx), conn, req)
+	return status, h.wrap(fs), auths
+}
+
+// AuthorizeExport passes calls to the wrapped handler when it implements
+// nfs.ExportAuthorizer.
+func (h *IdentityHandler) AuthorizeExport(ctx context.Context, conn net.Conn, fs billy.Filesystem, creds *nfs.Credentials) (*nfs.Credentials, error) {
+	if a, ok := h.Handler.(nfs.ExportAuthorizer); ok {
+		return a.AuthorizeExport(ctx, conn, h.unwrap(fs), creds)
+	}
+	return creds, nil
+}
+
+// ExportOf resolves exports with the wrapped handler when it implements
+// nfs.ExportResolver.
+func (h *IdentityHandler) ExportOf(fs billy.Filesystem) (string, []nfs.AuthFlavor, bool) {
+	if r, ok := h.Handler.(nfs.ExportResolver); ok {
+		return r.ExportOf(h.unwrap(fs))
+	}
+	return "", nil, false
+}
+
+// Exports lists the exports of the wrapped handler when it implements
+// nfs.ExportLister.
+func (h *IdentityHandler) Exports(ctx context.Context) []nfs.Export {
+	if l, ok := h.Handler.(nfs.ExportLister); ok {
+		return l.Exports(ctx)
+	}
+	return nil
+}
+
+// Change returns a billy.Change taking the owners of chown in client ids.
+func (h *IdentityHandler) Change(fs billy.Filesystem) billy.Change {
+	return h.wrapChange(h.Handler.Change(h.unwrap(fs)))
+}
+
+// ChangeContext is Change, passing the server identity of the caller to the
+// wrapped handler when it implements nfs.ContextChangeHandler.
+func (h *IdentityHandler) ChangeContext(ctx context.Context, fs billy.Filesystem) billy.Change {
+	if ch, ok := h.Handler.(nfs.ContextChangeHandler); ok {
+		return h.wrapChange(ch.ChangeContext(h.serverContext(ctx), h.unwrap(fs)))
+	}
+	return h.Change(fs)
+}
+
+// FSStat provides information about a filesystem.
+func (h *IdentityHandler) FSStat(ctx context.Context, fs billy.Filesystem, s *nfs.FSStat) error {
+	return h.Handler.FSStat(h.serverContext(ctx), h.unwrap(fs), s)
+}
+
+// Quota reports the quota of the server identity of a client user or group
+// when the wrapped handler implements nfs.QuotaHandler.
+func (h *IdentityHandler) Quota(ctx context.Context, fs billy.Filesystem, kind nfs.QuotaType, id uint32) (*nfs.Quota, error) {
+	q, ok := h.Handler.(nfs.QuotaHandler)
+	if !ok {
+		return nil, nil
+	}
+	if kind == nfs.QuotaGroup {
+		id = h.serverGID(id)
+	} else {
+		id = h.serverUID(id)
+	}
+	return q.Quota(h.serverContext(ctx), h.unwrap(fs), kind, id)
+}
+
+// ToHandle represents a file with a handle of the wrapped handler.
+func (h *IdentityHandler) ToHandle(fs billy.Filesystem, path []string) []byte {
+	return h.Handler.ToHandle(h.unwrap(fs), path)
+}
+
+// FromHandle converts a handle of the wrapped handler to the file it represents.
+func (h *IdentityHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	fs, path, err := h.Handler.FromHandle(fh)
+	return h.wrap(fs), path, err
+}
+
+// InvalidateHandle invalidates a handle of the wrapped handler.
+func (h *IdentityHandler) InvalidateHandle(fs billy.Filesystem, fh []byte) error {
+	return h.Handler.InvalidateHandle(h.unwrap(fs), fh)
+}
+
+func (h *IdentityHandler) serverUID(uid uint32) uint32 {
+	if h.Mapper == nil {
+		return uid
+	}
+	return h.Mapper.ServerUID(uid)
+}
+
+func (h *IdentityHandler) serverGID(gid uint32) uint32 {
+	if h.Mapper == nil {
+		return gid
+	}
+	return h.Mapper.ServerGID(gid)
+}
+
+func (h *IdentityHandler) clientUID(uid uint32) uint32 {
+	if h.Mapper == nil {
+		return uid
+	}
+	return h.Mapper.ClientUID(uid)
+}
+
+func (h *IdentityHandler) clientGID(gid uint32) uint32 {
+	if h.Mapper == nil {
+		return gid
+	}
+	return h.Mapper.ClientGID(gid)
+}
+
+// serverContext translates the caller's credentials in ctx to server ids.
+func (h *IdentityHandler) serverContext(ctx context.Context) context.Context {
+	creds, ok := nfs.CredentialsFromContext(ctx)
+	if !ok || !creds.HasIdentity() || h.Mapper == nil {
+		return ctx
+	}
+	mapped := *creds
+	mapped.UID = h.serverUID(creds.UID)
+	mapped.GID = h.serverGID(creds.GID)
+	mapped.GIDs = make([]uint32, len(creds.GIDs))
+	for i, g := range creds.GIDs {
+		mapped.GIDs[i] = h.serverGID(g)
+	}
+	return nfs.WithCredentials(ctx, &mapped)
+}
+
+// wrap presents a filesystem of the wrapped handler with owners in client ids.
+func (h *IdentityHandler) wrap(fs billy.Filesystem) billy.Filesystem {
+	if fs == nil || h.Mapper == nil {
+		return fs
+	}
+	if _, ok := fs.(identityFS); ok {
+		return fs
+	}
+	return identityFS{fs, h}
+}
+
+func (h *IdentityHandler) unwrap(fs billy.Filesystem) billy.Filesystem {
+	if ifs, ok := fs.(identityFS); ok {
+		return ifs.Filesystem
+	}
+	return fs
+}
+
+func (h *IdentityHandler) wrapChange(c billy.Change) billy.Change {
+	if c == nil || h.Mapper == nil {
+		return c
+	}
+	if uc, ok := c.(nfs.UnixChange); ok {
+		return identityUnixChange{uc, h}
+	}
+	return identityChange{c, h}
+}
+
+// identityFS reports the owners of files in client ids. It is a value, so
+// that wrapping a filesystem twice yields equal filesystems.
+type identityFS struct {
+	billy.Filesystem
+	h *IdentityHandler
+}
+
+// Capabilities implements billy.Capable.
+func (f identityFS) Capabilities() billy.Capability {
+	return billy.Capabilities(f.Filesystem)
+}
+
+// WithContext implements nfs.ContextFilesystem, passing the server identity
+// of the caller to the wrapped filesystem.
+func (f identityFS) WithContext(ctx context.Context) billy.Filesystem {
+	if cfs, ok := f.Filesystem.(nfs.ContextFilesystem); ok {
+		return identityFS{cfs.WithContext(f.h.serverContext(ctx)), f.h}
+	}
+	return f
+}
+
+func (f identityFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := f.Filesystem.Stat(filename)
+	return f.clientInfo(info), err
+}
+
+func (f identityFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := f.Filesystem.Lstat(filename)
+	return f.clientInfo(info), err
+}
+
+func (f identityFS) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := f.Filesystem.ReadDir(path)
+	for i, info := range infos {
+		infos[i] = f.clientInfo(info)
+	}
+	return infos, err
+}
+
+// GetACL implements nfs.ACLChange when the wrapped filesystem does,
+// reporting the users and groups of entries in client ids.
+func (f identityFS) GetACL(path string, def bool) ([]nfs.ACLEntry, error) {
+	ac, ok := f.Filesystem.(nfs.ACLChange)
+	if !ok {
+		return nil, errACLNotSupported
+	}
+	acl, err := ac.GetACL(path, def)
+	for i, e := range acl {
+		switch e.Tag {
+		case nfs.ACLUser:
+			acl[i].ID = f.h.clientUID(e.ID)
+		case nfs.ACLGroup:
+			acl[i].ID = f.h.clientGID(e.ID)
+		}
+	}
+	return acl, err
+}
+
+// SetACL implements nfs.ACLChange when the wrapped filesystem does,
+// translating the users and groups of entries to server ids.
+func (f identityFS) SetACL(path string, def bool, acl []nfs.ACLEntry) error {
+	ac, ok := f.Filesystem.(nfs.ACLChange)
+	if !ok {
+		return errACLNotSupported
+	}
+	mapped := make([]nfs.ACLEntry, len(acl))
+	for i, e := range acl {
+		switch e.Tag {
+		case nfs.ACLUser:
+			e.ID = f.h.serverUID(e.ID)
+		case nfs.ACLGroup:
+			e.ID = f.h.serverGID(e.ID)
+		}
+		mapped[i] = e
+	}
+	if acl == nil {
+		mapped = nil
+	}
+	sort.SliceStable(mapped, func(i, j int) bool {
+		return mapped[i].Tag < mapped[j].Tag || mapped[i].Tag == mapped[j].Tag && mapped[i].ID < mapped[j].ID
+	})
+	return ac.SetACL(path, def, mapped)
+}
+
+// errACLNotSupported is returned by the ACLs of wrapped filesystems that
+// have none.
+var errACLNotSupported = &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusNotSupp, WrappedErr: os.ErrInvalid}
+
+// clientInfo translates the owner of a file to client ids. Files without
+// ownership information are returned as they are.
+func (f identityFS) clientInfo(info os.FileInfo) os.FileInfo {
+	if info == nil {
+		return nil
+	}
+	a := file.GetInfo(info)
+	if a == nil {
+		return info
+	}
+	mapped := *a
+	mapped.UID = f.h.clientUID(a.UID)
+	mapped.GID = f.h.clientGID(a.GID)
+	return identityInfo{info, &mapped}
+}
+
+type identityInfo struct {
+	os.FileInfo
+	sys *file.FileInfo
+}
+
+func (i identityInfo) Sys() interface{} {
+	return i.sys
+}
+
+// identityChange takes the owners of chown in client ids.
+type identityChange struct {
+	billy.Change
+	h *IdentityHandler
+}
+
+func (c identityChange) Chown(name string, uid, gid int) error {
+	uid, gid = c.h.serverOwner(uid, gid)
+	return c.Change.Chown(name, uid, gid)
+}
+
+func (c identityChange) Lchown(name string, uid, gid int) error {
+	uid, gid = c.h.serverOwner(uid, gid)
+	return c.Change.Lchown(name, uid, gid)
+}
+
+type identityUnixChange struct {
+	nfs.UnixChange
+	h *IdentityHandler
+}
+
+func (c identityUnixChange) Chown(name string, uid, gid int) error {
+	uid, gid = c.h.serverOwner(uid, gid)
+	return c.UnixChange.Chown(name, uid, gid)
+}
+
+func (c identityUnixChange) Lchown(name string, uid, gid int) error {
+	uid, gid = c.h.serverOwner(uid, gid)
+	return c.UnixChange.Lchown(name, uid, gid)
+}
+
+// serverOwner translates an owner to server ids, leaving -1 (no change) as is.
+func (h *IdentityHandler) serverOwner(uid, gid int) (int, int) {
+	if uid >= 0 {
+		uid = int(h.serverUID(uint32(uid)))
+	}
+	if gid >= 0 {
+		gid = int(h.serverGID(uint32(gid)))
+	}
+	return uid, gid
+}
@@ -0,0 +1,67 @@
+package memfs
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+)
+
+// aclFS is the Memory filesystem as returned by New, which keeps the POSIX
+// ACLs that clients set through nfs.ACLChange.
+type aclFS struct {
+	billy.Filesystem
+	m *Memory
+}
+
+// Capabilities implements the Capable interface.
+func (fs aclFS) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
+
+// GetACL implements nfs.ACLChange.
+func (fs aclFS) GetACL(path string, def bool) ([]nfs.ACLEntry, error) {
+	return fs.m.GetACL(fs.Join(fs.Root(), path), def)
+}
+
+// SetACL implements nfs.ACLChange.
+func (fs aclFS) SetACL(path string, def bool, acl []nfs.ACLEntry) error {
+	return fs.m.SetACL(fs.Join(fs.Root(), path), def, acl)
+}
+
+// GetACL returns the access or default ACL of a file.
+func (fs *Memory) GetACL(path string, def bool) ([]nfs.ACLEntry, error) {
+	fs.s.mu.RLock()
+	defer fs.s.mu.RUnlock()
+	f, ok := fs.s.get(path)
+	if !ok {
+		return nil, &os.PathError{Op: "getacl", Path: path, Err: os.ErrNotExist}
+	}
+	acl := f.acl
+	if def {
+		acl = f.defaultACL
+	}
+	if acl == nil {
+		return nil, nil
+	}
+	return append([]nfs.ACLEntry{}, acl...), nil
+}
+
+// SetACL replaces the access or default ACL of a file.
+func (fs *Memory) SetACL(path string, def bool, acl []nfs.ACLEntry) error {
+	fs.s.mu.Lock()
+	defer fs.s.mu.Unlock()
+	f, ok := fs.s.get(path)
+	if !ok {
+		return &os.PathError{Op: "setacl", Path: path, Err: os.ErrNotExist}
+	}
+	if acl != nil {
+		acl = append([]nfs.ACLEntry{}, acl...)
+	}
+	if def {
+		f.defaultACL = acl
+	} else {
+		f.acl = acl
+	}
+	return nil
+}
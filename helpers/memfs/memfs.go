@@ -16,6 +16,7 @@ import (
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/helper/chroot"
 	"github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
 )
 
 const separator = filepath.Separator
@@ -28,7 +29,7 @@ type Memory struct {
 // New returns a new Memory filesystem.
 func New() billy.Filesystem {
 	fs := &Memory{s: newStorage()}
-	return chroot.New(fs, string(separator))
+	return aclFS{chroot.New(fs, string(separator)), fs}
 }
 
 func (fs *Memory) Create(filename string) (billy.File, error) {
@@ -213,6 +214,9 @@ type file struct {
 	flag     int
 	mode     os.FileMode
 	mtime    time.Time
+	// acl and defaultACL are the POSIX ACLs of the file, if set.
+	acl        []nfs.ACLEntry
+	defaultACL []nfs.ACLEntry
 
 	isClosed bool
 }
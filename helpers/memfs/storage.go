@@ -12,6 +12,7 @@ import (
 )
 
 type storage struct {
+	mu       sync.RWMutex
 	files    map[string]*file
 	children map[string]map[string]*file
 }
@@ -24,6 +25,12 @@ func newStorage() *storage {
 }
 
 func (s *storage) Has(path string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.has(path)
+}
+
+func (s *storage) has(path string) bool {
 	path = clean(path)
 
 	_, ok := s.files[path]
@@ -31,9 +38,15 @@ func (s *storage) Has(path string) bool {
 }
 
 func (s *storage) New(path string, mode os.FileMode, flag int) (*file, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.new(path, mode, flag)
+}
+
+func (s *storage) new(path string, mode os.FileMode, flag int) (*file, error) {
 	path = clean(path)
-	if s.Has(path) {
-		if !s.MustGet(path).mode.IsDir() {
+	if s.has(path) {
+		if !s.files[path].mode.IsDir() {
 			return nil, fmt.Errorf("file already exists %q", path)
 		}
 
@@ -64,7 +77,7 @@ func (s *storage) createParent(path string, mode os.FileMode, f *file) error {
 		return nil
 	}
 
-	if _, err := s.New(base, mode.Perm()|os.ModeDir, 0); err != nil {
+	if _, err := s.new(base, mode.Perm()|os.ModeDir, 0); err != nil {
 		return err
 	}
 
@@ -77,6 +90,8 @@ func (s *storage) createParent(path string, mode os.FileMode, f *file) error {
 }
 
 func (s *storage) Children(path string) []*file {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	path = clean(path)
 
 	l := make([]*file, 0)
@@ -97,8 +112,14 @@ func (s *storage) MustGet(path string) *file {
 }
 
 func (s *storage) Get(path string) (*file, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(path)
+}
+
+func (s *storage) get(path string) (*file, bool) {
 	path = clean(path)
-	if !s.Has(path) {
+	if !s.has(path) {
 		return nil, false
 	}
 
@@ -107,10 +128,12 @@ func (s *storage) Get(path string) (*file, bool) {
 }
 
 func (s *storage) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	from = clean(from)
 	to = clean(to)
 
-	if !s.Has(from) {
+	if !s.has(from) {
 		return os.ErrNotExist
 	}
 
@@ -154,9 +177,11 @@ func (s *storage) move(from, to string) error {
 }
 
 func (s *storage) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	path = clean(path)
 
-	f, has := s.Get(path)
+	f, has := s.get(path)
 	if !has {
 		return os.ErrNotExist
 	}
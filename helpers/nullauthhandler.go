@@ -26,6 +26,12 @@ func (h *NullAuthHandler) Mount(ctx context.Context, conn net.Conn, req nfs.Moun
 	return
 }
 
+// Exports lists the single export, at the root, that every mount request
+// is given.
+func (h *NullAuthHandler) Exports(ctx context.Context) []nfs.Export {
+	return []nfs.Export{{Dirpath: "/"}}
+}
+
 // Change provides an interface for updating file attributes.
 func (h *NullAuthHandler) Change(fs billy.Filesystem) billy.Change {
 	if c, ok := h.fs.(billy.Change); ok {
@@ -0,0 +1,57 @@
+package nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// Interceptor wraps the dispatch of every procedure. The call is described
+// by w.Request and w.RemoteAddr. An interceptor runs the rest of the chain,
+// and eventually the procedure handler, by calling next. It may instead
+// return an RPCError or NFSStatusError to answer the call without running
+// the handler. After next returns, w.NFSStatus reports the outcome of NFS
+// procedures.
+type Interceptor func(ctx context.Context, w *Response, userHandle Handler, next HandleFunc) error
+
+// chain wraps handler in the server's interceptors, the first of which is
+// outermost. Errors are recorded on the response as they pass each layer,
+// so that outer interceptors see the status of an inner short-circuit.
+func (s *Server) chain(handler HandleFunc) HandleFunc {
+	h := recordError(handler)
+	for i := len(s.Interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.Interceptors[i], h
+		h = recordError(func(ctx context.Context, w *Response, userHandle Handler) error {
+			return interceptor(ctx, w, userHandle, next)
+		})
+	}
+	return h
+}
+
+func recordError(h HandleFunc) HandleFunc {
+	return func(ctx context.Context, w *Response, userHandle Handler) error {
+		err := h(ctx, w, userHandle)
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		return err
+	}
+}
+
+// NFSStatus returns the status of an NFS procedure's reply, or of the error
+// its handler returned. ok is false for other programs, for NULL, and before
+// the handler has run.
+func (w *Response) NFSStatus() (status NFSStatus, ok bool) {
+	var statusErr *NFSStatusError
+	if errors.As(w.err, &statusErr) {
+		return statusErr.NFSStatus, true
+	}
+	var bodyErr *StatusErrorWithBody
+	if errors.As(w.err, &bodyErr) {
+		return bodyErr.NFSStatus, true
+	}
+	if w.req.Header.Prog != nfsServiceID || !w.responded || w.writer.Len() < w.bodyStart+4 {
+		return 0, false
+	}
+	return NFSStatus(binary.BigEndian.Uint32(w.writer.Bytes()[w.bodyStart:])), true
+}
@@ -0,0 +1,287 @@
+package nfs
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// NewMemoryLockManager returns a LockManager keeping locks in memory, so
+// that they are lost when the server restarts. It is the default of Server.
+func NewMemoryLockManager() LockManager {
+	return &memoryLockManager{files: make(map[string]*fileLocks)}
+}
+
+type memoryLockManager struct {
+	mu    sync.Mutex
+	files map[string]*fileLocks
+}
+
+// fileLocks are the locks and reservations held on one file.
+type fileLocks struct {
+	locks  []Lock
+	shares []Share
+}
+
+func (m *memoryLockManager) Test(ctx context.Context, fh []byte, l Lock) (*Lock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conflict(fh, &l), nil
+}
+
+func (m *memoryLockManager) conflict(fh []byte, l *Lock) *Lock {
+	f, ok := m.files[string(fh)]
+	if !ok {
+		return nil
+	}
+	for _, held := range f.locks {
+		if held.Conflicts(l) {
+			return &held
+		}
+	}
+	return nil
+}
+
+func (m *memoryLockManager) Lock(ctx context.Context, fh []byte, l Lock) (*Lock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if conflict := m.conflict(fh, &l); conflict != nil {
+		return conflict, nil
+	}
+	f := m.file(fh)
+	f.locks = append(release(f.locks, &l), l)
+	return nil, nil
+}
+
+func (m *memoryLockManager) Unlock(ctx context.Context, fh []byte, l Lock) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[string(fh)]; ok {
+		f.locks = release(f.locks, &l)
+		m.prune(fh, f)
+	}
+	return nil
+}
+
+func (m *memoryLockManager) Share(ctx context.Context, fh []byte, s Share) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.file(fh)
+	for _, held := range f.shares {
+		if held.Conflicts(&s) {
+			m.prune(fh, f)
+			return false, nil
+		}
+	}
+	f.shares = append(unshare(f.shares, &s), s)
+	return true, nil
+}
+
+func (m *memoryLockManager) Unshare(ctx context.Context, fh []byte, s Share) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[string(fh)]; ok {
+		f.shares = unshare(f.shares, &s)
+		m.prune(fh, f)
+	}
+	return nil
+}
+
+func (m *memoryLockManager) ReleaseAll(ctx context.Context, caller string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for fh, f := range m.files {
+		locks := f.locks[:0]
+		for _, l := range f.locks {
+			if l.Caller != caller {
+				locks = append(locks, l)
+			}
+		}
+		f.locks = locks
+		shares := f.shares[:0]
+		for _, s := range f.shares {
+			if s.Caller != caller {
+				shares = append(shares, s)
+			}
+		}
+		f.shares = shares
+		m.prune([]byte(fh), f)
+	}
+	return nil
+}
+
+func (m *memoryLockManager) file(fh []byte) *fileLocks {
+	f, ok := m.files[string(fh)]
+	if !ok {
+		f = &fileLocks{}
+		m.files[string(fh)] = f
+	}
+	return f
+}
+
+// prune forgets a file once nothing is held on it.
+func (m *memoryLockManager) prune(fh []byte, f *fileLocks) {
+	if len(f.locks) == 0 && len(f.shares) == 0 {
+		delete(m.files, string(fh))
+	}
+}
+
+// release removes the range of l from the locks of its process, splitting
+// those that extend beyond it.
+func release(locks []Lock, l *Lock) []Lock {
+	kept := make([]Lock, 0, len(locks))
+	for _, held := range locks {
+		if !held.SameOwner(l) || !held.Overlaps(l) {
+			kept = append(kept, held)
+			continue
+		}
+		if held.Offset < l.Offset {
+			before := held
+			before.Length = l.Offset - held.Offset
+			kept = append(kept, before)
+		}
+		if end := l.end(); end < held.end() {
+			after := held
+			after.Offset = end
+			if held.Length != 0 {
+				after.Length = held.end() - end
+			}
+			kept = append(kept, after)
+		}
+	}
+	return kept
+}
+
+func unshare(shares []Share, s *Share) []Share {
+	kept := shares[:0]
+	for _, held := range shares {
+		if held.Caller != s.Caller || string(held.Owner) != string(s.Owner) {
+			kept = append(kept, held)
+		}
+	}
+	return kept
+}
+
+// NewFileLockManager returns a LockManager keeping locks in m that, while a
+// file has any locks, also holds billy.File.Lock on it, so that the locks
+// exclude programs using the filesystem directly. Files are found through
+// the handles of h. Taking the file lock blocks while another process
+// holds it, delaying other requests for the same file only.
+func NewFileLockManager(m LockManager, h Handler) LockManager {
+	return &fileLockManager{LockManager: m, handler: h, held: make(map[string]billy.File), locking: make(map[string]chan struct{})}
+}
+
+type fileLockManager struct {
+	LockManager
+	handler Handler
+
+	mu   sync.Mutex
+	held map[string]billy.File
+	// locking holds, for each file whose lock is being taken, a channel
+	// closed once it has been.
+	locking map[string]chan struct{}
+}
+
+func (m *fileLockManager) Lock(ctx context.Context, fh []byte, l Lock) (*Lock, error) {
+	m.mu.Lock()
+	for {
+		pending, ok := m.locking[string(fh)]
+		if !ok {
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+	conflict, err := m.LockManager.Lock(ctx, fh, l)
+	if err != nil || conflict != nil {
+		m.mu.Unlock()
+		return conflict, err
+	}
+	if _, ok := m.held[string(fh)]; ok {
+		m.mu.Unlock()
+		return nil, nil
+	}
+	done := make(chan struct{})
+	m.locking[string(fh)] = done
+	m.mu.Unlock()
+
+	f, err := m.lockFile(fh)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locking, string(fh))
+	close(done)
+	if err != nil {
+		_ = m.LockManager.Unlock(ctx, fh, l)
+		return nil, err
+	}
+	m.held[string(fh)] = f
+	// the lock may have been released while the file lock was taken.
+	return nil, m.unlockIfFree(ctx, fh)
+}
+
+// lockFile opens the file of a handle and takes its file lock.
+func (m *fileLockManager) lockFile(fh []byte) (billy.File, error) {
+	fs, path, err := m.handler.FromHandle(fh)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.OpenFile(fs.Join(path...), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Lock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m *fileLockManager) Unlock(ctx context.Context, fh []byte, l Lock) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.LockManager.Unlock(ctx, fh, l); err != nil {
+		return err
+	}
+	return m.unlockIfFree(ctx, fh)
+}
+
+func (m *fileLockManager) ReleaseAll(ctx context.Context, caller string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.LockManager.ReleaseAll(ctx, caller); err != nil {
+		return err
+	}
+	for fh := range m.held {
+		if err := m.unlockIfFree(ctx, []byte(fh)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlockIfFree releases the file lock once no process has a lock on the
+// file, as found by testing for a lock over the whole of it by no process.
+func (m *fileLockManager) unlockIfFree(ctx context.Context, fh []byte) error {
+	f, ok := m.held[string(fh)]
+	if !ok {
+		return nil
+	}
+	conflict, err := m.LockManager.Test(ctx, fh, Lock{Svid: -1, Exclusive: true})
+	if err != nil || conflict != nil {
+		return err
+	}
+	delete(m.held, string(fh))
+	err = f.Unlock()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -4,31 +4,43 @@ import (
 	"bytes"
 	"context"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 const (
 	mountServiceID = 100005
+	mountVersion   = 3
+	mountV1Version = 1
 )
 
 func init() {
-	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcNull), onMountNull)
-	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcMount), onMount)
-	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcUmnt), onUMount)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcNull), onMountNull)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcMount), onMount)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcDump), onMountDump)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcUmnt), onUMount)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcUmntAll), onUMountAll)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountVersion, uint32(MountProcExport), onMountExport)
+	// MOUNT v1 serves NFSv2 clients, and differs from v3 only in the result
+	// of MNT.
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcNull), onMountNull)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcMount), onMountV1)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcDump), onMountDump)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcUmnt), onUMount)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcUmntAll), onUMountAll)
+	_ = RegisterVersionedMessageHandler(mountServiceID, mountV1Version, uint32(MountProcExport), onMountExport)
 }
 
-func onMountNull(ctx context.Context, w *response, userHandle Handler) error {
+func onMountNull(ctx context.Context, w *Response, userHandle Handler) error {
 	return w.writeHeader(ResponseCodeSuccess)
 }
 
-func onMount(ctx context.Context, w *response, userHandle Handler) error {
-	// TODO: auth check.
+func onMount(ctx context.Context, w *Response, userHandle Handler) error {
 	dirpath, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return err
 	}
-	mountReq := MountRequest{Header: w.req.Header, Dirpath: dirpath}
-	status, handle, flavors := userHandle.Mount(ctx, w.conn, mountReq)
+	status, handle, flavors := mount(ctx, w, userHandle, dirpath)
 
 	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
 		return err
@@ -39,20 +51,116 @@ func onMount(ctx context.Context, w *response, userHandle Handler) error {
 		return err
 	}
 
-	rootHndl := userHandle.ToHandle(handle, []string{})
-
 	if status == MountStatusOk {
+		rootHndl := userHandle.ToHandle(handle, []string{})
 		_ = xdr.Write(writer, rootHndl)
 		_ = xdr.Write(writer, flavors)
 	}
 	return w.Write(writer.Bytes())
 }
 
-func onUMount(ctx context.Context, w *response, userHandle Handler) error {
-	_, err := xdr.ReadOpaque(w.req.Body)
+// onMountV1 mounts an export for NFSv2, whose root handle is returned in
+// the fixed size of NFSv2 handles, without the flavors the export accepts.
+func onMountV1(ctx context.Context, w *Response, userHandle Handler) error {
+	dirpath, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return err
 	}
+	status, handle, _ := mount(ctx, w, userHandle, dirpath)
+	var rootHndl FileHandleV2
+	if status == MountStatusOk {
+		if rootHndl, err = toHandleV2(userHandle.ToHandle(handle, []string{})); err != nil {
+			Log.Errorf("mount of %s: %v", dirpath, err)
+			status = MountStatusErrIO
+		}
+	}
+	switch status {
+	case MountStatusErrNotSupp, MountStatusErrServerFault:
+		// the errors of MOUNT v1 are those of NFSv2.
+		status = MountStatusErrIO
+	}
+	if status != MountStatusOk {
+		return writeMountStatus(w, status)
+	}
+	return w.WriteXDR(&struct {
+		Status MountStatus
+		Handle FileHandleV2
+	}{status, rootHndl})
+}
 
+// mount asks the Handler for the export at dirpath, and on success records
+// its policy and the client's mount.
+func mount(ctx context.Context, w *Response, userHandle Handler, dirpath []byte) (MountStatus, billy.Filesystem, []AuthFlavor) {
+	requireTLS := w.conn.Server.RequireTLS != nil && w.conn.Server.RequireTLS(string(dirpath))
+	if requireTLS && w.conn.tlsConn == nil {
+		Log.Debugf("refusing cleartext mount of %s", dirpath)
+		return MountStatusErrAcces, nil, nil
+	}
+	mountReq := MountRequest{Header: w.req.Header, Dirpath: dirpath}
+	status, handle, flavors := userHandle.Mount(ctx, w.conn, mountReq)
+	if status == MountStatusOk {
+		w.conn.Server.exports.set(w.conn.Server.newExportPolicy(handle, string(dirpath), flavors))
+		w.conn.Server.mounts.add(MountEntry{Host: remoteIP(w.conn.Conn), Dirpath: string(dirpath)})
+	}
+	return status, handle, flavors
+}
+
+func onMountDump(ctx context.Context, w *Response, userHandle Handler) error {
+	writer := bytes.NewBuffer([]byte{})
+	for _, e := range w.conn.Server.Mounts() {
+		_ = xdr.Write(writer, uint32(1))
+		_ = xdr.Write(writer, e.Host)
+		_ = xdr.Write(writer, e.Dirpath)
+	}
+	_ = xdr.Write(writer, uint32(0))
+	return w.Write(writer.Bytes())
+}
+
+func onUMount(ctx context.Context, w *Response, userHandle Handler) error {
+	dirpath, err := xdr.ReadOpaque(w.req.Body)
+	if err != nil {
+		return err
+	}
+	w.conn.Server.mounts.remove(remoteIP(w.conn.Conn), func(e MountEntry) bool {
+		return e.Dirpath == string(dirpath)
+	})
+
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+func onUMountAll(ctx context.Context, w *Response, userHandle Handler) error {
+	w.conn.Server.mounts.remove(remoteIP(w.conn.Conn), func(MountEntry) bool {
+		return true
+	})
 	return w.writeHeader(ResponseCodeSuccess)
 }
+
+func onMountExport(ctx context.Context, w *Response, userHandle Handler) error {
+	var exports []Export
+	if lister, ok := userHandle.(ExportLister); ok {
+		exports = lister.Exports(ctx)
+	}
+	writer := bytes.NewBuffer([]byte{})
+	for _, e := range exports {
+		_ = xdr.Write(writer, uint32(1))
+		_ = xdr.Write(writer, e.Dirpath)
+		for _, g := range e.Groups {
+			_ = xdr.Write(writer, uint32(1))
+			_ = xdr.Write(writer, g)
+		}
+		_ = xdr.Write(writer, uint32(0))
+	}
+	_ = xdr.Write(writer, uint32(0))
+	return w.Write(writer.Bytes())
+}
+
+func writeMountStatus(w *Response, status MountStatus) error {
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(status)); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
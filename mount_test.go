@@ -0,0 +1,168 @@
+package nfs_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestMountTable(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+	rmtab := filepath.Join(t.TempDir(), "rmtab")
+	if err := os.WriteFile(rmtab, []byte("[::1]:/a:0x00000002\nother:/b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &nfs.Server{
+		Handler:   helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		RmtabPath: rmtab,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+
+	client, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	mounter := nfsc.Mount{Client: client}
+	if _, err := mounter.Mount("/", rpc.AuthNull); err != nil {
+		t.Fatal(err)
+	}
+	want := []nfs.MountEntry{{Host: "::1", Dirpath: "/a"}, {Host: "other", Dirpath: "/b"}, {Host: "127.0.0.1", Dirpath: "/"}}
+	if got := srv.Mounts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("mount table is %v", got)
+	}
+	if data, _ := os.ReadFile(rmtab); string(data) != "[::1]:/a:0x00000001\nother:/b:0x00000001\n127.0.0.1:/:0x00000001\n" {
+		t.Fatalf("rmtab is %q", data)
+	}
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	list := func(proc nfs.MountProcedure) []byte {
+		writeFragments(t, c, rpcCall(1, 100005, 3, uint32(proc), nil), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("%v failed: %d", proc, stat)
+		}
+		return body
+	}
+	if got := list(nfs.MountProcExport); !bytes.Equal(got, xdrUint32s(1, 1, '/'<<24, 0, 0)) {
+		t.Fatalf("unexpected export list: %x", got)
+	}
+	dump := append(xdrUint32s(1), xdrOpaque([]byte("::1"))...)
+	dump = append(append(dump, xdrOpaque([]byte("/a"))...), xdrUint32s(1)...)
+	dump = append(append(dump, xdrOpaque([]byte("other"))...), xdrOpaque([]byte("/b"))...)
+	dump = append(append(dump, xdrUint32s(1)...), xdrOpaque([]byte("127.0.0.1"))...)
+	dump = append(append(dump, xdrOpaque([]byte("/"))...), xdrUint32s(0)...)
+	if got := list(nfs.MountProcDump); !bytes.Equal(got, dump) {
+		t.Fatalf("unexpected mount list: %x", got)
+	}
+
+	list(nfs.MountProcUmntAll)
+	if got := srv.Mounts(); !reflect.DeepEqual(got, want[:2]) {
+		t.Fatalf("mount table after umntall is %v", got)
+	}
+}
+
+func TestExportsHandler(t *testing.T) {
+	filesystems := map[string]billy.Filesystem{}
+	exports, err := helpers.ParseExports(strings.NewReader(`
+# shares
+/a   127.0.0.1(rw,insecure,no_subtree_check)
+/b   -insecure 10.0.0.0/8(rw) \
+     127.0.0.0/8(all_squash,anonuid=1234)
+"/c d" 192.0.2.1
+`), func(dirpath string) (billy.Filesystem, error) {
+		fs := memfs.New()
+		// File needs to exist in the root for memfs to acknowledge the root exists.
+		r, _ := fs.Create("/test")
+		r.Close()
+		filesystems[dirpath] = fs
+		return fs, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []helpers.ExportConfig{
+		{Dirpath: "/a", Filesystem: filesystems["/a"], Clients: []helpers.ExportClient{{Host: "127.0.0.1", ExportOptions: helpers.DefaultExportOptions}}},
+		{Dirpath: "/b", Filesystem: filesystems["/b"], Clients: []helpers.ExportClient{{Host: "10.0.0.0/8", ExportOptions: helpers.DefaultExportOptions}, {Host: "127.0.0.0/8", ExportOptions: helpers.DefaultExportOptions}}},
+		{Dirpath: "/c d", Filesystem: filesystems["/c d"], Clients: []helpers.ExportClient{{Host: "192.0.2.1", ExportOptions: helpers.DefaultExportOptions}}},
+	}
+	want[0].Clients[0].ReadOnly, want[0].Clients[0].Secure = false, false
+	want[1].Clients[0].ReadOnly, want[1].Clients[0].Secure = false, false
+	anonUID := uint32(1234)
+	want[1].Clients[1].Secure, want[1].Clients[1].AllSquash, want[1].Clients[1].AnonUID = false, true, &anonUID
+	if !reflect.DeepEqual(exports, want) {
+		t.Fatalf("parsed exports are %+v", exports)
+	}
+
+	handler, err := helpers.NewExportsHandler(exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(handler, 1024))
+	}()
+	mount := func(dirpath string) (*nfsc.Target, error) {
+		client, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		mounter := nfsc.Mount{Client: client}
+		return mounter.Mount(dirpath, rpc.NewAuthUnix("client", 0, 0).Auth())
+	}
+
+	a, err := mount("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Create("/new", 0666); err != nil {
+		t.Fatalf("create in read-write export: %v", err)
+	}
+	if _, err := filesystems["/b"].Stat("/new"); err == nil {
+		t.Fatal("file created in the wrong export")
+	}
+	b, err := mount("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Create("/new", 0666); err == nil || !strings.Contains(err.Error(), "NFS3ERR_ROFS") {
+		t.Fatalf("create in read-only export: %v", err)
+	}
+	if _, err := mount("/c d"); err == nil {
+		t.Fatal("mount by a host not allowed succeeded")
+	}
+	if _, err := mount("/missing"); err == nil {
+		t.Fatal("mount of a missing export succeeded")
+	}
+}
@@ -74,6 +74,15 @@ const (
 	AuthFlavorUnix  AuthFlavor = 1
 	AuthFlavorShort AuthFlavor = 2
 	AuthFlavorDES   AuthFlavor = 3
+	// AuthFlavorRPCSECGSS is RPCSEC_GSS (rfc2203). See Server.GSSMechanism.
+	AuthFlavorRPCSECGSS AuthFlavor = 6
+	// AuthFlavorTLS is used only to probe for RPC-over-TLS support (rfc9289).
+	AuthFlavorTLS AuthFlavor = 7
+	// The Kerberos V5 pseudo-flavors an export may list to require
+	// RPCSEC_GSS with no protection, integrity or privacy (rfc2623).
+	AuthFlavorKrb5  AuthFlavor = 390003
+	AuthFlavorKrb5i AuthFlavor = 390004
+	AuthFlavorKrb5p AuthFlavor = 390005
 )
 
 // MountRequest contains the format of a client request to open a mount.
@@ -0,0 +1,179 @@
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MountEntry records that a client host has mounted an export.
+type MountEntry struct {
+	Host    string
+	Dirpath string
+}
+
+// mountTable is the list of mounts that MOUNTPROC_DUMP reports, optionally
+// kept in an rmtab file.
+type mountTable struct {
+	mu      sync.Mutex
+	entries []MountEntry
+	path    string
+	// version counts the changes to entries.
+	version uint64
+
+	// saveMu serializes writes of the file, which hold the table at saved.
+	saveMu sync.Mutex
+	saved  uint64
+}
+
+// load reads the entries of an rmtab file, in which each line is a
+// host:dirpath:count triple, with IPv6 hosts in brackets. Lines without the
+// count are accepted too. A missing file is an empty table.
+func (t *mountTable) load(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if entry, ok := parseRmtabLine(scanner.Text()); ok {
+			t.entries = append(t.entries, entry)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseRmtabLine(line string) (MountEntry, bool) {
+	if i := strings.LastIndex(line, ":0x"); i >= 0 {
+		if _, err := strconv.ParseUint(line[i+3:], 16, 32); err == nil {
+			line = line[:i]
+		}
+	}
+	var host, dirpath string
+	var ok bool
+	if strings.HasPrefix(line, "[") {
+		host, dirpath, ok = strings.Cut(line[1:], "]:")
+	} else {
+		host, dirpath, ok = strings.Cut(line, ":")
+	}
+	if !ok || host == "" {
+		return MountEntry{}, false
+	}
+	return MountEntry{Host: host, Dirpath: dirpath}, true
+}
+
+// add records a mount, unless the host already has the dirpath mounted.
+func (t *mountTable) add(entry MountEntry) {
+	t.mu.Lock()
+	for _, e := range t.entries {
+		if e == entry {
+			t.mu.Unlock()
+			return
+		}
+	}
+	t.entries = append(t.entries, entry)
+	t.changed()
+}
+
+// remove drops the mounts of a host for which match reports true.
+func (t *mountTable) remove(host string, match func(MountEntry) bool) {
+	t.mu.Lock()
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		if e.Host != host || !match(e) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(t.entries) {
+		t.mu.Unlock()
+		return
+	}
+	t.entries = kept
+	t.changed()
+}
+
+func (t *mountTable) list() []MountEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]MountEntry{}, t.entries...)
+}
+
+// changed records a change to the table, made with t.mu held, which it
+// releases before saving the table.
+func (t *mountTable) changed() {
+	t.version++
+	version, entries := t.version, append([]MountEntry{}, t.entries...)
+	t.mu.Unlock()
+	t.save(version, entries)
+}
+
+// save replaces the rmtab file, if there is one, with entries, the table at
+// version. A table older than the one the file holds is not written, so that
+// changes made while the file is being written are saved together.
+func (t *mountTable) save(version uint64, entries []MountEntry) {
+	if t.path == "" {
+		return
+	}
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	t.mu.Lock()
+	if latest := t.version; latest > version {
+		version, entries = latest, append([]MountEntry{}, t.entries...)
+	}
+	t.mu.Unlock()
+	if version <= t.saved {
+		return
+	}
+	buf := bytes.Buffer{}
+	for _, e := range entries {
+		host := e.Host
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		// as in the rmtab of Linux, with a count of one mount.
+		fmt.Fprintf(&buf, "%s:%s:0x%08x\n", host, e.Dirpath, 1)
+	}
+	if err := replaceFile(t.path, buf.Bytes()); err != nil {
+		Log.Warnf("unable to save mount table to %s: %v", t.path, err)
+		return
+	}
+	t.saved = version
+}
+
+// replaceFile writes data to a temporary file that is then renamed to path,
+// so that readers never see it partly written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Mounts returns the exports clients have mounted and not yet unmounted, as
+// reported to them by MOUNTPROC_DUMP (showmount -a).
+func (s *Server) Mounts() []MountEntry {
+	return s.mounts.list()
+}
@@ -8,13 +8,13 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onAccess(ctx context.Context, w *response, userHandle Handler) error {
+func onAccess(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	roothandle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -27,13 +27,15 @@ func onAccess(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	attr := tryStat(fs, path)
+	if err := WritePostOpAttrs(writer, attr); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
-		mask = mask & (1 | 2 | 0x20)
+		mask = mask & (accessRead | accessLookup | accessExecute)
 	}
+	mask = w.accessMask(attr, mask)
 
 	if err := xdr.Write(writer, mask); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
@@ -10,7 +10,7 @@ import (
 )
 
 // onCommit - note this is a no-op, as we always push writes to the backing store.
-func onCommit(ctx context.Context, w *response, userHandle Handler) error {
+func onCommit(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	handle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
@@ -18,7 +18,7 @@ func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	// The conn will drain the unread offset and count arguments.
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -39,7 +39,7 @@ func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	// write the 8 bytes of write verification.
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.conn.Server.ID); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -15,7 +15,7 @@ const (
 	createModeExclusive = 2
 )
 
-func onCreate(ctx context.Context, w *response, userHandle Handler) error {
+func onCreate(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -47,13 +47,16 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
 	}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
 
 	if len(string(obj.Filename)) > PathNameMax {
 		return &NFSStatusError{NFSStatusNameTooLong, nil}
@@ -68,12 +71,19 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		if how == createModeGuarded {
 			return &NFSStatusError{NFSStatusExist, os.ErrPermission}
 		}
+		// creating the file again truncates it.
+		if err := w.checkOwnerOrPermission(fs, newFile, permWrite); err != nil {
+			return err
+		}
+		// as with knfsd, only the size applies to an existing file.
+		attrs = &SetFileAttributes{SetSize: attrs.SetSize}
 	} else {
 		if s, err := fs.Stat(fs.Join(path...)); err != nil {
 			return &NFSStatusError{NFSStatusAccess, err}
 		} else if !s.IsDir() {
 			return &NFSStatusError{NFSStatusNotDir, nil}
 		}
+		w.creationAttrs(fs, path, attrs, FileTypeRegular)
 	}
 
 	file, err := fs.Create(newFilePath)
@@ -86,8 +96,8 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
 
-	fp := userHandle.ToHandle(fs, newFile)
-	changer := userHandle.Change(fs)
+	fp := userHandle.ToHandle(baseFS(fs), newFile)
+	changer := changeFor(ctx, userHandle, fs)
 	if err := attrs.Apply(changer, fs, newFilePath); err != nil {
 		Log.Errorf("Error applying attributes: %v\n", err)
 		return &NFSStatusError{NFSStatusIO, err}
@@ -19,12 +19,12 @@ const (
 	FSInfoPropertyCanSetTime = 0x0010
 )
 
-func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
+func onFSInfo(ctx context.Context, w *Response, userHandle Handler) error {
 	roothandle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -54,8 +54,8 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Rtmax:       1 << 30,
 		Rtpref:      1 << 30,
 		Rtmult:      4096,
-		Wtmax:       1 << 30,
-		Wtpref:      1 << 30,
+		Wtmax:       maxWriteSize(w.conn.Server.maxRecordSize()),
+		Wtpref:      maxWriteSize(w.conn.Server.maxRecordSize()),
 		Wtmult:      4096,
 		Dtpref:      8192,
 		Maxfilesize: 1 << 62, // wild guess. this seems big.
@@ -63,6 +63,13 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Properties:  0,
 	}
 
+	if w.conn.datagram {
+		res.Rtmax = datagramTransferSize
+		res.Rtpref = datagramTransferSize
+		res.Wtmax = datagramTransferSize
+		res.Wtpref = datagramTransferSize
+	}
+
 	// TODO: these aren't great indications of support, really.
 	if _, ok := fs.(billy.Symlink); ok {
 		res.Properties |= FSInfoPropertyLink
@@ -85,3 +92,16 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// maxWriteSize is the largest WRITE payload, in multiples of the preferred
+// write size, that fits in a record of the given size.
+func maxWriteSize(recordSize uint32) uint32 {
+	if recordSize <= recordOverhead+4096 {
+		return 4096
+	}
+	size := (recordSize - recordOverhead) &^ (4096 - 1)
+	if size > 1<<30 {
+		size = 1 << 30
+	}
+	return size
+}
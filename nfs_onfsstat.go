@@ -8,16 +8,41 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
+func onFSStat(ctx context.Context, w *Response, userHandle Handler) error {
 	roothandle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
+	stat, err := fsStat(ctx, userHandle, fs)
+	if err != nil {
+		return err
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := xdr.Write(writer, stat); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+// fsStat returns the usage of a filesystem as the Handler reports it, with
+// unbounded defaults.
+func fsStat(ctx context.Context, userHandle Handler, fs billy.Filesystem) (*FSStat, error) {
 	defaults := FSStat{
 		TotalSize:      1 << 62,
 		FreeSize:       1 << 62,
@@ -32,27 +57,13 @@ func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
 		defaults.AvailableSize = 0
 	}
 
-	err = userHandle.FSStat(ctx, fs, &defaults)
+	err := userHandle.FSStat(ctx, baseFS(fs), &defaults)
 	if err != nil {
 		if _, ok := err.(*NFSStatusError); ok {
-			return err
+			return nil, err
 		}
-		return &NFSStatusError{NFSStatusServerFault, err}
+		return nil, &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	writer := bytes.NewBuffer([]byte{})
-	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-
-	if err := xdr.Write(writer, defaults); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := w.Write(writer.Bytes()); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	return nil
+	return &defaults, nil
 }
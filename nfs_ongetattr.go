@@ -8,13 +8,13 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onGetAttr(ctx context.Context, w *response, userHandle Handler) error {
+func onGetAttr(ctx context.Context, w *Response, userHandle Handler) error {
 	handle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -10,7 +10,7 @@ import (
 )
 
 // Backing billy.FS doesn't support hard links
-func onLink(ctx context.Context, w *response, userHandle Handler) error {
+func onLink(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -27,13 +27,16 @@ func onLink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
 
 	if len(string(obj.Filename)) > PathNameMax {
 		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
@@ -49,8 +52,8 @@ func onLink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
 
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
-	changer := userHandle.Change(fs)
+	fp := userHandle.ToHandle(baseFS(fs), append(path, string(obj.Filename)))
+	changer := changeFor(ctx, userHandle, fs)
 	if changer == nil {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
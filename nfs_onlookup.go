@@ -26,7 +26,7 @@ func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Fi
 	return writer.Bytes(), nil
 }
 
-func onLookup(ctx context.Context, w *response, userHandle Handler) error {
+func onLookup(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -34,7 +34,7 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -42,6 +42,9 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil || !dirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, err}
 	}
+	if err := w.checkPermission(fs, p, permExec); err != nil {
+		return err
+	}
 
 	// Special cases for "." and ".."
 	if bytes.Equal(obj.Filename, []byte(".")) {
@@ -59,7 +62,7 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 			return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
 		}
 		pPath := p[0 : len(p)-1]
-		pHandle := userHandle.ToHandle(fs, pPath)
+		pHandle := userHandle.ToHandle(baseFS(fs), pPath)
 		resp, err := lookupSuccessResponse(pHandle, pPath, p, fs)
 		if err != nil {
 			return &NFSStatusError{NFSStatusServerFault, err}
@@ -75,7 +78,7 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
 	}
 
-	newHandle := userHandle.ToHandle(fs, reqPath)
+	newHandle := userHandle.ToHandle(baseFS(fs), reqPath)
 	resp, err := lookupSuccessResponse(newHandle, reqPath, p, fs)
 	if err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
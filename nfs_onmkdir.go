@@ -13,7 +13,7 @@ const (
 	mkdirDefaultMode = 755
 )
 
-func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
+func onMkdir(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -26,13 +26,16 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
 
 	if len(string(obj.Filename)) > PathNameMax {
 		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
@@ -55,16 +58,22 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 		}
 	}
 
+	setgid := w.creationAttrs(fs, path, attrs, FileTypeDirectory)
 	if err := fs.MkdirAll(newFolderPath, attrs.Mode(mkdirDefaultMode)); err != nil {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
 
-	fp := userHandle.ToHandle(fs, newFolder)
-	changer := userHandle.Change(fs)
+	fp := userHandle.ToHandle(baseFS(fs), newFolder)
+	changer := changeFor(ctx, userHandle, fs)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFolderPath); err != nil {
 			return &NFSStatusError{NFSStatusIO, err}
 		}
+		if setgid {
+			if err := changer.Chmod(newFolderPath, attrs.Mode(mkdirDefaultMode)|os.ModeSetgid); err != nil {
+				return &NFSStatusError{NFSStatusIO, err}
+			}
+		}
 	}
 
 	writer := bytes.NewBuffer([]byte{})
@@ -23,7 +23,7 @@ const (
 
 // Backing billy.FS doesn't support creation of
 // char, block, socket, or fifo pipe nodes
-func onMknod(ctx context.Context, w *response, userHandle Handler) error {
+func onMknod(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -37,14 +37,17 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 	}
 
 	// see if the filesystem supports mknod
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
-	c := userHandle.Change(fs)
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
+	c := changeFor(ctx, userHandle, fs)
 	if c == nil {
 		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
 	}
@@ -67,7 +70,7 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 	} else if !parent.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	fp := userHandle.ToHandle(baseFS(fs), append(path, string(obj.Filename)))
 
 	switch nfs_ftype(ftype) {
 	case FTYPE_NF3CHR:
@@ -86,6 +89,11 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
 
+		ft := FileTypeCharacter
+		if nfs_ftype(ftype) == FTYPE_NF3BLK {
+			ft = FileTypeBlock
+		}
+		w.creationAttrs(fs, path, attrs, ft)
 		err = cu.Mknod(newFilePath, uint32(attrs.Mode(parent.Mode())), specData1, specData2)
 		if err != nil {
 			return &NFSStatusError{NFSStatusAccess, err}
@@ -100,6 +108,7 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
+		w.creationAttrs(fs, path, attrs, FileTypeSocket)
 		if err := cu.Socket(newFilePath); err != nil {
 			return &NFSStatusError{NFSStatusAccess, err}
 		}
@@ -113,6 +122,7 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
+		w.creationAttrs(fs, path, attrs, FileTypeFIFO)
 		err = cu.Mkfifo(newFilePath, uint32(attrs.Mode(parent.Mode())))
 		if err != nil {
 			return &NFSStatusError{NFSStatusAccess, err}
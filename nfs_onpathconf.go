@@ -10,12 +10,12 @@ import (
 // PathNameMax is the maximum length for a file name
 const PathNameMax = 255
 
-func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
+func onPathConf(ctx context.Context, w *Response, userHandle Handler) error {
 	roothandle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
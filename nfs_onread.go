@@ -25,18 +25,22 @@ type nfsReadResponse struct {
 // MaxRead is the advertised largest buffer the server is willing to read
 const MaxRead = 1 << 24
 
-func onRead(ctx context.Context, w *response, userHandle Handler) error {
+func onRead(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	var obj nfsReadArgs
 	err := xdr.Read(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
+	if err := w.checkOwnerOrPermission(fs, path, permRead); err != nil {
+		return err
+	}
+
 	fh, err := fs.Open(fs.Join(path...))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -48,6 +52,9 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 
 	resp := nfsReadResponse{}
 	setEOF := false
+	if max := w.conn.maxReadSize(); obj.Count > max {
+		obj.Count = max
+	}
 
 	fullPath := fs.Join(path...)
 	info, err := fs.Stat(fullPath)
@@ -61,9 +68,6 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 		obj.Count = uint32(uint64(info.Size()) - obj.Offset)
 		setEOF = true
 	}
-	if obj.Count > MaxRead {
-		obj.Count = MaxRead
-	}
 	resp.Data = make([]byte, obj.Count)
 	// todo: multiple reads if size isn't full
 	cnt, err := fh.ReadAt(resp.Data, int64(obj.Offset))
@@ -92,3 +96,11 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// maxReadSize is the largest READ payload served on the connection.
+func (c *conn) maxReadSize() uint32 {
+	if c.datagram {
+		return datagramTransferSize
+	}
+	return MaxRead
+}
@@ -28,7 +28,7 @@ type readDirEntity struct {
 	Next   bool
 }
 
-func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
+func onReadDir(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := readDirArgs{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -39,13 +39,16 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	if obj.Count < 1024 {
 		return &NFSStatusError{NFSStatusTooSmall, io.ErrShortBuffer}
 	}
+	if w.conn.datagram && obj.Count > datagramTransferSize {
+		obj.Count = datagramTransferSize
+	}
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	contents, verifier, err := getDirListingWithVerifier(ctx, userHandle, obj.Handle, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
@@ -137,9 +140,9 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	return nil
 }
 
-func getDirListingWithVerifier(userHandle Handler, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
+func getDirListingWithVerifier(ctx context.Context, userHandle Handler, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
 	// figure out what directory it is.
-	fs, p, err := userHandle.FromHandle(fsHandle)
+	fs, p, err := fromHandle(ctx, userHandle, fsHandle)
 	if err != nil {
 		return nil, 0, &NFSStatusError{NFSStatusStale, err}
 	}
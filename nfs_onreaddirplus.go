@@ -32,7 +32,7 @@ func joinPath(parent []string, elements ...string) []string {
 	return joinedPath
 }
 
-func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
+func onReadDirPlus(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := readDirPlusArgs{}
 	if err := xdr.Read(w.req.Body, &obj); err != nil {
@@ -45,13 +45,16 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	if obj.DirCount < 512 || obj.MaxCount < 4096 {
 		return &NFSStatusError{NFSStatusTooSmall, nil}
 	}
+	if w.conn.datagram && obj.MaxCount > datagramTransferSize {
+		obj.MaxCount = datagramTransferSize
+	}
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	contents, verifier, err := getDirListingWithVerifier(ctx, userHandle, obj.Handle, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
@@ -102,7 +105,7 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 			}
 
 			filePath := joinPath(p, c.Name())
-			handle := userHandle.ToHandle(fs, filePath)
+			handle := userHandle.ToHandle(baseFS(fs), filePath)
 			attrs := ToFileAttribute(c, path.Join(filePath...))
 			entities = append(entities, readDirPlusEntity{
 				FileID:     attrs.Fileid,
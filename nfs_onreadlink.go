@@ -8,13 +8,13 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onReadLink(ctx context.Context, w *response, userHandle Handler) error {
+func onReadLink(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	handle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -9,13 +9,13 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onRemove(ctx context.Context, w *response, userHandle Handler) error {
+func onRemove(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	if err := xdr.Read(w.req.Body, &obj); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -44,8 +44,12 @@ func onRemove(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	preCacheData := ToFileAttribute(dirInfo, fullPath).AsCache()
 
+	if err := w.checkUnlink(fs, path, string(obj.Filename)); err != nil {
+		return err
+	}
+
 	toDelete := fs.Join(append(path, string(obj.Filename))...)
-	toDeleteHandle := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	toDeleteHandle := userHandle.ToHandle(baseFS(fs), append(path, string(obj.Filename)))
 
 	err = fs.Remove(toDelete)
 	if err != nil {
@@ -58,7 +62,7 @@ func onRemove(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusIO, err}
 	}
 
-	if err := userHandle.InvalidateHandle(fs, toDeleteHandle); err != nil {
+	if err := userHandle.InvalidateHandle(baseFS(fs), toDeleteHandle); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
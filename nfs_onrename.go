@@ -12,14 +12,14 @@ import (
 
 var doubleWccErrorBody = [16]byte{}
 
-func onRename(ctx context.Context, w *response, userHandle Handler) error {
+func onRename(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = errFormatterWithBody(doubleWccErrorBody[:])
 	from := DirOpArg{}
 	err := xdr.Read(w.req.Body, &from)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs, fromPath, err := userHandle.FromHandle(from.Handle)
+	fs, fromPath, err := fromHandle(ctx, userHandle, from.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -28,7 +28,7 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	if err = xdr.Read(w.req.Body, &to); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
-	fs2, toPath, err := userHandle.FromHandle(to.Handle)
+	fs2, toPath, err := fromHandle(ctx, userHandle, to.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -71,7 +71,14 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	preDestData := ToFileAttribute(toDirInfo, toDirPath).AsCache()
 
-	oldHandle := userHandle.ToHandle(fs, append(fromPath, string(from.Filename)))
+	if err := w.checkUnlink(fs, fromPath, string(from.Filename)); err != nil {
+		return err
+	}
+	if err := w.checkUnlink(fs, toPath, string(to.Filename)); err != nil {
+		return err
+	}
+
+	oldHandle := userHandle.ToHandle(baseFS(fs), append(fromPath, string(from.Filename)))
 
 	fromLoc := fs.Join(append(fromPath, string(from.Filename))...)
 	toLoc := fs.Join(append(toPath, string(to.Filename))...)
@@ -87,7 +94,7 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusIO, err}
 	}
 
-	if err := userHandle.InvalidateHandle(fs, oldHandle); err != nil {
+	if err := userHandle.InvalidateHandle(baseFS(fs), oldHandle); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
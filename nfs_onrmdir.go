@@ -4,6 +4,6 @@ import (
 	"context"
 )
 
-func onRmDir(ctx context.Context, w *response, userHandle Handler) error {
+func onRmDir(ctx context.Context, w *Response, userHandle Handler) error {
 	return onRemove(ctx, w, userHandle)
 }
@@ -9,14 +9,14 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
+func onSetAttr(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	handle, err := xdr.ReadOpaque(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
@@ -53,7 +53,11 @@ func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	changer := userHandle.Change(fs)
+	if err := w.checkSetAttr(ToFileAttribute(info, fullPath), attrs); err != nil {
+		return err
+	}
+
+	changer := changeFor(ctx, userHandle, fs)
 	if err := attrs.Apply(changer, fs, fs.Join(path...)); err != nil {
 		// Already an nfsstatuserror
 		return err
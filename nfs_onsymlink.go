@@ -9,7 +9,7 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
+func onSymlink(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
 	err := xdr.Read(w.req.Body, &obj)
@@ -26,13 +26,16 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
 
 	if len(string(obj.Filename)) > PathNameMax {
 		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
@@ -48,13 +51,14 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
 
+	w.creationAttrs(fs, path, attrs, FileTypeLink)
 	err = fs.Symlink(string(target), newFilePath)
 	if err != nil {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
 
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
-	changer := userHandle.Change(fs)
+	fp := userHandle.ToHandle(baseFS(fs), append(path, string(obj.Filename)))
+	changer := changeFor(ctx, userHandle, fs)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
 			return &NFSStatusError{NFSStatusIO, err}
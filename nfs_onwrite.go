@@ -28,20 +28,23 @@ type writeArgs struct {
 	Data   []byte
 }
 
-func onWrite(ctx context.Context, w *response, userHandle Handler) error {
+func onWrite(ctx context.Context, w *Response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	var req writeArgs
 	if err := xdr.Read(w.req.Body, &req); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	fs, path, err := userHandle.FromHandle(req.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, req.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := w.checkOwnerOrPermission(fs, path, permWrite); err != nil {
+		return err
+	}
 	if len(req.Data) > math.MaxInt32 || req.Count > math.MaxInt32 {
 		return &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
 	}
@@ -101,7 +104,7 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, fileSync); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.conn.Server.ID); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -0,0 +1,362 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	nfsACLServiceID = 100227
+	nfsACLVersion   = 3
+)
+
+// The mask of GETACL and SETACL selects the ACLs, or their sizes, that are
+// read or changed.
+const (
+	aclMaskAccess       = 0x1
+	aclMaskAccessCount  = 0x2
+	aclMaskDefault      = 0x4
+	aclMaskDefaultCount = 0x8
+	aclMaskAll          = aclMaskAccess | aclMaskAccessCount | aclMaskDefault | aclMaskDefaultCount
+)
+
+// aclDefaultFlag marks the entries of default ACLs on the wire.
+const aclDefaultFlag = 0x1000
+
+// aclMaxEntries bounds the entries of an ACL.
+const aclMaxEntries = 1024
+
+func init() {
+	_ = RegisterVersionedMessageHandler(nfsACLServiceID, nfsACLVersion, uint32(ACLProcNull), onNull)
+	_ = RegisterVersionedMessageHandler(nfsACLServiceID, nfsACLVersion, uint32(ACLProcGetACL), onGetACL)
+	_ = RegisterVersionedMessageHandler(nfsACLServiceID, nfsACLVersion, uint32(ACLProcSetACL), onSetACL)
+}
+
+// aclChangeFor returns the ACLChange of a filesystem, if it has one.
+func aclChangeFor(fs billy.Filesystem) (ACLChange, bool) {
+	if r, ok := fs.(*requestFS); ok {
+		fs = r.Filesystem
+	}
+	ac, ok := fs.(ACLChange)
+	return ac, ok
+}
+
+// aclStatus maps the errors of an ACLChange to NFS status codes.
+func aclStatus(err error) *NFSStatusError {
+	var nerr *NFSStatusError
+	switch {
+	case errors.As(err, &nerr):
+		return nerr
+	case os.IsNotExist(err):
+		return &NFSStatusError{NFSStatusNoEnt, err}
+	case os.IsPermission(err):
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	return &NFSStatusError{NFSStatusIO, err}
+}
+
+// aclFromMode returns the access ACL equivalent to a mode.
+func aclFromMode(mode os.FileMode) []ACLEntry {
+	return []ACLEntry{
+		{Tag: ACLUserObj, Perm: uint32(mode>>6) & 7},
+		{Tag: ACLGroupObj, Perm: uint32(mode>>3) & 7},
+		{Tag: ACLOther, Perm: uint32(mode) & 7},
+	}
+}
+
+// aclMode returns the permission bits of a mode that an access ACL implies:
+// those of the owner, of the mask or else the owning group, and of others.
+func aclMode(acl []ACLEntry) os.FileMode {
+	var owner, group, mask, other uint32
+	hasMask := false
+	for _, e := range acl {
+		switch e.Tag {
+		case ACLUserObj:
+			owner = e.Perm
+		case ACLGroupObj:
+			group = e.Perm
+		case ACLMask:
+			mask, hasMask = e.Perm, true
+		case ACLOther:
+			other = e.Perm
+		}
+	}
+	if hasMask {
+		group = mask
+	}
+	return os.FileMode(owner<<6 | group<<3 | other)
+}
+
+// validACL sorts an ACL and checks that it is well formed: it has one entry
+// for the owner, owning group and others, at most one for each named user
+// and group, and a mask if it has named entries. A mask in an ACL without
+// named entries that matches the owning group is dropped, and one missing
+// from an ACL with them is added, as Solaris clients expect.
+func validACL(acl []ACLEntry) ([]ACLEntry, bool) {
+	if len(acl) == 0 {
+		return nil, true
+	}
+	sort.SliceStable(acl, func(i, j int) bool {
+		if acl[i].Tag != acl[j].Tag {
+			return acl[i].Tag < acl[j].Tag
+		}
+		return acl[i].ID < acl[j].ID
+	})
+	counts := map[ACLTag]int{}
+	var named, groupPerm uint32
+	for i := range acl {
+		e := &acl[i]
+		if e.Perm&^7 != 0 {
+			return nil, false
+		}
+		switch e.Tag {
+		case ACLUser, ACLGroup:
+			if i > 0 && acl[i-1].Tag == e.Tag && acl[i-1].ID == e.ID {
+				return nil, false
+			}
+			named |= e.Perm
+		case ACLUserObj, ACLGroupObj, ACLMask, ACLOther:
+			e.ID = 0
+			if e.Tag == ACLGroupObj {
+				groupPerm = e.Perm
+			}
+		default:
+			return nil, false
+		}
+		counts[e.Tag]++
+	}
+	if counts[ACLUserObj] != 1 || counts[ACLGroupObj] != 1 || counts[ACLOther] != 1 || counts[ACLMask] > 1 {
+		return nil, false
+	}
+	hasNamed := counts[ACLUser]+counts[ACLGroup] > 0
+	if !hasNamed && counts[ACLMask] == 1 && acl[len(acl)-2].Perm == groupPerm {
+		kept := acl[:0]
+		for _, e := range acl {
+			if e.Tag != ACLMask {
+				kept = append(kept, e)
+			}
+		}
+		acl = kept
+	} else if hasNamed && counts[ACLMask] == 0 {
+		acl = append(acl, ACLEntry{Tag: ACLMask, Perm: groupPerm | named})
+		acl[len(acl)-1], acl[len(acl)-2] = acl[len(acl)-2], acl[len(acl)-1]
+	}
+	return acl, true
+}
+
+// readACL reads an ACL in the form of the protocol: its number of entries,
+// followed by an array of the entries, which may be left empty.
+func readACL(r io.Reader) ([]ACLEntry, error) {
+	count, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > aclMaxEntries || n > count {
+		return nil, ErrInputInvalid
+	}
+	acl := make([]ACLEntry, n)
+	for i := range acl {
+		if err := xdr.Read(r, &acl[i]); err != nil {
+			return nil, err
+		}
+		acl[i].Tag &^= aclDefaultFlag
+	}
+	return acl, nil
+}
+
+// writeACL writes an ACL in the form of the protocol, with its entries only
+// if withEntries is set. Entries for the owner and owning group carry their
+// ids, and ACLs are given a mask, as Solaris clients expect.
+func writeACL(w io.Writer, acl []ACLEntry, withEntries bool, flag ACLTag, attr *FileAttribute) error {
+	if len(acl) == 3 {
+		acl = []ACLEntry{acl[0], acl[1], {Tag: ACLMask, Perm: acl[1].Perm}, acl[2]}
+	}
+	if err := xdr.Write(w, uint32(len(acl))); err != nil {
+		return err
+	}
+	if !withEntries {
+		return xdr.Write(w, uint32(0))
+	}
+	if err := xdr.Write(w, uint32(len(acl))); err != nil {
+		return err
+	}
+	for _, e := range acl {
+		switch e.Tag {
+		case ACLUserObj:
+			e.ID = attr.UID
+		case ACLGroupObj:
+			e.ID = attr.GID
+		}
+		e.Tag |= flag
+		if err := xdr.Write(w, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func onGetACL(ctx context.Context, w *Response, userHandle Handler) error {
+	w.errorFmt = opAttrErrorFormatter
+	handle, err := xdr.ReadOpaque(w.req.Body)
+	if err != nil {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	fs, path, err := fromHandle(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	mask, err := xdr.ReadUint32(w.req.Body)
+	if err != nil || mask&^aclMaskAll != 0 {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	ac, ok := aclChangeFor(fs)
+	if !ok {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	access, err := ac.GetACL(fullPath, false)
+	if err != nil {
+		return aclStatus(err)
+	}
+	if access == nil {
+		access = aclFromMode(info.Mode())
+	}
+	var def []ACLEntry
+	if info.IsDir() {
+		if def, err = ac.GetACL(fullPath, true); err != nil {
+			return aclStatus(err)
+		}
+	}
+
+	attr := ToFileAttribute(info, fullPath)
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, attr); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := xdr.Write(writer, mask); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := writeACL(writer, access, mask&aclMaskAccess != 0, 0, attr); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := writeACL(writer, def, mask&aclMaskDefault != 0, aclDefaultFlag, attr); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func onSetACL(ctx context.Context, w *Response, userHandle Handler) error {
+	w.errorFmt = opAttrErrorFormatter
+	handle, err := xdr.ReadOpaque(w.req.Body)
+	if err != nil {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	fs, path, err := fromHandle(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	mask, err := xdr.ReadUint32(w.req.Body)
+	if err != nil || mask&^aclMaskAll != 0 {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	access, err := readACL(w.req.Body)
+	if err != nil {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	def, err := readACL(w.req.Body)
+	if err != nil {
+		return &NFSStatusError{NFSStatusInval, err}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	ac, ok := aclChangeFor(fs)
+	if !ok {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	if w.checkingPermissions() && !callerOf(w).owns(ToFileAttribute(info, fullPath)) {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+
+	if mask&aclMaskAccess != 0 {
+		acl, ok := validACL(access)
+		if !ok {
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+		}
+		if acl != nil {
+			// the mode follows the access ACL, and ACLs no more precise
+			// than the mode are not kept.
+			if changer := changeFor(ctx, userHandle, fs); changer != nil {
+				mode := info.Mode()&^os.ModePerm | aclMode(acl)
+				if err := changer.Chmod(fullPath, mode); err != nil {
+					return aclStatus(err)
+				}
+			}
+			if len(acl) == 3 {
+				acl = nil
+			}
+		}
+		if err := ac.SetACL(fullPath, false, acl); err != nil {
+			return aclStatus(err)
+		}
+	}
+	if mask&aclMaskDefault != 0 {
+		acl, ok := validACL(def)
+		if !ok {
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+		}
+		if !info.IsDir() {
+			if acl != nil {
+				return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+			}
+		} else if err := ac.SetACL(fullPath, true, acl); err != nil {
+			return aclStatus(err)
+		}
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package nfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+)
+
+// xdrACL encodes an ACL with its entries, as (tag, id, perm) triples.
+func xdrACL(entries ...uint32) []byte {
+	return append(xdrUint32s(uint32(len(entries)/3), uint32(len(entries)/3)), xdrUint32s(entries...)...)
+}
+
+func TestNFSACL(t *testing.T) {
+	mem := memfs.New()
+	f, _ := mem.Create("/file")
+	f.Close()
+	_ = mem.MkdirAll("/dir", 0755)
+
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	xid := uint32(0)
+	call := func(proc nfs.ACLProcedure, fh []byte, args []byte) (nfs.NFSStatus, []byte) {
+		xid++
+		writeFragments(t, c, rpcCall(xid, 100227, 3, uint32(proc), append(xdrOpaque(fh), args...)), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("%v failed: %d", proc, stat)
+		}
+		status := nfs.NFSStatus(binary.BigEndian.Uint32(body))
+		if status != nfs.NFSStatusOk {
+			return status, nil
+		}
+		// skip the post_op_attr of the object.
+		if binary.BigEndian.Uint32(body[4:]) == 1 {
+			return status, body[8+84:]
+		}
+		return status, body[8:]
+	}
+	getACL := func(fh []byte) []byte {
+		status, res := call(nfs.ACLProcGetACL, fh, xdrUint32s(0xf))
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("getacl: %v", status)
+		}
+		return res
+	}
+	file := handler.ToHandle(mem, []string{"file"})
+	dir := handler.ToHandle(mem, []string{"dir"})
+
+	// without an ACL, the access ACL is that of the mode.
+	want := append(xdrUint32s(0xf), xdrACL(1, 0, 6, 4, 0, 6, 0x10, 0, 6, 0x20, 0, 6)...)
+	if got := getACL(file); !bytes.Equal(got, append(want, xdrUint32s(0, 0)...)) {
+		t.Fatalf("getacl of file without acl: %x", got)
+	}
+
+	// a mask is added to an ACL with named entries, which is sorted.
+	acl := xdrACL(0x20, 0, 0, 2, 1000, 7, 4, 0, 4, 1, 0, 6)
+	if status, _ := call(nfs.ACLProcSetACL, file, append(append(xdrUint32s(1), acl...), xdrACL()...)); status != nfs.NFSStatusOk {
+		t.Fatalf("setacl: %v", status)
+	}
+	want = append(xdrUint32s(0xf), xdrACL(1, 0, 6, 2, 1000, 7, 4, 0, 4, 0x10, 0, 7, 0x20, 0, 0)...)
+	if got := getACL(file); !bytes.Equal(got, append(want, xdrUint32s(0, 0)...)) {
+		t.Fatalf("getacl after setacl: %x", got)
+	}
+
+	def := xdrACL(0x1001, 0, 7, 0x1004, 0, 5, 0x1020, 0, 5)
+	if status, _ := call(nfs.ACLProcSetACL, file, append(append(xdrUint32s(4), xdrACL()...), def...)); status != nfs.NFSStatusAccess {
+		t.Fatalf("setacl of default acl on file: %v", status)
+	}
+	if status, _ := call(nfs.ACLProcSetACL, dir, append(append(xdrUint32s(4), xdrACL()...), def...)); status != nfs.NFSStatusOk {
+		t.Fatalf("setacl of default acl on directory: %v", status)
+	}
+	if got := getACL(dir); !bytes.HasSuffix(got, xdrACL(0x1001, 0, 7, 0x1004, 0, 5, 0x1010, 0, 5, 0x1020, 0, 5)) {
+		t.Fatalf("getacl of directory: %x", got)
+	}
+
+	invalid := xdrACL(1, 0, 6, 1, 0, 6, 4, 0, 4, 0x20, 0, 0)
+	if status, _ := call(nfs.ACLProcSetACL, file, append(append(xdrUint32s(1), invalid...), xdrACL()...)); status != nfs.NFSStatusInval {
+		t.Fatalf("setacl of invalid acl: %v", status)
+	}
+}
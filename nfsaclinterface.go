@@ -0,0 +1,63 @@
+package nfs
+
+// ACLProcedure is the valid RPC calls for the NFSACL side protocol, version 3.
+type ACLProcedure uint32
+
+// ACLProcedure Codes
+const (
+	ACLProcNull ACLProcedure = iota
+	ACLProcGetACL
+	ACLProcSetACL
+)
+
+func (a ACLProcedure) String() string {
+	switch a {
+	case ACLProcNull:
+		return "Null"
+	case ACLProcGetACL:
+		return "GetACL"
+	case ACLProcSetACL:
+		return "SetACL"
+	default:
+		return "Unknown"
+	}
+}
+
+// ACLTag is the kind of an entry of a POSIX ACL.
+type ACLTag uint32
+
+// ACLTag Codes, in the order entries of an ACL are sorted.
+const (
+	ACLUserObj  ACLTag = 0x01
+	ACLUser     ACLTag = 0x02
+	ACLGroupObj ACLTag = 0x04
+	ACLGroup    ACLTag = 0x08
+	ACLMask     ACLTag = 0x10
+	ACLOther    ACLTag = 0x20
+)
+
+// ACLEntry is an entry of a POSIX ACL. ID is the user of an ACLUser entry
+// or the group of an ACLGroup entry, and zero for other entries. Perm holds
+// the read (4), write (2) and execute (1) bits the entry grants.
+type ACLEntry struct {
+	Tag  ACLTag
+	ID   uint32
+	Perm uint32
+}
+
+// ACLChange is an optional interface for filesystems with POSIX ACLs, which
+// clients read and change through the NFSACL side protocol.
+//
+// Each file may have an access ACL, and each directory a default ACL that
+// new objects in it inherit. The ACLs given to SetACL are valid and sorted,
+// and the server keeps the permission bits of the file's mode in step with
+// its access ACL.
+type ACLChange interface {
+	// GetACL returns the access ACL of a file, or its default ACL if def is
+	// set. It returns nil if the file has none, which for the access ACL
+	// means the one equivalent to its mode.
+	GetACL(path string, def bool) ([]ACLEntry, error)
+	// SetACL replaces the access or default ACL of a file. A nil acl removes
+	// the ACL.
+	SetACL(path string, def bool, acl []ACLEntry) error
+}
@@ -0,0 +1,804 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const nfsV2Version = 2
+
+func init() {
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureNull), onNull)           // 0
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureGetAttr), onGetAttrV2)   // 1
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureSetAttr), onSetAttrV2)   // 2
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureRoot), onNull)           // 3, obsolete
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureLookup), onLookupV2)     // 4
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureReadlink), onReadLinkV2) // 5
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureRead), onReadV2)         // 6
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureWriteCache), onNull)     // 7, obsolete
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureWrite), onWriteV2)       // 8
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureCreate), onCreateV2)     // 9
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureRemove), onRemoveV2)     // 10
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureRename), onRenameV2)     // 11
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureLink), onLinkV2)         // 12
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureSymlink), onSymlinkV2)   // 13
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureMkDir), onMkdirV2)       // 14
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureRmDir), onRemoveV2)      // 15
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureReadDir), onReadDirV2)   // 16
+	_ = RegisterVersionedMessageHandler(nfsServiceID, nfsV2Version, uint32(NFSv2ProcedureStatFS), onStatFSV2)     // 17
+}
+
+var errHandleV2 = errors.New("file handle does not fit in an NFSv2 handle")
+
+// toHandleV2 encodes a file handle of the Handler as an NFSv2 handle: its
+// length, followed by the handle and zero padding.
+func toHandleV2(fh []byte) (FileHandleV2, error) {
+	var h FileHandleV2
+	if len(fh) >= FHSizeV2 {
+		return h, &NFSStatusError{NFSStatusServerFault, errHandleV2}
+	}
+	h[0] = byte(len(fh))
+	copy(h[1:], fh)
+	return h, nil
+}
+
+// handle decodes the file handle of the Handler that an NFSv2 handle holds.
+func (h FileHandleV2) handle() ([]byte, error) {
+	n := int(h[0])
+	if n >= FHSizeV2 {
+		return nil, errHandleV2
+	}
+	return h[1 : 1+n], nil
+}
+
+// fromHandleV2 is fromHandle for NFSv2 handles.
+func fromHandleV2(ctx context.Context, userHandle Handler, h FileHandleV2) (billy.Filesystem, []string, error) {
+	fh, err := h.handle()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fromHandle(ctx, userHandle, fh)
+}
+
+// statusV2 maps a status to itself if NFSv2 defines it, and otherwise to
+// NFSERR_IO.
+func statusV2(s NFSStatus) NFSStatus {
+	switch s {
+	case NFSStatusOk, NFSStatusPerm, NFSStatusNoEnt, NFSStatusIO, NFSStatusNXIO,
+		NFSStatusAccess, NFSStatusExist, NFSStatusNoDev, NFSStatusNotDir,
+		NFSStatusIsDir, NFSStatusFBig, NFSStatusNoSPC, NFSStatusROFS,
+		NFSStatusNameTooLong, NFSStatusNotEmpty, NFSStatusDQuot, NFSStatusStale:
+		return s
+	}
+	return NFSStatusIO
+}
+
+// errorFormatterV2 encodes the failure of an NFSv2 procedure, which is its
+// status alone.
+func errorFormatterV2(err error) RPCError {
+	var statusErr *NFSStatusError
+	if errors.As(err, &statusErr) {
+		return &NFSStatusError{statusV2(statusErr.NFSStatus), statusErr.WrappedErr}
+	}
+	return basicErrorFormatter(err)
+}
+
+type dirOpArgsV2 struct {
+	Handle   FileHandleV2
+	Filename []byte
+}
+
+type attrStatV2 struct {
+	Status NFSStatus
+	Attr   FileAttributeV2
+}
+
+type dirOpResV2 struct {
+	Status NFSStatus
+	Handle FileHandleV2
+	Attr   FileAttributeV2
+}
+
+// statV2 returns the fattr of the object at path.
+func statV2(fs billy.Filesystem, path []string) (*FileAttributeV2, error) {
+	fullPath := fs.Join(path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return nil, &NFSStatusError{NFSStatusIO, err}
+	}
+	return ToFileAttributeV2(ToFileAttribute(info, fullPath)), nil
+}
+
+// writeAttrStatV2 replies with the attributes of the object at path.
+func writeAttrStatV2(w *Response, fs billy.Filesystem, path []string) error {
+	attr, err := statV2(fs, path)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteXDR(&attrStatV2{NFSStatusOk, *attr}); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+// writeDirOpResV2 replies with the handle and attributes of the object at
+// path.
+func writeDirOpResV2(w *Response, userHandle Handler, fs billy.Filesystem, path []string) error {
+	fh, err := toHandleV2(userHandle.ToHandle(baseFS(fs), path))
+	if err != nil {
+		return err
+	}
+	attr, err := statV2(fs, path)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteXDR(&dirOpResV2{NFSStatusOk, fh, *attr}); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func writeStatusV2(w *Response) error {
+	if err := w.WriteXDR(NFSStatusOk); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func onGetAttrV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var handle FileHandleV2
+	if err := xdr.Read(w.req.Body, &handle); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	return writeAttrStatV2(w, fs, path)
+}
+
+func onSetAttrV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var handle FileHandleV2
+	if err := xdr.Read(w.req.Body, &handle); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	attrs, err := ReadSetFileAttributesV2(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if err := w.checkSetAttr(ToFileAttribute(info, fullPath), attrs); err != nil {
+		return err
+	}
+	if err := attrs.Apply(changeFor(ctx, userHandle, fs), fs, fullPath); err != nil {
+		return err
+	}
+	return writeAttrStatV2(w, fs, path)
+}
+
+func onLookupV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, p, err := fromHandleV2(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	dirInfo, err := fs.Lstat(fs.Join(p...))
+	if err != nil || !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, err}
+	}
+	if err := w.checkPermission(fs, p, permExec); err != nil {
+		return err
+	}
+
+	switch string(obj.Filename) {
+	case ".":
+		return writeDirOpResV2(w, userHandle, fs, p)
+	case "..":
+		if len(p) == 0 {
+			return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+		}
+		return writeDirOpResV2(w, userHandle, fs, p[0:len(p)-1])
+	}
+
+	reqPath := append(p, string(obj.Filename))
+	if _, err = fs.Lstat(fs.Join(reqPath...)); err != nil {
+		return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
+	}
+	return writeDirOpResV2(w, userHandle, fs, reqPath)
+}
+
+func onReadLinkV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var handle FileHandleV2
+	if err := xdr.Read(w.req.Body, &handle); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+
+	out, err := fs.Readlink(fs.Join(path...))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if err := w.WriteXDR(&struct {
+		Status NFSStatus
+		Path   string
+	}{NFSStatusOk, out}); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+type readArgsV2 struct {
+	Handle     FileHandleV2
+	Offset     uint32
+	Count      uint32
+	TotalCount uint32
+}
+
+func onReadV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj readArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if err := w.checkOwnerOrPermission(fs, path, permRead); err != nil {
+		return err
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if info.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, os.ErrInvalid}
+	}
+	fh, err := fs.Open(fullPath)
+	if err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	defer fh.Close()
+
+	if obj.Count > MaxDataV2 {
+		obj.Count = MaxDataV2
+	}
+	if int64(obj.Offset) >= info.Size() {
+		obj.Count = 0
+	} else if info.Size()-int64(obj.Offset) < int64(obj.Count) {
+		obj.Count = uint32(info.Size() - int64(obj.Offset))
+	}
+	data := make([]byte, obj.Count)
+	cnt, err := fh.ReadAt(data, int64(obj.Offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+
+	if err := w.WriteXDR(&struct {
+		Status NFSStatus
+		Attr   FileAttributeV2
+		Data   []byte
+	}{NFSStatusOk, *ToFileAttributeV2(ToFileAttribute(info, fullPath)), data[:cnt]}); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+type writeArgsV2 struct {
+	Handle      FileHandleV2
+	BeginOffset uint32
+	Offset      uint32
+	TotalCount  uint32
+	Data        []byte
+}
+
+func onWriteV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var req writeArgsV2
+	if err := xdr.Read(w.req.Body, &req); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, req.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if err := w.checkOwnerOrPermission(fs, path, permWrite); err != nil {
+		return err
+	}
+	if len(req.Data) > MaxDataV2 {
+		return &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if info.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, os.ErrInvalid}
+	} else if !info.Mode().IsRegular() {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	file, err := fs.OpenFile(fullPath, os.O_RDWR, info.Mode().Perm())
+	if err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if _, err := file.Seek(int64(req.Offset), io.SeekStart); err != nil {
+		file.Close()
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	if _, err := file.Write(req.Data); err != nil {
+		file.Close()
+		return &NFSStatusError{statusFromWriteError(err), err}
+	}
+	if err := file.Close(); err != nil {
+		return &NFSStatusError{statusFromWriteError(err), err}
+	}
+	return writeAttrStatV2(w, fs, path)
+}
+
+// checkDirOpV2 checks that a new entry name may be created in the directory
+// at path.
+func (w *Response) checkDirOpV2(fs billy.Filesystem, path []string, name []byte) error {
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if err := w.checkPermission(fs, path, permWrite|permExec); err != nil {
+		return err
+	}
+	if len(name) > PathNameMax {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	if s, err := fs.Stat(fs.Join(path...)); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	} else if !s.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	return nil
+}
+
+func onCreateV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	attrs, err := ReadSetFileAttributesV2(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if err := w.checkDirOpV2(fs, path, obj.Filename); err != nil {
+		return err
+	}
+
+	newFile := append(path, string(obj.Filename))
+	newFilePath := fs.Join(newFile...)
+	changer := changeFor(ctx, userHandle, fs)
+	if s, err := fs.Stat(newFilePath); err == nil {
+		if s.IsDir() {
+			return &NFSStatusError{NFSStatusExist, nil}
+		}
+		// an existing file is kept, truncated if the client asks for it.
+		if attrs.SetSize != nil {
+			truncate := SetFileAttributes{SetSize: attrs.SetSize}
+			if err := w.checkSetAttr(ToFileAttribute(s, newFilePath), &truncate); err != nil {
+				return err
+			}
+			if err := truncate.Apply(changer, fs, newFilePath); err != nil {
+				return err
+			}
+		}
+		return writeDirOpResV2(w, userHandle, fs, newFile)
+	}
+
+	w.creationAttrs(fs, path, attrs, FileTypeRegular)
+	file, err := fs.Create(newFilePath)
+	if err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if err := file.Close(); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if err := attrs.Apply(changer, fs, newFilePath); err != nil {
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	return writeDirOpResV2(w, userHandle, fs, newFile)
+}
+
+func onMkdirV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	attrs, err := ReadSetFileAttributesV2(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if err := w.checkDirOpV2(fs, path, obj.Filename); err != nil {
+		return err
+	}
+	if string(obj.Filename) == "." || string(obj.Filename) == ".." {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+
+	newFolder := append(path, string(obj.Filename))
+	newFolderPath := fs.Join(newFolder...)
+	if _, err := fs.Stat(newFolderPath); err == nil {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+
+	setgid := w.creationAttrs(fs, path, attrs, FileTypeDirectory)
+	if err := fs.MkdirAll(newFolderPath, attrs.Mode(mkdirDefaultMode)); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if changer := changeFor(ctx, userHandle, fs); changer != nil {
+		if err := attrs.Apply(changer, fs, newFolderPath); err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+		if setgid {
+			if err := changer.Chmod(newFolderPath, attrs.Mode(mkdirDefaultMode)|os.ModeSetgid); err != nil {
+				return &NFSStatusError{NFSStatusIO, err}
+			}
+		}
+	}
+	return writeDirOpResV2(w, userHandle, fs, newFolder)
+}
+
+func onSymlinkV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj struct {
+		From   dirOpArgsV2
+		Target string
+	}
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	attrs, err := ReadSetFileAttributesV2(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, obj.From.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if err := w.checkDirOpV2(fs, path, obj.From.Filename); err != nil {
+		return err
+	}
+
+	newFilePath := fs.Join(append(path, string(obj.From.Filename))...)
+	if _, err := fs.Stat(newFilePath); err == nil {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+	w.creationAttrs(fs, path, attrs, FileTypeLink)
+	if err := fs.Symlink(obj.Target, newFilePath); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if changer := changeFor(ctx, userHandle, fs); changer != nil {
+		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+	}
+	return writeStatusV2(w)
+}
+
+func onLinkV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var from FileHandleV2
+	if err := xdr.Read(w.req.Body, &from); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	var to dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &to); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, fromPath, err := fromHandleV2(ctx, userHandle, from)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	fs2, toPath, err := fromHandleV2(ctx, userHandle, to.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if !reflect.DeepEqual(fs, fs2) {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	}
+	if err := w.checkDirOpV2(fs, toPath, to.Filename); err != nil {
+		return err
+	}
+
+	newFilePath := fs.Join(append(toPath, string(to.Filename))...)
+	if _, err := fs.Lstat(newFilePath); err == nil {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+	cos, ok := changeFor(ctx, userHandle, fs).(UnixChange)
+	if !ok {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	if err := cos.Link(fs.Join(fromPath...), newFilePath); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	return writeStatusV2(w)
+}
+
+// removeErrorV2 maps the error of removing an entry to its status.
+func removeErrorV2(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return &NFSStatusError{NFSStatusNoEnt, err}
+	case os.IsPermission(err):
+		return &NFSStatusError{NFSStatusAccess, err}
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return &NFSStatusError{NFSStatusNotEmpty, err}
+	}
+	return &NFSStatusError{NFSStatusIO, err}
+}
+
+func onRemoveV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, path, err := fromHandleV2(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if len(obj.Filename) > PathNameMax {
+		return &NFSStatusError{NFSStatusNameTooLong, nil}
+	}
+	dirInfo, err := fs.Stat(fs.Join(path...))
+	if err != nil {
+		return removeErrorV2(err)
+	}
+	if !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	if err := w.checkUnlink(fs, path, string(obj.Filename)); err != nil {
+		return err
+	}
+
+	toDelete := append(path, string(obj.Filename))
+	toDeleteHandle := userHandle.ToHandle(baseFS(fs), toDelete)
+	if err := fs.Remove(fs.Join(toDelete...)); err != nil {
+		return removeErrorV2(err)
+	}
+	if err := userHandle.InvalidateHandle(baseFS(fs), toDeleteHandle); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return writeStatusV2(w)
+}
+
+func onRenameV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var from, to dirOpArgsV2
+	if err := xdr.Read(w.req.Body, &from); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	if err := xdr.Read(w.req.Body, &to); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, fromPath, err := fromHandleV2(ctx, userHandle, from.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	fs2, toPath, err := fromHandleV2(ctx, userHandle, to.Handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if !reflect.DeepEqual(fs, fs2) {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if len(from.Filename) > PathNameMax || len(to.Filename) > PathNameMax {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	for _, dir := range [][]string{fromPath, toPath} {
+		info, err := fs.Stat(fs.Join(dir...))
+		if err != nil {
+			return removeErrorV2(err)
+		}
+		if !info.IsDir() {
+			return &NFSStatusError{NFSStatusNotDir, nil}
+		}
+	}
+	if err := w.checkUnlink(fs, fromPath, string(from.Filename)); err != nil {
+		return err
+	}
+	if err := w.checkUnlink(fs, toPath, string(to.Filename)); err != nil {
+		return err
+	}
+
+	oldHandle := userHandle.ToHandle(baseFS(fs), append(fromPath, string(from.Filename)))
+	fromLoc := fs.Join(append(fromPath, string(from.Filename))...)
+	toLoc := fs.Join(append(toPath, string(to.Filename))...)
+	if err := fs.Rename(fromLoc, toLoc); err != nil {
+		return removeErrorV2(err)
+	}
+	if err := userHandle.InvalidateHandle(baseFS(fs), oldHandle); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return writeStatusV2(w)
+}
+
+type readDirArgsV2 struct {
+	Handle FileHandleV2
+	Cookie uint32
+	Count  uint32
+}
+
+type readDirEntityV2 struct {
+	FileID uint32
+	Name   []byte
+	Cookie uint32
+	Next   bool
+}
+
+// onReadDirV2 lists a directory. The cookie of an entry is the position of
+// the entry after it, counting "." and ".." first.
+func onReadDirV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var obj readDirArgsV2
+	if err := xdr.Read(w.req.Body, &obj); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	if obj.Count > MaxDataV2 {
+		obj.Count = MaxDataV2
+	}
+	fh, err := obj.Handle.handle()
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	fs, p, err := fromHandle(ctx, userHandle, fh)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	contents, _, err := getDirListingWithVerifier(ctx, userHandle, fh, 0)
+	if err != nil {
+		return err
+	}
+
+	fileID := func(path []string) uint32 {
+		if attr := tryStat(fs, path); attr != nil {
+			return uint32(attr.Fileid ^ attr.Fileid>>32)
+		}
+		return 0
+	}
+	entities := make([]readDirEntityV2, 0)
+	// the status, the end of the list and the eof flag.
+	size := uint32(12)
+	eof := true
+	for i := int(obj.Cookie); i < len(contents)+2; i++ {
+		e := readDirEntityV2{Cookie: uint32(i + 1), Next: true}
+		switch i {
+		case 0:
+			e.Name, e.FileID = []byte("."), fileID(p)
+		case 1:
+			e.Name = []byte("..")
+			if len(p) > 0 {
+				e.FileID = fileID(p[0 : len(p)-1])
+			}
+		default:
+			c := contents[i-2]
+			attr := ToFileAttribute(c, path.Join(append(p, c.Name())...))
+			e.Name, e.FileID = []byte(c.Name()), uint32(attr.Fileid^attr.Fileid>>32)
+		}
+		// an entry takes its flag, file id, name and cookie.
+		size += 16 + uint32(len(e.Name)+3)&^3
+		if size > obj.Count {
+			eof = false
+			break
+		}
+		entities = append(entities, e)
+	}
+	if len(entities) == 0 && !eof {
+		return &NFSStatusError{NFSStatusTooSmall, nil}
+	}
+	if len(entities) > 0 {
+		entities[len(entities)-1].Next = false
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, NFSStatusOk); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := xdr.Write(writer, len(entities) > 0); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	for _, e := range entities {
+		if err := xdr.Write(writer, e); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+	}
+	if err := xdr.Write(writer, eof); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func onStatFSV2(ctx context.Context, w *Response, userHandle Handler) error {
+	var handle FileHandleV2
+	if err := xdr.Read(w.req.Body, &handle); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	fs, _, err := fromHandleV2(ctx, userHandle, handle)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	stat, err := fsStat(ctx, userHandle, fs)
+	if err != nil {
+		return err
+	}
+
+	if err := w.WriteXDR(&struct {
+		Status NFSStatus
+		TSize  uint32
+		BSize  uint32
+		Blocks uint32
+		BFree  uint32
+		BAvail uint32
+	}{
+		NFSStatusOk, MaxDataV2, BlockSizeV2,
+		clampUint32(stat.TotalSize / BlockSizeV2),
+		clampUint32(stat.FreeSize / BlockSizeV2),
+		clampUint32(stat.AvailableSize / BlockSizeV2),
+	}); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
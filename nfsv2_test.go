@@ -0,0 +1,171 @@
+package nfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+)
+
+// sattrUnset is a sattr that changes nothing.
+var sattrUnset = xdrUint32s(^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0))
+
+func TestNFSv2(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	xid := uint32(0)
+	call := func(prog, vers, proc uint32, args []byte) []byte {
+		xid++
+		writeFragments(t, c, rpcCall(xid, prog, vers, proc, args), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("%d.%d failed: %d", prog, proc, stat)
+		}
+		return body
+	}
+	nfs2 := func(proc nfs.NFSv2Procedure, args []byte) (nfs.NFSStatus, []byte) {
+		body := call(100003, 2, uint32(proc), args)
+		return nfs.NFSStatus(binary.BigEndian.Uint32(body)), body[4:]
+	}
+
+	// MOUNT v1 returns the root as a fixed size handle.
+	mnt := call(100005, 1, uint32(nfs.MountProcMount), xdrOpaque([]byte("/")))
+	if status := binary.BigEndian.Uint32(mnt); status != 0 || len(mnt) != 4+nfs.FHSizeV2 {
+		t.Fatalf("mount: %x", mnt)
+	}
+	root := mnt[4:]
+
+	status, res := nfs2(nfs.NFSv2ProcedureGetAttr, root)
+	if status != nfs.NFSStatusOk || binary.BigEndian.Uint32(res) != uint32(nfs.FileTypeV2Directory) {
+		t.Fatalf("getattr of root: %v %x", status, res)
+	}
+	if mode := binary.BigEndian.Uint32(res[4:]); mode&0170000 != 0040000 {
+		t.Fatalf("mode of root: %o", mode)
+	}
+
+	dirop := func(fh []byte, name string) []byte {
+		return append(append([]byte{}, fh...), xdrOpaque([]byte(name))...)
+	}
+	status, res = nfs2(nfs.NFSv2ProcedureCreate, append(dirop(root, "file"), sattrUnset...))
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("create: %v", status)
+	}
+	file := res[:nfs.FHSizeV2]
+
+	data := []byte("hello, nfsv2")
+	status, res = nfs2(nfs.NFSv2ProcedureWrite, append(append(append([]byte{}, file...), xdrUint32s(0, 0, 0)...), xdrOpaque(data)...))
+	if status != nfs.NFSStatusOk || binary.BigEndian.Uint32(res[20:]) != uint32(len(data)) {
+		t.Fatalf("write: %v %x", status, res)
+	}
+
+	status, res = nfs2(nfs.NFSv2ProcedureLookup, dirop(root, "file"))
+	if status != nfs.NFSStatusOk || !bytes.Equal(res[:nfs.FHSizeV2], file) {
+		t.Fatalf("lookup: %v %x", status, res)
+	}
+	if status, _ := nfs2(nfs.NFSv2ProcedureLookup, dirop(root, "missing")); status != nfs.NFSStatusNoEnt {
+		t.Fatalf("lookup of missing file: %v", status)
+	}
+
+	status, res = nfs2(nfs.NFSv2ProcedureRead, append(append([]byte{}, file...), xdrUint32s(7, 100, 0)...))
+	if status != nfs.NFSStatusOk || !bytes.Equal(res[68:], xdrOpaque(data[7:])) {
+		t.Fatalf("read: %v %x", status, res)
+	}
+
+	// entries are ".", "..", "dir" and "file", resumed from the cookie of
+	// the second.
+	status, res = nfs2(nfs.NFSv2ProcedureReadDir, append(append([]byte{}, root...), xdrUint32s(2, 8192)...))
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("readdir: %v", status)
+	}
+	var names []string
+	for p := res; binary.BigEndian.Uint32(p) == 1; {
+		n := binary.BigEndian.Uint32(p[8:])
+		names = append(names, string(p[12:12+n]))
+		p = p[12+(n+3)&^3+4:]
+	}
+	if len(names) != 2 || names[0] != "dir" || names[1] != "file" || binary.BigEndian.Uint32(res[len(res)-4:]) != 1 {
+		t.Fatalf("readdir entries: %v %x", names, res)
+	}
+
+	if status, res := nfs2(nfs.NFSv2ProcedureStatFS, root); status != nfs.NFSStatusOk || binary.BigEndian.Uint32(res) != nfs.MaxDataV2 {
+		t.Fatalf("statfs: %v %x", status, res)
+	}
+
+	if status, _ := nfs2(nfs.NFSv2ProcedureRemove, dirop(root, "file")); status != nfs.NFSStatusOk {
+		t.Fatalf("remove: %v", status)
+	}
+	// the handle of the removed file is stale.
+	if status, _ := nfs2(nfs.NFSv2ProcedureGetAttr, file); status != nfs.NFSStatusStale {
+		t.Fatalf("getattr of removed file: %v", status)
+	}
+	if status, _ := nfs2(nfs.NFSv2ProcedureRmDir, dirop(root, "dir")); status != nfs.NFSStatusOk {
+		t.Fatalf("rmdir: %v", status)
+	}
+}
+
+func TestNFSv2CreateExisting(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kept"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &nfs.Server{
+		Handler:          helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024),
+		CheckPermissions: true,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeFragments(t, c, rpcCall(1, 100005, 1, uint32(nfs.MountProcMount), xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, mnt := readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(mnt) != 0 {
+		t.Fatalf("mount: %d %x", stat, mnt)
+	}
+	// a CREATE of an existing file that truncates it, by a caller without
+	// write permission on it.
+	sattr := xdrUint32s(^uint32(0), ^uint32(0), ^uint32(0), 0, ^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0))
+	create := append(append(append([]byte{}, mnt[4:]...), xdrOpaque([]byte("kept"))...), sattr...)
+	writeFragments(t, c, rpcCall(2, 100003, 2, uint32(nfs.NFSv2ProcedureCreate), create), 1<<20)
+	if _, stat, res := readReplyBody(t, c); stat != 0 || nfs.NFSStatus(binary.BigEndian.Uint32(res)) != nfs.NFSStatusAccess {
+		t.Fatalf("create over another's file: %d %x", stat, res)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "kept")); err != nil || string(data) != "secret" {
+		t.Fatalf("file created over holds %q: %v", data, err)
+	}
+}
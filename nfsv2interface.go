@@ -0,0 +1,240 @@
+package nfs
+
+import (
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// NFSv2Procedure is the valid RPC calls for version 2 of the nfs service.
+type NFSv2Procedure uint32
+
+// NFSv2Procedure Codes
+const (
+	NFSv2ProcedureNull NFSv2Procedure = iota
+	NFSv2ProcedureGetAttr
+	NFSv2ProcedureSetAttr
+	NFSv2ProcedureRoot
+	NFSv2ProcedureLookup
+	NFSv2ProcedureReadlink
+	NFSv2ProcedureRead
+	NFSv2ProcedureWriteCache
+	NFSv2ProcedureWrite
+	NFSv2ProcedureCreate
+	NFSv2ProcedureRemove
+	NFSv2ProcedureRename
+	NFSv2ProcedureLink
+	NFSv2ProcedureSymlink
+	NFSv2ProcedureMkDir
+	NFSv2ProcedureRmDir
+	NFSv2ProcedureReadDir
+	NFSv2ProcedureStatFS
+)
+
+func (n NFSv2Procedure) String() string {
+	switch n {
+	case NFSv2ProcedureNull:
+		return "Null"
+	case NFSv2ProcedureGetAttr:
+		return "GetAttr"
+	case NFSv2ProcedureSetAttr:
+		return "SetAttr"
+	case NFSv2ProcedureRoot:
+		return "Root"
+	case NFSv2ProcedureLookup:
+		return "Lookup"
+	case NFSv2ProcedureReadlink:
+		return "ReadLink"
+	case NFSv2ProcedureRead:
+		return "Read"
+	case NFSv2ProcedureWriteCache:
+		return "WriteCache"
+	case NFSv2ProcedureWrite:
+		return "Write"
+	case NFSv2ProcedureCreate:
+		return "Create"
+	case NFSv2ProcedureRemove:
+		return "Remove"
+	case NFSv2ProcedureRename:
+		return "Rename"
+	case NFSv2ProcedureLink:
+		return "Link"
+	case NFSv2ProcedureSymlink:
+		return "Symlink"
+	case NFSv2ProcedureMkDir:
+		return "Mkdir"
+	case NFSv2ProcedureRmDir:
+		return "Rmdir"
+	case NFSv2ProcedureReadDir:
+		return "ReadDir"
+	case NFSv2ProcedureStatFS:
+		return "StatFS"
+	default:
+		return "Unknown"
+	}
+}
+
+// FHSizeV2 is the size of every NFSv2 file handle.
+const FHSizeV2 = 32
+
+// MaxDataV2 is the largest READ, WRITE or READDIR payload of NFSv2.
+const MaxDataV2 = 8192
+
+// BlockSizeV2 is the block size NFSv2 attributes and STATFS count space in.
+const BlockSizeV2 = 4096
+
+// FileHandleV2 maps to a fhandle
+type FileHandleV2 [FHSizeV2]byte
+
+// FileTypeV2 represents a NFSv2 File Type (ftype)
+type FileTypeV2 uint32
+
+// Enumeration of NFSv2 FileTypes. Sockets and FIFOs have no type of their
+// own, and are told apart by the type bits of their mode.
+const (
+	FileTypeV2Non FileTypeV2 = iota
+	FileTypeV2Regular
+	FileTypeV2Directory
+	FileTypeV2Block
+	FileTypeV2Character
+	FileTypeV2Link
+)
+
+// TimeV2 is the NFSv2 wire time format (timeval)
+type TimeV2 struct {
+	Seconds  uint32
+	USeconds uint32
+}
+
+// FileAttributeV2 holds metadata about a filesystem object as fattr
+type FileAttributeV2 struct {
+	Type                FileTypeV2
+	Mode                uint32
+	Nlink               uint32
+	UID                 uint32
+	GID                 uint32
+	Size                uint32
+	BlockSize           uint32
+	Rdev                uint32
+	Blocks              uint32
+	FSID                uint32
+	Fileid              uint32
+	Atime, Mtime, Ctime TimeV2
+}
+
+// The unix file type bits of a mode.
+const (
+	modeTypeSocket    = 0140000
+	modeTypeLink      = 0120000
+	modeTypeRegular   = 0100000
+	modeTypeBlock     = 0060000
+	modeTypeDirectory = 0040000
+	modeTypeCharacter = 0020000
+	modeTypeFIFO      = 0010000
+)
+
+// ToFileAttributeV2 converts the attributes of a file to their fattr
+// representation. Values beyond 32 bits are clamped, except for the file
+// id, which is folded.
+func ToFileAttributeV2(f *FileAttribute) *FileAttributeV2 {
+	mode := f.Mode()
+	a := FileAttributeV2{
+		Mode:      uint32(mode.Perm()),
+		Nlink:     f.Nlink,
+		UID:       f.UID,
+		GID:       f.GID,
+		Size:      clampUint32(f.Filesize),
+		BlockSize: BlockSizeV2,
+		Blocks:    clampUint32((f.Used + BlockSizeV2 - 1) / BlockSizeV2),
+		FSID:      uint32(f.FSID ^ f.FSID>>32),
+		Fileid:    uint32(f.Fileid ^ f.Fileid>>32),
+		Atime:     toTimeV2(f.Atime),
+		Mtime:     toTimeV2(f.Mtime),
+		Ctime:     toTimeV2(f.Ctime),
+	}
+	if mode&os.ModeSetuid != 0 {
+		a.Mode |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		a.Mode |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		a.Mode |= 01000
+	}
+	switch f.Type {
+	case FileTypeRegular:
+		a.Type, a.Mode = FileTypeV2Regular, a.Mode|modeTypeRegular
+	case FileTypeDirectory:
+		a.Type, a.Mode = FileTypeV2Directory, a.Mode|modeTypeDirectory
+	case FileTypeBlock:
+		a.Type, a.Mode = FileTypeV2Block, a.Mode|modeTypeBlock
+	case FileTypeCharacter:
+		a.Type, a.Mode = FileTypeV2Character, a.Mode|modeTypeCharacter
+	case FileTypeLink:
+		a.Type, a.Mode = FileTypeV2Link, a.Mode|modeTypeLink
+	case FileTypeSocket:
+		a.Mode |= modeTypeSocket
+	case FileTypeFIFO:
+		a.Mode |= modeTypeFIFO
+	}
+	if f.Type == FileTypeBlock || f.Type == FileTypeCharacter {
+		a.Rdev = f.SpecData[0]<<8 | f.SpecData[1]&0xff
+	}
+	return &a
+}
+
+func toTimeV2(t FileTime) TimeV2 {
+	return TimeV2{Seconds: t.Seconds, USeconds: t.Nseconds / 1000}
+}
+
+// sattrUnset marks a field of a sattr that is left unchanged.
+const sattrUnset = math.MaxUint32
+
+// sattrServerTime is the microseconds of a time that clients set to the
+// server's current time.
+const sattrServerTime = 1000000
+
+// ReadSetFileAttributesV2 reads a sattr xdr stream into a go struct.
+func ReadSetFileAttributesV2(r io.Reader) (*SetFileAttributes, error) {
+	var sattr struct {
+		Mode, UID, GID, Size uint32
+		Atime, Mtime         TimeV2
+	}
+	if err := xdr.Read(r, &sattr); err != nil {
+		return nil, err
+	}
+	attrs := SetFileAttributes{}
+	if sattr.Mode != sattrUnset {
+		mode := sattr.Mode & 07777
+		attrs.SetMode = &mode
+	}
+	if sattr.UID != sattrUnset {
+		attrs.SetUID = &sattr.UID
+	}
+	if sattr.GID != sattrUnset {
+		attrs.SetGID = &sattr.GID
+	}
+	if sattr.Size != sattrUnset {
+		size := uint64(sattr.Size)
+		attrs.SetSize = &size
+	}
+	attrs.SetAtime = sattr.Atime.native()
+	attrs.SetMtime = sattr.Mtime.native()
+	return &attrs, nil
+}
+
+// native is the time a sattr sets, or nil if it is unset.
+func (t TimeV2) native() *time.Time {
+	if t.Seconds == sattrUnset && t.USeconds == sattrUnset {
+		return nil
+	}
+	if t.USeconds == sattrServerTime {
+		now := time.Now()
+		return &now
+	}
+	ts := time.Unix(int64(t.Seconds), int64(t.USeconds)*int64(time.Microsecond))
+	return &ts
+}
@@ -0,0 +1,597 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	nlmServiceID = 100021
+	nlmVersion   = 4
+)
+
+func init() {
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcNull), onNLMNull)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcTest), onNLMTest)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcLock), onNLMLock)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcCancel), onNLMCancel)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcUnlock), onNLMUnlock)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcGranted), onNLMGranted)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcTestMsg), onNLMTestMsg)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcLockMsg), onNLMLockMsg)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcCancelMsg), onNLMCancelMsg)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcUnlockMsg), onNLMUnlockMsg)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcGrantedMsg), onNLMNull)
+	for _, proc := range []NLMProcedure{NLMProcTestRes, NLMProcLockRes, NLMProcCancelRes, NLMProcUnlockRes, NLMProcGrantedRes} {
+		_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(proc), onNLMNull)
+	}
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcShare), onNLMShare)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcUnshare), onNLMUnshare)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcNMLock), onNLMNMLock)
+	_ = RegisterVersionedMessageHandler(nlmServiceID, nlmVersion, uint32(NLMProcFreeAll), onNLMFreeAll)
+}
+
+// nlmLock is the nlm4_lock of the protocol.
+type nlmLock struct {
+	CallerName string
+	FH         []byte
+	OH         []byte
+	Svid       int32
+	Offset     uint64
+	Length     uint64
+}
+
+func (l *nlmLock) lock(exclusive bool) Lock {
+	return Lock{Caller: l.CallerName, Owner: l.OH, Svid: l.Svid, Offset: l.Offset, Length: l.Length, Exclusive: exclusive}
+}
+
+type nlmTestArgs struct {
+	Cookie    []byte
+	Exclusive bool
+	Lock      nlmLock
+}
+
+type nlmLockArgs struct {
+	Cookie    []byte
+	Block     bool
+	Exclusive bool
+	Lock      nlmLock
+	Reclaim   bool
+	State     int32
+}
+
+type nlmCancelArgs struct {
+	Cookie    []byte
+	Block     bool
+	Exclusive bool
+	Lock      nlmLock
+}
+
+type nlmUnlockArgs struct {
+	Cookie []byte
+	Lock   nlmLock
+}
+
+type nlmShareArgs struct {
+	Cookie     []byte
+	CallerName string
+	FH         []byte
+	OH         []byte
+	Mode       uint32
+	Access     uint32
+	Reclaim    bool
+}
+
+// nlmFileHandle returns the file handle of the arguments of an NLM procedure,
+// which follows the cookie, the flags of the procedure and the caller name.
+func nlmFileHandle(proc NLMProcedure, args []byte) ([]byte, bool) {
+	var flags int
+	switch proc {
+	case NLMProcTest, NLMProcTestMsg:
+		flags = 1
+	case NLMProcLock, NLMProcLockMsg, NLMProcNMLock, NLMProcCancel, NLMProcCancelMsg:
+		flags = 2
+	case NLMProcUnlock, NLMProcUnlockMsg, NLMProcShare, NLMProcUnshare:
+	default:
+		return nil, false
+	}
+	r := bytes.NewReader(args)
+	var cookie []byte
+	if err := xdr.Read(r, &cookie); err != nil {
+		return nil, false
+	}
+	for i := 0; i < flags; i++ {
+		if _, err := xdr.ReadUint32(r); err != nil {
+			return nil, false
+		}
+	}
+	var lock struct {
+		CallerName string
+		FH         []byte
+	}
+	if err := xdr.Read(r, &lock); err != nil {
+		return nil, false
+	}
+	return lock.FH, true
+}
+
+// nlmStatusError is an NFSStatusError raised before an NLM procedure runs,
+// sent as the failure of the procedure.
+type nlmStatusError struct {
+	NFSStatusError
+	body []byte
+}
+
+// MarshalBinary provides the wire format of the error response
+func (e *nlmStatusError) MarshalBinary() (data []byte, err error) {
+	return e.body, nil
+}
+
+// nlmErrorFormatter encodes NFS status errors, as an ExportAuthorizer
+// returns, as the procedure's result with NLMStatusFailed. The asynchronous
+// procedures are left with an empty reply.
+func nlmErrorFormatter(req *Request) func(error) RPCError {
+	return func(err error) RPCError {
+		nerr, ok := err.(*NFSStatusError)
+		if !ok {
+			return basicErrorFormatter(err)
+		}
+		writer := bytes.NewBuffer([]byte{})
+		switch NLMProcedure(req.Header.Proc) {
+		case NLMProcTest, NLMProcLock, NLMProcCancel, NLMProcUnlock, NLMProcNMLock,
+			NLMProcShare, NLMProcUnshare:
+			var cookie []byte
+			_ = xdr.Read(bytes.NewReader(req.args), &cookie)
+			_ = xdr.Write(writer, cookie)
+			_ = xdr.Write(writer, NLMStatusFailed)
+			if p := NLMProcedure(req.Header.Proc); p == NLMProcShare || p == NLMProcUnshare {
+				_ = xdr.Write(writer, int32(0))
+			}
+		}
+		return &nlmStatusError{*nerr, writer.Bytes()}
+	}
+}
+
+type nlmNotify struct {
+	Name  string
+	State int32
+}
+
+type nlmRes struct {
+	Cookie []byte
+	Stat   NLMStatus
+}
+
+// nlmHolder is the nlm4_holder reported with NLMStatusDenied by TEST.
+type nlmHolder struct {
+	Exclusive bool
+	Svid      int32
+	OH        []byte
+	Offset    uint64
+	Length    uint64
+}
+
+type nlmShareRes struct {
+	Cookie   []byte
+	Stat     NLMStatus
+	Sequence int32
+}
+
+// lockWaiter is a blocking LOCK request waiting for a conflicting lock to be
+// released, after which it is granted with a GRANTED callback.
+type lockWaiter struct {
+	fh   string
+	args nlmLockArgs
+	// network and host are where the client's lock manager is reached.
+	network string
+	host    string
+}
+
+// lockService is the network lock manager state of a Server.
+type lockService struct {
+	manager LockManager
+	// graceEnd is when the grace period for reclaiming locks after a
+	// restart ends.
+	graceEnd time.Time
+
+	mu      sync.Mutex
+	waiters []*lockWaiter
+	// monitored holds the hosts holding locks that the status monitor
+	// watches for restarts, with the functions that stop it.
+	monitored map[string]func()
+}
+
+func (l *lockService) inGrace() bool {
+	return time.Now().Before(l.graceEnd)
+}
+
+func onNLMNull(ctx context.Context, w *Response, userHandle Handler) error {
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// checkLockHandle reports the status for a lock request on a file handle the
+// handler does not know, and for a range beyond the protocol's offsets.
+func checkLockHandle(userHandle Handler, fh []byte, l *nlmLock) (NLMStatus, bool) {
+	if _, _, err := userHandle.FromHandle(fh); err != nil {
+		return NLMStatusStaleFH, false
+	}
+	if l != nil && l.Length != 0 && l.Offset+l.Length < l.Offset {
+		return NLMStatusFBig, false
+	}
+	return NLMStatusGranted, true
+}
+
+func nlmTest(ctx context.Context, w *Response, userHandle Handler) ([]byte, error) {
+	var args nlmTestArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return nil, &ResponseCodeGarbageArgsError{}
+	}
+	writer := bytes.NewBuffer([]byte{})
+	_ = xdr.Write(writer, args.Cookie)
+	if status, ok := checkLockHandle(userHandle, args.Lock.FH, &args.Lock); !ok {
+		_ = xdr.Write(writer, status)
+		return writer.Bytes(), nil
+	}
+	locks := w.conn.Server.locks
+	if locks.inGrace() {
+		_ = xdr.Write(writer, NLMStatusDeniedGracePeriod)
+		return writer.Bytes(), nil
+	}
+	conflict, err := locks.manager.Test(ctx, args.Lock.FH, args.Lock.lock(args.Exclusive))
+	if err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		_ = xdr.Write(writer, NLMStatusFailed)
+	} else if conflict != nil {
+		_ = xdr.Write(writer, NLMStatusDenied)
+		_ = xdr.Write(writer, &nlmHolder{conflict.Exclusive, conflict.Svid, conflict.Owner, conflict.Offset, conflict.Length})
+	} else {
+		_ = xdr.Write(writer, NLMStatusGranted)
+	}
+	return writer.Bytes(), nil
+}
+
+func onNLMTest(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmTest(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	return w.Write(res)
+}
+
+func nlmLockRequest(ctx context.Context, w *Response, userHandle Handler, monitored bool) (*nlmRes, error) {
+	var args nlmLockArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return nil, &ResponseCodeGarbageArgsError{}
+	}
+	if !monitored {
+		args.Block = false
+	}
+	res := &nlmRes{Cookie: args.Cookie}
+	if status, ok := checkLockHandle(userHandle, args.Lock.FH, &args.Lock); !ok {
+		res.Stat = status
+		return res, nil
+	}
+	locks := w.conn.Server.locks
+	if locks.inGrace() && !args.Reclaim {
+		res.Stat = NLMStatusDeniedGracePeriod
+		return res, nil
+	}
+	conflict, err := locks.manager.Lock(ctx, args.Lock.FH, args.Lock.lock(args.Exclusive))
+	switch {
+	case err != nil:
+		Log.Debugf("%v: %v", w.req, err)
+		res.Stat = NLMStatusFailed
+	case conflict == nil:
+		res.Stat = NLMStatusGranted
+		if monitored {
+			locks.monitor(w.conn.Server, args.Lock.CallerName, remoteIP(w.conn.Conn))
+		}
+		locks.retry(w.conn.Server, args.Lock.FH)
+	case args.Block:
+		network := "tcp"
+		if w.conn.datagram {
+			network = "udp"
+		}
+		locks.wait(&lockWaiter{fh: string(args.Lock.FH), args: args, network: network, host: remoteIP(w.conn.Conn)})
+		res.Stat = NLMStatusBlocked
+	default:
+		res.Stat = NLMStatusDenied
+	}
+	return res, nil
+}
+
+func onNLMLock(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmLockRequest(ctx, w, userHandle, true)
+	if err != nil {
+		return err
+	}
+	return w.WriteXDR(res)
+}
+
+func onNLMNMLock(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmLockRequest(ctx, w, userHandle, false)
+	if err != nil {
+		return err
+	}
+	return w.WriteXDR(res)
+}
+
+func nlmCancel(ctx context.Context, w *Response, userHandle Handler) (*nlmRes, error) {
+	var args nlmCancelArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return nil, &ResponseCodeGarbageArgsError{}
+	}
+	res := &nlmRes{Cookie: args.Cookie, Stat: NLMStatusDenied}
+	if w.conn.Server.locks.cancel(args.Lock.FH, args.Lock.lock(args.Exclusive)) {
+		res.Stat = NLMStatusGranted
+	}
+	return res, nil
+}
+
+func onNLMCancel(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmCancel(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	return w.WriteXDR(res)
+}
+
+func nlmUnlock(ctx context.Context, w *Response, userHandle Handler) (*nlmRes, error) {
+	var args nlmUnlockArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return nil, &ResponseCodeGarbageArgsError{}
+	}
+	res := &nlmRes{Cookie: args.Cookie}
+	if status, ok := checkLockHandle(userHandle, args.Lock.FH, nil); !ok {
+		res.Stat = status
+		return res, nil
+	}
+	locks := w.conn.Server.locks
+	if err := locks.manager.Unlock(ctx, args.Lock.FH, args.Lock.lock(false)); err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		res.Stat = NLMStatusFailed
+		return res, nil
+	}
+	locks.retry(w.conn.Server, args.Lock.FH)
+	return res, nil
+}
+
+func onNLMUnlock(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmUnlock(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	return w.WriteXDR(res)
+}
+
+// onNLMGranted answers a GRANTED callback, which only a lock manager client
+// expects, as one for a request this server never made.
+func onNLMGranted(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nlmTestArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	return w.WriteXDR(&nlmRes{Cookie: args.Cookie, Stat: NLMStatusDenied})
+}
+
+// The asynchronous procedures are answered with a call of the matching
+// result procedure to the client, the reply to the call itself being empty.
+
+func onNLMTestMsg(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmTest(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	w.sendNLMResult(NLMProcTestRes, res)
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+func onNLMLockMsg(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmLockRequest(ctx, w, userHandle, true)
+	if err != nil {
+		return err
+	}
+	w.sendNLMResult(NLMProcLockRes, res)
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+func onNLMCancelMsg(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmCancel(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	w.sendNLMResult(NLMProcCancelRes, res)
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+func onNLMUnlockMsg(ctx context.Context, w *Response, userHandle Handler) error {
+	res, err := nlmUnlock(ctx, w, userHandle)
+	if err != nil {
+		return err
+	}
+	w.sendNLMResult(NLMProcUnlockRes, res)
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// sendNLMResult calls a result procedure of the client's lock manager.
+func (w *Response) sendNLMResult(proc NLMProcedure, res interface{}) {
+	s, host, network := w.conn.Server, remoteIP(w.conn.Conn), "tcp"
+	if w.conn.datagram {
+		network = "udp"
+	}
+	go func() {
+		if _, err := s.callClient(context.Background(), network, host, nlmServiceID, nlmVersion, uint32(proc), res); err != nil {
+			Log.Debugf("unable to send nlm.%s to %s: %v", proc, host, err)
+		}
+	}()
+}
+
+func onNLMShare(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nlmShareArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	res := &nlmShareRes{Cookie: args.Cookie}
+	if status, ok := checkLockHandle(userHandle, args.FH, nil); !ok {
+		res.Stat = status
+		return w.WriteXDR(res)
+	}
+	if w.conn.Server.locks.inGrace() && !args.Reclaim {
+		res.Stat = NLMStatusDeniedGracePeriod
+		return w.WriteXDR(res)
+	}
+	granted, err := w.conn.Server.locks.manager.Share(ctx, args.FH, Share{args.CallerName, args.OH, args.Mode, args.Access})
+	if err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		res.Stat = NLMStatusFailed
+	} else if !granted {
+		res.Stat = NLMStatusDenied
+	}
+	return w.WriteXDR(res)
+}
+
+func onNLMUnshare(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nlmShareArgs
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	res := &nlmShareRes{Cookie: args.Cookie}
+	if err := w.conn.Server.locks.manager.Unshare(ctx, args.FH, Share{args.CallerName, args.OH, args.Mode, args.Access}); err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		res.Stat = NLMStatusFailed
+	}
+	return w.WriteXDR(res)
+}
+
+// onNLMFreeAll releases the locks of a client host that has rebooted.
+func onNLMFreeAll(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nlmNotify
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	w.conn.Server.releaseLocks(ctx, args.Name)
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// releaseLocks drops the locks, reservations and waiting requests of a
+// client host.
+func (s *Server) releaseLocks(ctx context.Context, caller string) {
+	locks := s.locks
+	if err := locks.manager.ReleaseAll(ctx, caller); err != nil {
+		Log.Warnf("unable to release locks of %s: %v", caller, err)
+	}
+	locks.mu.Lock()
+	if stop, ok := locks.monitored[caller]; ok {
+		delete(locks.monitored, caller)
+		stop()
+	}
+	kept := locks.waiters[:0]
+	for _, waiter := range locks.waiters {
+		if waiter.args.Lock.CallerName != caller {
+			kept = append(kept, waiter)
+		}
+	}
+	locks.waiters = kept
+	locks.mu.Unlock()
+	locks.retry(s, nil)
+}
+
+// wait queues a blocked lock request, unless it is already waiting.
+func (l *lockService) wait(waiter *lockWaiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock := waiter.args.Lock.lock(waiter.args.Exclusive)
+	for _, other := range l.waiters {
+		if other.fh == waiter.fh && sameLock(other.args.Lock.lock(other.args.Exclusive), lock) {
+			return
+		}
+	}
+	l.waiters = append(l.waiters, waiter)
+}
+
+// cancel drops a waiting lock request, reporting whether there was one.
+func (l *lockService) cancel(fh []byte, lock Lock) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter.fh == string(fh) && sameLock(waiter.args.Lock.lock(waiter.args.Exclusive), lock) {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// monitor asks the status monitor to report when a host holding locks
+// restarts, so that its locks are released.
+func (l *lockService) monitor(s *Server, caller, host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.monitored[caller]; ok {
+		return
+	}
+	stop, err := s.MonitorHost(caller, host, func(name string, state int32) {
+		Log.Infof("releasing locks of %s, which restarted", name)
+		s.releaseLocks(context.Background(), name)
+	})
+	if err != nil {
+		Log.Warnf("unable to monitor %s: %v", caller, err)
+		return
+	}
+	l.monitored[caller] = stop
+}
+
+func sameLock(a, b Lock) bool {
+	return a.SameOwner(&b) && a.Offset == b.Offset && a.Length == b.Length && a.Exclusive == b.Exclusive
+}
+
+// retry grants the waiting requests for a file, or all files if fh is nil,
+// that no longer conflict, and tells their clients with GRANTED callbacks.
+func (l *lockService) retry(s *Server, fh []byte) {
+	ctx := context.Background()
+	l.mu.Lock()
+	var granted []*lockWaiter
+	kept := l.waiters[:0]
+	for _, waiter := range l.waiters {
+		if fh != nil && waiter.fh != string(fh) {
+			kept = append(kept, waiter)
+			continue
+		}
+		conflict, err := l.manager.Lock(ctx, []byte(waiter.fh), waiter.args.Lock.lock(waiter.args.Exclusive))
+		if err != nil || conflict != nil {
+			kept = append(kept, waiter)
+			continue
+		}
+		granted = append(granted, waiter)
+	}
+	l.waiters = kept
+	l.mu.Unlock()
+
+	for _, waiter := range granted {
+		go l.grant(s, waiter)
+	}
+}
+
+// grant tells a client its blocked lock has been granted, releasing the lock
+// again if the client does not accept it.
+func (l *lockService) grant(s *Server, waiter *lockWaiter) {
+	ctx := context.Background()
+	args := nlmTestArgs{Cookie: waiter.args.Cookie, Exclusive: waiter.args.Exclusive, Lock: waiter.args.Lock}
+	res, err := s.callClient(ctx, waiter.network, waiter.host, nlmServiceID, nlmVersion, uint32(NLMProcGranted), &args)
+	if err == nil {
+		var reply nlmRes
+		if err = xdr.Read(bytes.NewReader(res), &reply); err == nil && reply.Stat == NLMStatusGranted {
+			l.monitor(s, waiter.args.Lock.CallerName, waiter.host)
+			return
+		}
+	}
+	Log.Debugf("releasing lock granted to %s, which did not accept it: %v", waiter.host, err)
+	if err := l.manager.Unlock(ctx, []byte(waiter.fh), waiter.args.Lock.lock(waiter.args.Exclusive)); err != nil {
+		Log.Warnf("unable to release lock: %v", err)
+	}
+	l.retry(s, []byte(waiter.fh))
+}
@@ -0,0 +1,256 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+// nlmLockArg encodes an nlm4_lock over the whole of a file.
+func nlmLockArg(caller string, fh []byte, svid uint32) []byte {
+	b := append(xdrOpaque([]byte(caller)), xdrOpaque(fh)...)
+	b = append(b, xdrOpaque([]byte(caller))...)
+	return append(b, xdrUint32s(svid, 0, 0, 0, 0)...)
+}
+
+func TestNLM(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+
+	// callbacks stands in for the lock manager of the client, accepting
+	// GRANTED calls.
+	callbacks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callbacks.Close()
+	granted := make(chan []byte, 1)
+	go func() {
+		c, err := callbacks.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var hdr [4]byte
+		if _, err := io.ReadFull(c, hdr[:]); err != nil {
+			return
+		}
+		call := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+		if _, err := io.ReadFull(c, call); err != nil {
+			return
+		}
+		reply := append(xdrUint32s(binary.BigEndian.Uint32(call), 1, 0, 0, 0, 0), xdrOpaque(nil)...)
+		writeFragments(t, c, append(reply, xdrUint32s(uint32(nfs.NLMStatusGranted))...), 1<<20)
+		granted <- call
+	}()
+	callbackPort := callbacks.Addr().(*net.TCPAddr).Port
+
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		CallbackPort: func(host string, prog, vers uint32) (int, error) {
+			return callbackPort, nil
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	xid := uint32(0)
+	call := func(prog, vers uint32, proc uint32, args []byte) []byte {
+		xid++
+		writeFragments(t, c, rpcCall(xid, prog, vers, proc, args), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("call %d.%d failed: %d", prog, proc, stat)
+		}
+		return body
+	}
+	mnt := call(100005, 3, uint32(nfs.MountProcMount), xdrOpaque([]byte("/")))
+	fhLen := binary.BigEndian.Uint32(mnt[4:])
+	fh := mnt[8 : 8+fhLen]
+	nlm := func(proc nfs.NLMProcedure, args []byte) []byte {
+		return call(100021, 4, uint32(proc), append(xdrOpaque([]byte("cookie")), args...))
+	}
+	status := func(res []byte) nfs.NLMStatus {
+		return nfs.NLMStatus(binary.BigEndian.Uint32(res[len(xdrOpaque([]byte("cookie"))):]))
+	}
+
+	lockA := nlmLockArg("a", fh, 1)
+	lockB := nlmLockArg("b", fh, 2)
+	if s := status(nlm(nfs.NLMProcLock, append(append(xdrUint32s(0, 1), lockA...), xdrUint32s(0, 0)...))); s != nfs.NLMStatusGranted {
+		t.Fatalf("lock by a: %d", s)
+	}
+	if s := status(nlm(nfs.NLMProcLock, append(append(xdrUint32s(1, 1), lockB...), xdrUint32s(0, 0)...))); s != nfs.NLMStatusBlocked {
+		t.Fatalf("blocking lock by b: %d", s)
+	}
+	res := nlm(nfs.NLMProcTest, append(xdrUint32s(0), lockB...))
+	if s := status(res); s != nfs.NLMStatusDenied {
+		t.Fatalf("test by b: %d", s)
+	}
+	holder := append(append(xdrUint32s(1, 1), xdrOpaque([]byte("a"))...), xdrUint32s(0, 0, 0, 0)...)
+	if !bytes.HasSuffix(res, holder) {
+		t.Fatalf("test by b reports holder %x", res)
+	}
+	if s := status(nlm(nfs.NLMProcUnlock, lockA)); s != nfs.NLMStatusGranted {
+		t.Fatalf("unlock by a: %d", s)
+	}
+	select {
+	case callback := <-granted:
+		want := append(append(xdrUint32s(100021, 4, uint32(nfs.NLMProcGranted)), make([]byte, 16)...), xdrOpaque([]byte("cookie"))...)
+		want = append(append(want, xdrUint32s(1)...), lockB...)
+		if !bytes.Equal(callback[12:], want) {
+			t.Fatalf("granted callback is %x", callback)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no granted callback")
+	}
+	if s := status(nlm(nfs.NLMProcTest, append(xdrUint32s(0), lockA...))); s != nfs.NLMStatusDenied {
+		t.Fatalf("test by a after grant to b: %d", s)
+	}
+
+	share := func(proc nfs.NLMProcedure, caller string, mode, access uint32) nfs.NLMStatus {
+		args := append(xdrOpaque([]byte(caller)), xdrOpaque(fh)...)
+		args = append(append(args, xdrOpaque([]byte(caller))...), xdrUint32s(mode, access, 0)...)
+		return status(nlm(proc, args))
+	}
+	if s := share(nfs.NLMProcShare, "a", nfs.ShareDenyWrite, nfs.ShareAccessRead); s != nfs.NLMStatusGranted {
+		t.Fatalf("share by a: %d", s)
+	}
+	if s := share(nfs.NLMProcShare, "b", nfs.ShareDenyNone, nfs.ShareAccessWrite); s != nfs.NLMStatusDenied {
+		t.Fatalf("conflicting share by b: %d", s)
+	}
+	if s := share(nfs.NLMProcUnshare, "a", 0, 0); s != nfs.NLMStatusGranted {
+		t.Fatalf("unshare by a: %d", s)
+	}
+	if s := share(nfs.NLMProcShare, "b", nfs.ShareDenyNone, nfs.ShareAccessWrite); s != nfs.NLMStatusGranted {
+		t.Fatalf("share by b after unshare: %d", s)
+	}
+}
+
+// blockingLockFS holds File.Lock on /blocked until release is closed.
+type blockingLockFS struct {
+	billy.Filesystem
+	locking chan struct{}
+	release chan struct{}
+}
+
+func (fs blockingLockFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil || strings.TrimPrefix(name, "/") != "blocked" {
+		return f, err
+	}
+	return blockingLockFile{f, fs.locking, fs.release}, nil
+}
+
+type blockingLockFile struct {
+	billy.File
+	locking chan struct{}
+	release chan struct{}
+}
+
+func (f blockingLockFile) Lock() error {
+	close(f.locking)
+	<-f.release
+	return nil
+}
+
+func TestFileLockManager(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/blocked", "/free"} {
+		f, _ := mem.Create(name)
+		f.Close()
+	}
+	fs := blockingLockFS{mem, make(chan struct{}), make(chan struct{})}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	m := nfs.NewFileLockManager(nfs.NewMemoryLockManager(), handler)
+	ctx := context.Background()
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := m.Lock(ctx, handler.ToHandle(fs, []string{"blocked"}), nfs.Lock{Caller: "a", Svid: 1, Exclusive: true})
+		blocked <- err
+	}()
+	<-fs.locking
+	// a file lock held by another process does not delay other files.
+	free := make(chan error, 1)
+	go func() {
+		_, err := m.Lock(ctx, handler.ToHandle(fs, []string{"free"}), nfs.Lock{Caller: "a", Svid: 1, Exclusive: true})
+		free <- err
+	}()
+	select {
+	case err := <-free:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock of a free file waited for another file")
+	}
+	close(fs.release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNLMExportFlavors(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, helpers.NewCachingHandler(unixOnlyHandler{helpers.NewNullAuthHandler(mem)}, 1024))
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeFragments(t, c, rpcUnixCall(1, 100005, 3, uint32(nfs.MountProcMount), 1001, 100, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	// an unmonitored, non-blocking exclusive lock of the root.
+	lock := append(append(xdrOpaque([]byte("c")), xdrUint32s(0, 1)...), nlmLockArg("a", fh, 1)...)
+	lock = append(lock, xdrUint32s(0, 0)...)
+
+	// the export only offers AUTH_UNIX, to lock requests as to others.
+	writeFragments(t, c, rpcCall(2, 100021, 4, uint32(nfs.NLMProcNMLock), lock), 1<<20)
+	if !readTooWeak(t, c) {
+		t.Fatal("lock request with AUTH_NULL was not refused")
+	}
+	writeFragments(t, c, rpcUnixCall(3, 100021, 4, uint32(nfs.NLMProcNMLock), 1001, 100, lock), 1<<20)
+	_, stat, res = readReplyBody(t, c)
+	if stat != 0 || !bytes.Equal(res, append(xdrOpaque([]byte("c")), xdrUint32s(uint32(nfs.NLMStatusGranted))...)) {
+		t.Fatalf("lock request with AUTH_UNIX: %d %x", stat, res)
+	}
+}
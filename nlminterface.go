@@ -0,0 +1,194 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+)
+
+// NLMProcedure is the valid RPC calls for the network lock manager, version 4.
+type NLMProcedure uint32
+
+// NLMProcedure Codes
+const (
+	NLMProcNull NLMProcedure = iota
+	NLMProcTest
+	NLMProcLock
+	NLMProcCancel
+	NLMProcUnlock
+	NLMProcGranted
+	NLMProcTestMsg
+	NLMProcLockMsg
+	NLMProcCancelMsg
+	NLMProcUnlockMsg
+	NLMProcGrantedMsg
+	NLMProcTestRes
+	NLMProcLockRes
+	NLMProcCancelRes
+	NLMProcUnlockRes
+	NLMProcGrantedRes
+)
+
+// NLMProcedure Codes following a gap in the numbering.
+const (
+	NLMProcShare NLMProcedure = iota + 20
+	NLMProcUnshare
+	NLMProcNMLock
+	NLMProcFreeAll
+)
+
+func (n NLMProcedure) String() string {
+	switch n {
+	case NLMProcNull:
+		return "Null"
+	case NLMProcTest:
+		return "Test"
+	case NLMProcLock:
+		return "Lock"
+	case NLMProcCancel:
+		return "Cancel"
+	case NLMProcUnlock:
+		return "Unlock"
+	case NLMProcGranted:
+		return "Granted"
+	case NLMProcTestMsg:
+		return "TestMsg"
+	case NLMProcLockMsg:
+		return "LockMsg"
+	case NLMProcCancelMsg:
+		return "CancelMsg"
+	case NLMProcUnlockMsg:
+		return "UnlockMsg"
+	case NLMProcGrantedMsg:
+		return "GrantedMsg"
+	case NLMProcTestRes:
+		return "TestRes"
+	case NLMProcLockRes:
+		return "LockRes"
+	case NLMProcCancelRes:
+		return "CancelRes"
+	case NLMProcUnlockRes:
+		return "UnlockRes"
+	case NLMProcGrantedRes:
+		return "GrantedRes"
+	case NLMProcShare:
+		return "Share"
+	case NLMProcUnshare:
+		return "Unshare"
+	case NLMProcNMLock:
+		return "NMLock"
+	case NLMProcFreeAll:
+		return "FreeAll"
+	default:
+		return "Unknown"
+	}
+}
+
+// NLMStatus is the result of a lock manager procedure (nlm4_stats).
+type NLMStatus uint32
+
+// NLMStatus Codes
+const (
+	NLMStatusGranted NLMStatus = iota
+	NLMStatusDenied
+	NLMStatusDeniedNoLocks
+	NLMStatusBlocked
+	NLMStatusDeniedGracePeriod
+	NLMStatusDeadlock
+	NLMStatusROFS
+	NLMStatusStaleFH
+	NLMStatusFBig
+	NLMStatusFailed
+)
+
+// Lock is a byte-range lock on a file, held by a process on a client host.
+type Lock struct {
+	// Caller is the name of the client host.
+	Caller string
+	// Owner identifies the process holding the lock, together with Svid,
+	// its process id on the client.
+	Owner []byte
+	Svid  int32
+	// Offset and Length are the byte range locked. A zero Length extends
+	// the lock to the end of the file, however large it grows.
+	Offset uint64
+	Length uint64
+	// Exclusive locks are write locks, and others read locks.
+	Exclusive bool
+}
+
+// SameOwner reports whether two locks are held by the same process.
+func (l *Lock) SameOwner(o *Lock) bool {
+	return l.Caller == o.Caller && l.Svid == o.Svid && bytes.Equal(l.Owner, o.Owner)
+}
+
+// end is the offset following the locked range.
+func (l *Lock) end() uint64 {
+	if l.Length == 0 || l.Offset+l.Length < l.Offset {
+		return ^uint64(0)
+	}
+	return l.Offset + l.Length
+}
+
+// Overlaps reports whether two locks cover some of the same bytes.
+func (l *Lock) Overlaps(o *Lock) bool {
+	return l.Offset < o.end() && o.Offset < l.end()
+}
+
+// Conflicts reports whether two locks may not both be held: they are held by
+// different processes, overlap, and one is exclusive.
+func (l *Lock) Conflicts(o *Lock) bool {
+	return !l.SameOwner(o) && (l.Exclusive || o.Exclusive) && l.Overlaps(o)
+}
+
+// Share modes and access of a share reservation (fsh4_mode and fsh4_access).
+const (
+	ShareDenyNone      uint32 = 0
+	ShareDenyRead      uint32 = 1
+	ShareDenyWrite     uint32 = 2
+	ShareDenyReadWrite uint32 = 3
+
+	ShareAccessNone      uint32 = 0
+	ShareAccessRead      uint32 = 1
+	ShareAccessWrite     uint32 = 2
+	ShareAccessReadWrite uint32 = 3
+)
+
+// Share is a DOS-style share reservation on a file: the access its holder
+// has to the file, and the access it denies to others.
+type Share struct {
+	Caller string
+	Owner  []byte
+	Mode   uint32
+	Access uint32
+}
+
+// Conflicts reports whether two reservations may not both be held.
+func (s *Share) Conflicts(o *Share) bool {
+	if s.Caller == o.Caller && bytes.Equal(s.Owner, o.Owner) {
+		return false
+	}
+	return s.Mode&o.Access != 0 || o.Mode&s.Access != 0
+}
+
+// LockManager keeps the byte-range locks and share reservations that
+// clients take through the network lock manager. Files are identified by
+// their NFS file handle.
+type LockManager interface {
+	// Test returns a lock held by another process that conflicts with l on
+	// the file, or nil if l could be granted.
+	Test(ctx context.Context, fh []byte, l Lock) (*Lock, error)
+	// Lock grants l, unless it conflicts with a lock held by another
+	// process, which is returned instead. The locks a process already holds
+	// over the range are replaced, as POSIX locks are.
+	Lock(ctx context.Context, fh []byte, l Lock) (*Lock, error)
+	// Unlock releases the range of l from the locks of its process.
+	Unlock(ctx context.Context, fh []byte, l Lock) error
+	// Share takes a share reservation, reporting false if it conflicts with
+	// that of another holder.
+	Share(ctx context.Context, fh []byte, s Share) (bool, error)
+	// Unshare releases a share reservation.
+	Unshare(ctx context.Context, fh []byte, s Share) error
+	// ReleaseAll releases every lock and reservation held by processes on
+	// the client host caller, as when it has rebooted.
+	ReleaseAll(ctx context.Context, caller string) error
+}
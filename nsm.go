@@ -0,0 +1,384 @@
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	nsmServiceID = 100024
+	nsmVersion   = 1
+)
+
+const (
+	nsmStatSucc uint32 = 0
+	nsmStatFail uint32 = 1
+)
+
+// notifyAttempts bounds how many times each host is sent SM_NOTIFY after a
+// restart, the delay between attempts doubling from notifyRetryDelay.
+const (
+	notifyAttempts   = 5
+	notifyRetryDelay = time.Second
+)
+
+// DefaultLockGracePeriod is how long after a restart only reclaimed locks are
+// granted when Server.LockGracePeriod is not set.
+const DefaultLockGracePeriod = 90 * time.Second
+
+func init() {
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcNull), onNSMNull)
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcStat), onNSMStat)
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcMon), onNSMMon)
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcUnmon), onNSMUnmon)
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcUnmonAll), onNSMUnmonAll)
+	_ = RegisterVersionedMessageHandler(nsmServiceID, nsmVersion, uint32(NSMProcNotify), onNSMNotify)
+}
+
+// nsmMyID is the my_id of the protocol: the procedure a local lock manager
+// wants called when a monitored host restarts.
+type nsmMyID struct {
+	MyName string
+	MyProg uint32
+	MyVers uint32
+	MyProc uint32
+}
+
+type nsmMonID struct {
+	MonName string
+	MyID    nsmMyID
+}
+
+type nsmMon struct {
+	MonID nsmMonID
+	Priv  [16]byte
+}
+
+type nsmStatRes struct {
+	ResStat uint32
+	State   int32
+}
+
+// nsmStatChange is the stat_chge a restarted host sends with SM_NOTIFY.
+type nsmStatChange struct {
+	MonName string
+	State   int32
+}
+
+// nsmStatus is the argument of the procedure of a monitor that is called
+// when its host restarts.
+type nsmStatus struct {
+	MonName string
+	State   int32
+	Priv    [16]byte
+}
+
+// hostMonitor is a request to be told that a host has restarted, made either
+// through SM_MON by a lock manager, or by the server itself.
+type hostMonitor struct {
+	name string
+	// addr is the address the host was seen at, if known.
+	addr string
+	id   nsmMyID
+	priv [16]byte
+	// onReboot is called for monitors of the server itself.
+	onReboot func(name string, state int32)
+}
+
+// statusMonitor is the network status monitor of a Server: the state number
+// of the server, odd while it is up and incremented by each restart, and the
+// hosts being monitored. Both are optionally kept in a directory.
+type statusMonitor struct {
+	mu       sync.Mutex
+	state    int32
+	monitors []*hostMonitor
+	dir      string
+}
+
+// load reads the state number and monitor list left by the last run in dir,
+// advances the state number, and returns the hosts that were monitored,
+// which are to be told of the restart. The monitor list is then cleared.
+func (m *statusMonitor) load(dir string) ([]*hostMonitor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dir = dir
+	m.state = 1
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "state"))
+	if err == nil {
+		prev, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state file: %w", err)
+		}
+		m.state = int32(prev) + 1
+		if m.state%2 == 0 {
+			m.state++
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := replaceFile(filepath.Join(dir, "state"), []byte(strconv.Itoa(int(m.state))+"\n")); err != nil {
+		return nil, err
+	}
+
+	var hosts []*hostMonitor
+	data, err = os.ReadFile(filepath.Join(dir, "sm"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var h hostMonitor
+		var priv []byte
+		if _, err := fmt.Sscanf(scanner.Text(), "%q %q %q %d %d %d %x", &h.name, &h.addr, &h.id.MyName, &h.id.MyProg, &h.id.MyVers, &h.id.MyProc, &priv); err != nil {
+			Log.Warnf("ignoring invalid monitor in %s: %q", dir, scanner.Text())
+			continue
+		}
+		copy(h.priv[:], priv)
+		hosts = append(hosts, &h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	m.save()
+	return hosts, nil
+}
+
+// save replaces the monitor list in the directory, if there is one.
+func (m *statusMonitor) save() {
+	if m.dir == "" {
+		return
+	}
+	buf := bytes.Buffer{}
+	for _, h := range m.monitors {
+		fmt.Fprintf(&buf, "%q %q %q %d %d %d %x\n", h.name, h.addr, h.id.MyName, h.id.MyProg, h.id.MyVers, h.id.MyProc, h.priv[:])
+	}
+	if err := replaceFile(filepath.Join(m.dir, "sm"), buf.Bytes()); err != nil {
+		Log.Warnf("unable to save monitor list to %s: %v", m.dir, err)
+	}
+}
+
+func (m *statusMonitor) currentState() int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// add records a monitor, replacing one of the same host and lock manager.
+func (m *statusMonitor) add(h *hostMonitor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, other := range m.monitors {
+		if h.onReboot == nil && other.onReboot == nil && strings.EqualFold(other.name, h.name) && other.id == h.id {
+			m.monitors[i] = h
+			m.save()
+			return
+		}
+	}
+	m.monitors = append(m.monitors, h)
+	m.save()
+}
+
+// remove drops the monitors for which match reports true.
+func (m *statusMonitor) remove(match func(*hostMonitor) bool) []*hostMonitor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed []*hostMonitor
+	kept := m.monitors[:0]
+	for _, h := range m.monitors {
+		if match(h) {
+			removed = append(removed, h)
+		} else {
+			kept = append(kept, h)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	m.monitors = kept
+	m.save()
+	return removed
+}
+
+// MonitorHost registers onReboot to be called when the client host name
+// reports that it has restarted, from addr if that is not empty, as lock
+// managers do to release the locks the host held. The host is also told
+// when this server restarts, if the server keeps its state in StatdPath.
+// The returned function cancels the registration, which otherwise ends once
+// onReboot has been called.
+func (s *Server) MonitorHost(name, addr string, onReboot func(name string, state int32)) (func(), error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	h := &hostMonitor{name: name, addr: addr, onReboot: onReboot}
+	s.statd.add(h)
+	return func() {
+		s.statd.remove(func(other *hostMonitor) bool { return other == h })
+	}, nil
+}
+
+// notifyRestart tells the hosts monitored before the server restarted that
+// it has, with SM_NOTIFY, so that they reclaim their locks.
+func (s *Server) notifyRestart(hosts []*hostMonitor) {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "localhost"
+	}
+	state := s.statd.currentState()
+	notified := make(map[string]bool)
+	for _, h := range hosts {
+		host := h.addr
+		if host == "" {
+			host = h.name
+		}
+		if notified[host] {
+			continue
+		}
+		notified[host] = true
+		go func() {
+			delay := notifyRetryDelay
+			for attempt := 1; ; attempt++ {
+				_, err := s.callClient(context.Background(), "udp", host, nsmServiceID, nsmVersion, uint32(NSMProcNotify), &nsmStatChange{name, state})
+				if err == nil {
+					return
+				}
+				if attempt == notifyAttempts || s.inShutdown.Load() {
+					Log.Warnf("unable to notify %s of restart: %v", host, err)
+					return
+				}
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}()
+	}
+}
+
+// localCaller reports whether a call comes from the host the server runs on,
+// from which alone lock managers may ask for hosts to be monitored.
+func localCaller(w *Response) bool {
+	ip := net.ParseIP(remoteIP(w.conn.Conn))
+	return ip == nil || ip.IsLoopback()
+}
+
+func onNSMNull(ctx context.Context, w *Response, userHandle Handler) error {
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// onNSMStat reports the state number of the server.
+func onNSMStat(ctx context.Context, w *Response, userHandle Handler) error {
+	var name string
+	if err := xdr.Read(w.req.Body, &name); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	return w.WriteXDR(&nsmStatRes{nsmStatSucc, w.conn.Server.statd.currentState()})
+}
+
+func onNSMMon(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nsmMon
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	statd := &w.conn.Server.statd
+	res := &nsmStatRes{nsmStatSucc, statd.currentState()}
+	name := args.MonID.MonName
+	if !localCaller(w) || name == "" || len(name) > NSMMaxNameLen || len(args.MonID.MyID.MyName) > NSMMaxNameLen {
+		Log.Debugf("%v: refusing to monitor %q for %s", w.req, name, remoteIP(w.conn.Conn))
+		res.ResStat = nsmStatFail
+		return w.WriteXDR(res)
+	}
+	statd.add(&hostMonitor{name: name, id: args.MonID.MyID, priv: args.Priv})
+	return w.WriteXDR(res)
+}
+
+func onNSMUnmon(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nsmMonID
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	statd := &w.conn.Server.statd
+	if localCaller(w) {
+		statd.remove(func(h *hostMonitor) bool {
+			return h.onReboot == nil && strings.EqualFold(h.name, args.MonName) && h.id == args.MyID
+		})
+	}
+	return w.WriteXDR(statd.currentState())
+}
+
+func onNSMUnmonAll(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nsmMyID
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	statd := &w.conn.Server.statd
+	if localCaller(w) {
+		statd.remove(func(h *hostMonitor) bool {
+			return h.onReboot == nil && h.id == args
+		})
+	}
+	return w.WriteXDR(statd.currentState())
+}
+
+// onNSMNotify handles a host reporting that it has restarted, telling those
+// monitoring it. Monitors are matched by the name the host gives, or by the
+// address it calls from. The server's own monitors of a host seen at an
+// address only accept notifications from that address, as anyone may give
+// the host's name.
+func onNSMNotify(ctx context.Context, w *Response, userHandle Handler) error {
+	var args nsmStatChange
+	if err := xdr.Read(w.req.Body, &args); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	s := w.conn.Server
+	from := remoteIP(w.conn.Conn)
+	matches := func(h *hostMonitor) bool {
+		return strings.EqualFold(h.name, args.MonName) || (h.addr != "" && h.addr == from)
+	}
+	// the server's own monitors end with the notification, while lock
+	// managers unmonitor hosts themselves.
+	ownMatches := func(h *hostMonitor) bool {
+		if h.addr != "" {
+			return h.addr == from
+		}
+		return matches(h)
+	}
+	for _, h := range s.statd.remove(func(h *hostMonitor) bool { return h.onReboot != nil && ownMatches(h) }) {
+		go h.onReboot(h.name, args.State)
+	}
+	s.statd.mu.Lock()
+	var callbacks []*hostMonitor
+	for _, h := range s.statd.monitors {
+		if matches(h) {
+			callbacks = append(callbacks, h)
+		}
+	}
+	s.statd.mu.Unlock()
+	for _, h := range callbacks {
+		go func(h *hostMonitor) {
+			status := &nsmStatus{MonName: h.name, State: args.State, Priv: h.priv}
+			if _, err := s.callClient(context.Background(), "udp", h.id.MyName, h.id.MyProg, h.id.MyVers, h.id.MyProc, status); err != nil {
+				Log.Warnf("unable to tell %s that %s restarted: %v", h.id.MyName, h.name, err)
+			}
+		}(h)
+	}
+	return w.writeHeader(ResponseCodeSuccess)
+}
@@ -0,0 +1,156 @@
+package nfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func TestNSM(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	r, _ := mem.Create("/test")
+	r.Close()
+
+	// The server was last monitoring a client at 127.0.0.1, which it should
+	// tell of its restart.
+	statd := t.TempDir()
+	if err := os.WriteFile(filepath.Join(statd, "state"), []byte("3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(statd, "sm"), []byte(`"client" "127.0.0.1" "" 0 0 0 00000000000000000000000000000000`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	notified := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = client.WriteTo(xdrUint32s(binary.BigEndian.Uint32(buf), 1, 0, 0, 0, 0), addr)
+		notified <- buf[:n]
+	}()
+	clientPort := client.LocalAddr().(*net.UDPAddr).Port
+
+	srv := &nfs.Server{
+		Handler:   helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		StatdPath: statd,
+		CallbackPort: func(host string, prog, vers uint32) (int, error) {
+			return clientPort, nil
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+
+	select {
+	case call := <-notified:
+		hostname, _ := os.Hostname()
+		want := append(append(xdrUint32s(100024, 1, uint32(nfs.NSMProcNotify)), make([]byte, 16)...), xdrOpaque([]byte(hostname))...)
+		if !bytes.Equal(call[12:], append(want, xdrUint32s(5)...)) {
+			t.Fatalf("notify is %x", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notify after restart")
+	}
+	if data, _ := os.ReadFile(filepath.Join(statd, "state")); string(data) != "5\n" {
+		t.Fatalf("state file is %q", data)
+	}
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	xid := uint32(0)
+	call := func(prog, vers uint32, proc uint32, args []byte) []byte {
+		xid++
+		writeFragments(t, c, rpcCall(xid, prog, vers, proc, args), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("call %d.%d failed: %d", prog, proc, stat)
+		}
+		return body
+	}
+	mnt := call(100005, 3, uint32(nfs.MountProcMount), xdrOpaque([]byte("/")))
+	fh := mnt[8 : 8+binary.BigEndian.Uint32(mnt[4:])]
+	lock := func(caller string, svid uint32, reclaim uint32) nfs.NLMStatus {
+		args := append(append(xdrOpaque([]byte("cookie")), xdrUint32s(0, 1)...), nlmLockArg(caller, fh, svid)...)
+		res := call(100021, 4, uint32(nfs.NLMProcLock), append(args, xdrUint32s(reclaim, 0)...))
+		return nfs.NLMStatus(binary.BigEndian.Uint32(res[len(xdrOpaque([]byte("cookie"))):]))
+	}
+
+	if s := lock("client", 1, 0); s != nfs.NLMStatusDeniedGracePeriod {
+		t.Fatalf("new lock in grace period: %d", s)
+	}
+	if s := lock("client", 1, 1); s != nfs.NLMStatusGranted {
+		t.Fatalf("reclaimed lock in grace period: %d", s)
+	}
+	if data, _ := os.ReadFile(filepath.Join(statd, "sm")); !strings.HasPrefix(string(data), `"client" "127.0.0.1"`) {
+		t.Fatalf("lock holder is not monitored: %q", data)
+	}
+	if s := lock("other", 2, 1); s != nfs.NLMStatusDenied {
+		t.Fatalf("conflicting lock: %d", s)
+	}
+
+	// a notification naming the client from another address is ignored.
+	spoofer, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+	writeFragments(t, spoofer, rpcCall(100, 100024, 1, uint32(nfs.NSMProcNotify), append(xdrOpaque([]byte("client")), xdrUint32s(7)...)), 1<<20)
+	if _, stat, _ := readReplyBody(t, spoofer); stat != 0 {
+		t.Fatalf("notify failed: %d", stat)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := lock("other", 2, 1); s != nfs.NLMStatusDenied {
+		t.Fatalf("conflicting lock after notify from another address: %d", s)
+	}
+
+	// the client restarting releases its locks.
+	call(100024, 1, uint32(nfs.NSMProcNotify), append(xdrOpaque([]byte("client")), xdrUint32s(7)...))
+	deadline := time.Now().Add(5 * time.Second)
+	for lock("other", 2, 1) != nfs.NLMStatusGranted {
+		if time.Now().After(deadline) {
+			t.Fatal("locks of restarted client were not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res := call(100024, 1, uint32(nfs.NSMProcStat), xdrOpaque([]byte("client"))); !bytes.Equal(res, xdrUint32s(0, 5)) {
+		t.Fatalf("stat is %x", res)
+	}
+	myID := append(xdrOpaque([]byte("localhost")), xdrUint32s(100021, 4, 16)...)
+	mon := append(append(xdrOpaque([]byte("peer")), myID...), make([]byte, 16)...)
+	if res := call(100024, 1, uint32(nfs.NSMProcMon), mon); !bytes.Equal(res, xdrUint32s(0, 5)) {
+		t.Fatalf("mon is %x", res)
+	}
+	if data, _ := os.ReadFile(filepath.Join(statd, "sm")); !strings.Contains(string(data), `"peer" "" "localhost" 100021 4 16`) {
+		t.Fatalf("monitor list is %q", data)
+	}
+	call(100024, 1, uint32(nfs.NSMProcUnmonAll), myID)
+	if data, _ := os.ReadFile(filepath.Join(statd, "sm")); strings.Contains(string(data), "peer") {
+		t.Fatalf("monitor list after unmon_all is %q", data)
+	}
+}
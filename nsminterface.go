@@ -0,0 +1,39 @@
+package nfs
+
+// NSMProcedure is the valid RPC calls for the network status monitor.
+type NSMProcedure uint32
+
+// NSMProcedure Codes
+const (
+	NSMProcNull NSMProcedure = iota
+	NSMProcStat
+	NSMProcMon
+	NSMProcUnmon
+	NSMProcUnmonAll
+	NSMProcSimuCrash
+	NSMProcNotify
+)
+
+func (n NSMProcedure) String() string {
+	switch n {
+	case NSMProcNull:
+		return "Null"
+	case NSMProcStat:
+		return "Stat"
+	case NSMProcMon:
+		return "Mon"
+	case NSMProcUnmon:
+		return "Unmon"
+	case NSMProcUnmonAll:
+		return "UnmonAll"
+	case NSMProcSimuCrash:
+		return "SimuCrash"
+	case NSMProcNotify:
+		return "Notify"
+	default:
+		return "Unknown"
+	}
+}
+
+// NSMMaxNameLen is the maximum size of a host name given to the monitor.
+const NSMMaxNameLen = 1024
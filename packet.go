@@ -0,0 +1,160 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload carried by an IPv4 datagram.
+	maxDatagramSize = 65507
+	// datagramTransferSize is the largest READ or WRITE payload advertised
+	// to and served for clients using a datagram transport.
+	datagramTransferSize = 32 * 1024
+)
+
+// ServePacket answers RPC calls arriving as datagrams on the provided
+// connection, as used by NFS over UDP. Each datagram carries one call without
+// record marking, and each reply is sent back as a single datagram. Requests
+// for a file handle are ordered as on a stream connection, across all peers.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	s.trackAddr(pc.LocalAddr(), false)
+	return s.servePacket(pc, false)
+}
+
+// servePacket answers datagrams on pc, for only the portmapper program if
+// portmapper is set, and for every other program otherwise.
+func (s *Server) servePacket(pc net.PacketConn, portmapper bool) error {
+	defer pc.Close()
+	baseCtx := context.Background()
+	if s.Context != nil {
+		baseCtx = s.Context
+	}
+	if err := s.init(); err != nil {
+		return err
+	}
+	if !s.trackPacketConn(pc, true) {
+		return ErrServerClosed
+	}
+	defer s.trackPacketConn(pc, false)
+
+	// requests on the socket share the limits and the ordering of requests
+	// of a single connection.
+	slots := make(chan struct{}, s.maxConnRequests())
+	order := newHandleOrder()
+	var inFlight sync.WaitGroup
+	var tempDelay time.Duration
+
+	for {
+		buf := make([]byte, maxDatagramSize+1)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				// replies to requests already read are still sent.
+				inFlight.Wait()
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if n > maxDatagramSize {
+			Log.Warnf("dropping oversized datagram from %v", addr)
+			continue
+		}
+
+		c := s.newPacketConn(pc, addr, portmapper)
+		c.order = order
+		w, err := c.parseRequest(buf[:n], false)
+		if err != nil {
+			Log.Debugf("dropping malformed datagram from %v: %v", addr, err)
+			continue
+		}
+		Log.Tracef("request: %v", w.req)
+
+		slots <- struct{}{}
+		if err := s.acquireWorker(baseCtx); err != nil {
+			return err
+		}
+		prev, done := c.sequence(w.req)
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			defer s.releaseWorker()
+			defer done()
+			for _, p := range prev {
+				<-p
+			}
+			if err := c.handle(baseCtx, w); err != nil {
+				Log.Errorf("error handling req: %v", err)
+				return
+			}
+			if err := w.finish(baseCtx); err != nil {
+				Log.Errorf("error sending response: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) newPacketConn(pc net.PacketConn, addr net.Addr, portmapper bool) *conn {
+	return &conn{
+		Server:     s,
+		Conn:       &packetConn{PacketConn: pc, remote: addr},
+		datagram:   true,
+		portmapper: portmapper,
+	}
+}
+
+// packetConn presents one peer of a packet listener as a net.Conn, so that
+// handlers see clients the same way regardless of transport.
+type packetConn struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+func (p *packetConn) Read(b []byte) (int, error) {
+	return 0, errors.New("read on a datagram peer")
+}
+
+func (p *packetConn) Write(b []byte) (int, error) {
+	return p.WriteTo(b, p.remote)
+}
+
+func (p *packetConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// Close is a no-op, as the underlying socket is shared by all peers.
+func (p *packetConn) Close() error {
+	return nil
+}
+
+// sendDatagram transmits the reply as a single datagram. A reply too large to
+// be sent is replaced by SYSTEM_ERR so the client is not left waiting.
+func (w *Response) sendDatagram(ctx context.Context) error {
+	if w.writer.Len() > maxDatagramSize {
+		Log.Errorf("%v: reply of %d bytes exceeds the datagram limit", w.req, w.writer.Len())
+		w.writer.Reset()
+		w.responded = false
+		if err := w.writeHeader(ResponseCodeSystemErr); err != nil {
+			return err
+		}
+	}
+	_, err := w.conn.Conn.Write(w.writer.Bytes())
+	return err
+}
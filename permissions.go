@@ -0,0 +1,194 @@
+package nfs
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Bits of the ACCESS3 mask (rfc1813 section 3.3.4).
+const (
+	accessRead    uint32 = 0x0001
+	accessLookup  uint32 = 0x0002
+	accessModify  uint32 = 0x0004
+	accessExtend  uint32 = 0x0008
+	accessDelete  uint32 = 0x0010
+	accessExecute uint32 = 0x0020
+)
+
+// Permission bits requested of a mode, as for access(2).
+const (
+	permRead  uint32 = 4
+	permWrite uint32 = 2
+	permExec  uint32 = 1
+)
+
+// nobody is the identity of callers without AUTH_UNIX credentials when
+// permissions are checked.
+const nobody = 65534
+
+// caller is an identity permissions are evaluated for.
+type caller struct {
+	*Credentials
+}
+
+// callerOf returns the identity of the caller of a request.
+func callerOf(w *Response) caller {
+	if w.req.creds.HasIdentity() {
+		return caller{w.req.creds}
+	}
+	return caller{&Credentials{Flavor: AuthFlavorUnix, UID: nobody, GID: nobody}}
+}
+
+func (c caller) root() bool {
+	return c.UID == 0
+}
+
+func (c caller) owns(attr *FileAttribute) bool {
+	return c.root() || c.UID == attr.UID
+}
+
+// may reports whether the caller is granted every bit of perm by the mode of
+// attr. As with a local superuser, root is refused only execution of files no
+// one may execute.
+func (c caller) may(attr *FileAttribute, perm uint32) bool {
+	mode := uint32(attr.Mode().Perm())
+	if c.root() {
+		if perm&permExec != 0 && attr.Type != FileTypeDirectory && mode&0o111 == 0 {
+			return false
+		}
+		return true
+	}
+	var granted uint32
+	switch {
+	case c.UID == attr.UID:
+		granted = mode >> 6
+	case c.InGroup(attr.GID):
+		granted = mode >> 3
+	default:
+		granted = mode
+	}
+	return granted&perm == perm
+}
+
+// checkingPermissions reports whether the server evaluates the caller's
+// permissions itself.
+func (w *Response) checkingPermissions() bool {
+	return w.conn != nil && w.conn.Server.CheckPermissions
+}
+
+// checkPermission fails with NFS3ERR_ACCES unless the caller is granted perm
+// on the object at path. Objects that cannot be examined are left for the
+// procedure to report.
+func (w *Response) checkPermission(fs billy.Filesystem, path []string, perm uint32) error {
+	if !w.checkingPermissions() {
+		return nil
+	}
+	attr := tryStat(fs, path)
+	if attr == nil {
+		return nil
+	}
+	if !callerOf(w).may(attr, perm) {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	return nil
+}
+
+// checkOwnerOrPermission is checkPermission, except that the owner of the
+// object is always permitted. Like other NFS servers, this allows READ and
+// WRITE on files the owner opened before removing their own access.
+func (w *Response) checkOwnerOrPermission(fs billy.Filesystem, path []string, perm uint32) error {
+	if !w.checkingPermissions() {
+		return nil
+	}
+	attr := tryStat(fs, path)
+	if attr == nil {
+		return nil
+	}
+	if c := callerOf(w); !c.owns(attr) && !c.may(attr, perm) {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	return nil
+}
+
+// checkUnlink checks that the caller may remove or rename away name in the
+// directory at dir: it needs write and search permission on the directory,
+// and if the directory is sticky, must own either it or the entry.
+func (w *Response) checkUnlink(fs billy.Filesystem, dir []string, name string) error {
+	if err := w.checkPermission(fs, dir, permWrite|permExec); err != nil || !w.checkingPermissions() {
+		return err
+	}
+	dirAttr := tryStat(fs, dir)
+	if dirAttr == nil || dirAttr.Mode()&os.ModeSticky == 0 {
+		return nil
+	}
+	c := callerOf(w)
+	if c.owns(dirAttr) {
+		return nil
+	}
+	info, err := fs.Lstat(fs.Join(append(dir, name)...))
+	if err != nil {
+		return nil
+	}
+	if !c.owns(ToFileAttribute(info, "")) {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	return nil
+}
+
+// checkSetAttr checks that the caller may make the changes in attrs to the
+// object described by curr. Only root may change the owner. The owner may
+// change the mode, and the group to one they belong to. The size and times
+// may be changed by the owner or with write permission.
+func (w *Response) checkSetAttr(curr *FileAttribute, attrs *SetFileAttributes) error {
+	if !w.checkingPermissions() {
+		return nil
+	}
+	c := callerOf(w)
+	if c.root() {
+		return nil
+	}
+	if attrs.SetMode != nil && attrs.Mode(0) != curr.Mode().Perm() && !c.owns(curr) {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	if attrs.SetUID != nil && *attrs.SetUID != curr.UID {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	if attrs.SetGID != nil && *attrs.SetGID != curr.GID && (!c.owns(curr) || !c.InGroup(*attrs.SetGID)) {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	if (attrs.SetAtime != nil || attrs.SetMtime != nil) && !c.owns(curr) && !c.may(curr, permWrite) {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	if attrs.SetSize != nil && !c.owns(curr) && !c.may(curr, permWrite) {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	return nil
+}
+
+// accessMask narrows the ACCESS3 bits requested to those the caller holds on
+// the object described by attr.
+func (w *Response) accessMask(attr *FileAttribute, mask uint32) uint32 {
+	if !w.checkingPermissions() || attr == nil {
+		return mask
+	}
+	c := callerOf(w)
+	granted := uint32(0)
+	if c.may(attr, permRead) {
+		granted |= accessRead
+	}
+	if c.may(attr, permWrite) {
+		granted |= accessModify | accessExtend
+		if attr.Type == FileTypeDirectory && c.may(attr, permExec) {
+			granted |= accessDelete
+		}
+	}
+	if c.may(attr, permExec) {
+		if attr.Type == FileTypeDirectory {
+			granted |= accessLookup
+		} else {
+			granted |= accessExecute
+		}
+	}
+	return mask & granted
+}
@@ -0,0 +1,352 @@
+package nfs_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/file"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not available")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "private"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "shared"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "shared"), 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shared", "owned"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shared", "kept"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &nfs.Server{
+		Handler:          helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024),
+		CheckPermissions: true,
+	}
+	// a caller who neither owns the files nor shares their group.
+	other := uint32(os.Getuid() + 1000)
+	target := mountAs(t, srv, other, other)
+
+	isAcces := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "NFS3ERR_ACCES")
+	}
+
+	if mask, err := target.Access("/", 0x3f); err != nil || mask != 0x3 {
+		t.Fatalf("access to root: %x %v", mask, err)
+	}
+	if mask, err := target.Access("/private", 0x3f); err != nil || mask != 0 {
+		t.Fatalf("access to private file: %x %v", mask, err)
+	}
+	if _, err := target.Create("/new", 0644); !isAcces(err) {
+		t.Fatalf("create in unwritable directory: %v", err)
+	}
+	f, err := target.Open("/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 8)); !isAcces(err) {
+		t.Fatalf("read of private file: %v", err)
+	}
+	if err := target.Setattr("/private", nfsc.Sattr3{Mode: nfsc.SetMode{SetIt: true, Mode: 0777}}); !errors.Is(err, os.ErrPermission) || isAcces(err) {
+		t.Fatalf("chmod of another's file: %v", err)
+	}
+	if err := target.Remove("/shared/owned"); !errors.Is(err, os.ErrPermission) || isAcces(err) {
+		t.Fatalf("remove of another's file from sticky directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared", "owned")); err != nil {
+		t.Fatal(err)
+	}
+	// creating an existing file truncates it.
+	if _, err := target.Create("/shared/kept", 0644); !isAcces(err) {
+		t.Fatalf("create over another's file: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "shared", "kept")); err != nil || string(data) != "secret" {
+		t.Fatalf("file created over holds %q: %v", data, err)
+	}
+}
+
+// mountAs serves srv and mounts its root with AUTH_UNIX credentials.
+func mountAs(t *testing.T, srv *nfs.Server, uid, gid uint32) *nfsc.Target {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+
+	c, err := rpc.DialTCP(listener.Addr().Network(), listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.NewAuthUnix("client", uid, gid).Auth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// offsetMapper maps client ids to server ids a fixed distance below them.
+type offsetMapper uint32
+
+func (o offsetMapper) ServerUID(uid uint32) uint32 { return uid - uint32(o) }
+func (o offsetMapper) ServerGID(gid uint32) uint32 { return gid - uint32(o) }
+func (o offsetMapper) ClientUID(uid uint32) uint32 { return uid + uint32(o) }
+func (o offsetMapper) ClientGID(gid uint32) uint32 { return gid + uint32(o) }
+
+func TestIdentityHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "private"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	handler := func(opts helpers.IdentityOptions) nfs.Handler {
+		return helpers.NewCachingHandler(helpers.NewIdentityHandler(helpers.NewNullAuthHandler(osfs.New(dir)), opts), 1024)
+	}
+	read := func(target *nfsc.Target) error {
+		f, err := target.Open("/private")
+		if err != nil {
+			return err
+		}
+		_, err = f.Read(make([]byte, 4))
+		return err
+	}
+
+	// the owner of the files, known to the client by another uid.
+	mapped := &nfs.Server{Handler: handler(helpers.IdentityOptions{Mapper: offsetMapper(5000)}), CheckPermissions: true}
+	target := mountAs(t, mapped, uid+5000, gid+5000)
+	attr, err := target.Getattr("/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.UID != uid+5000 || attr.GID != gid+5000 {
+		t.Fatalf("owner reported as %d:%d", attr.UID, attr.GID)
+	}
+	if err := read(target); err != nil {
+		t.Fatalf("read by mapped owner: %v", err)
+	}
+
+	// root, squashed to the default anonymous user.
+	squashed := &nfs.Server{Handler: handler(helpers.IdentityOptions{RootSquash: true}), CheckPermissions: true}
+	if err := read(mountAs(t, squashed, 0, 0)); err == nil || !strings.Contains(err.Error(), "NFS3ERR_ACCES") {
+		t.Fatalf("read by squashed root: %v", err)
+	}
+	unsquashed := &nfs.Server{Handler: handler(helpers.IdentityOptions{}), CheckPermissions: true}
+	if err := read(mountAs(t, unsquashed, 0, 0)); err != nil {
+		t.Fatalf("read by root: %v", err)
+	}
+}
+
+func TestExportsHandlerSquash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "private"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// root is squashed to the default anonymous user without ParseExports.
+	exports, err := helpers.NewExportsHandler([]helpers.ExportConfig{{
+		Dirpath:    "/",
+		Filesystem: osfs.New(dir),
+		Clients:    []helpers.ExportClient{{Host: "*", ExportOptions: helpers.ExportOptions{RootSquash: true}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &nfs.Server{Handler: helpers.NewCachingHandler(exports, 1024), CheckPermissions: true}
+	f, err := mountAs(t, srv, 0, 0).Open("/private")
+	if err == nil {
+		_, err = f.Read(make([]byte, 4))
+	}
+	if err == nil || !strings.Contains(err.Error(), "NFS3ERR_ACCES") {
+		t.Fatalf("read by squashed root: %v", err)
+	}
+}
+
+// changeOS adds billy.Change to an osfs filesystem rooted at root.
+type changeOS struct {
+	billy.Filesystem
+	root string
+}
+
+func (c changeOS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(c.root, name), mode)
+}
+
+func (c changeOS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c changeOS) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c changeOS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(c.root, name), atime, mtime)
+}
+
+func TestCreationPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	dir := t.TempDir()
+	group := filepath.Join(dir, "group")
+	if err := os.Mkdir(group, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(group, 0, 4242); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(group, 0777|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(changeOS{osfs.New(dir), dir}), 1024),
+		CreationPolicy: func(dirpath string) *nfs.CreationPolicy {
+			return &nfs.CreationPolicy{Umask: 0022, SetOwner: true}
+		},
+	}
+	target := mountAs(t, srv, 1234, 5678)
+
+	owner := func(path string) (uint32, uint32, os.FileMode) {
+		info, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := file.GetInfo(info)
+		return a.UID, a.GID, info.Mode()
+	}
+
+	if _, err := target.Create("/file", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, mode := owner("file"); uid != 1234 || gid != 5678 || mode != 0644 {
+		t.Fatalf("new file is %d:%d %v", uid, gid, mode)
+	}
+	if _, err := target.Mkdir("/group/sub", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, mode := owner("group/sub"); uid != 1234 || gid != 4242 || mode != os.ModeDir|os.ModeSetgid|0755 {
+		t.Fatalf("new directory in setgid directory is %d:%d %v", uid, gid, mode)
+	}
+
+	// the policy does not apply to a file that already exists.
+	if err := os.WriteFile(filepath.Join(dir, "existing"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Create("/existing", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, mode := owner("existing"); uid != 0 || gid != 0 || mode != 0600 {
+		t.Fatalf("existing file is %d:%d %v", uid, gid, mode)
+	}
+
+	// a caller other than root cannot choose the owner of a new file.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writeFragments(t, c, rpcUnixCall(1, 100005, 3, 1, 1234, 5678, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	// UNCHECKED, with a sattr3 setting only the uid, to 0.
+	create := append(append(xdrOpaque(fh), xdrOpaque([]byte("chosen"))...), xdrUint32s(0, 0, 1, 0, 0, 0, 0, 0)...)
+	writeFragments(t, c, rpcUnixCall(2, 100003, 3, uint32(nfs.NFSProcedureCreate), 1234, 5678, create), 1<<20)
+	if _, stat, res := readReplyBody(t, c); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("create failed: %d %x", stat, res)
+	}
+	if uid, gid, _ := owner("chosen"); uid != 1234 || gid != 5678 {
+		t.Fatalf("file created with a chosen owner is %d:%d", uid, gid)
+	}
+}
+
+func TestCreationWithoutPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	dir := t.TempDir()
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(changeOS{osfs.New(dir), dir}), 1024),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writeFragments(t, c, rpcUnixCall(1, 100005, 3, 1, 1234, 5678, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+
+	// without a policy or permission checks, the owner the client sets is
+	// kept, whoever the caller is.
+	create := append(append(xdrOpaque(fh), xdrOpaque([]byte("chosen"))...), xdrUint32s(0, 0, 1, 4321, 1, 8765, 0, 0, 0)...)
+	writeFragments(t, c, rpcUnixCall(2, 100003, 3, uint32(nfs.NFSProcedureCreate), 1234, 5678, create), 1<<20)
+	if _, stat, res := readReplyBody(t, c); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("create failed: %d %x", stat, res)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "chosen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := file.GetInfo(info); a.UID != 4321 || a.GID != 8765 {
+		t.Fatalf("file created with a chosen owner is %d:%d", a.UID, a.GID)
+	}
+}
@@ -0,0 +1,261 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	portmapServiceID = 100000
+	portmapVersion   = 2
+)
+
+// rpcbindVersions are the versions of the portmapper program that speak
+// universal addresses rather than ports.
+var rpcbindVersions = []uint32{3, 4}
+
+func init() {
+	_ = RegisterVersionedMessageHandler(portmapServiceID, portmapVersion, uint32(PortmapProcNull), onPortmapNull)
+	_ = RegisterVersionedMessageHandler(portmapServiceID, portmapVersion, uint32(PortmapProcSet), onPortmapSet)
+	_ = RegisterVersionedMessageHandler(portmapServiceID, portmapVersion, uint32(PortmapProcUnset), onPortmapUnset)
+	_ = RegisterVersionedMessageHandler(portmapServiceID, portmapVersion, uint32(PortmapProcGetPort), onPortmapGetPort)
+	_ = RegisterVersionedMessageHandler(portmapServiceID, portmapVersion, uint32(PortmapProcDump), onPortmapDump)
+	for _, v := range rpcbindVersions {
+		_ = RegisterVersionedMessageHandler(portmapServiceID, v, uint32(RpcbindProcNull), onPortmapNull)
+		_ = RegisterVersionedMessageHandler(portmapServiceID, v, uint32(RpcbindProcGetAddr), onRpcbindGetAddr)
+	}
+}
+
+// ServePortmapper answers portmapper and rpcbind requests on the provided
+// listener, which is typically bound to port 111. Every program version
+// registered with the server is reported at the addresses passed to Serve
+// and ServePacket, so that clients can mount without specifying ports. A
+// program registered only with RegisterMessageHandler is mapped for every
+// version, and is listed by DUMP with version 0. The
+// listener answers no other program, and the portmapper is not answered on
+// the other listeners.
+func (s *Server) ServePortmapper(l net.Listener) error {
+	s.trackAddr(l.Addr(), true)
+	return s.serve(l, true)
+}
+
+// ServePortmapperPacket answers portmapper and rpcbind requests arriving
+// as datagrams on the provided connection.
+func (s *Server) ServePortmapperPacket(pc net.PacketConn) error {
+	s.trackAddr(pc.LocalAddr(), true)
+	return s.servePacket(pc, true)
+}
+
+// portMapping is a mapping of a program version to a port (rfc1833).
+type portMapping struct {
+	Prog uint32
+	Vers uint32
+	Prot uint32
+	Port uint32
+}
+
+// boundMapping is a portMapping along with the address it is bound to, when known.
+type boundMapping struct {
+	portMapping
+	ip net.IP
+}
+
+// portMappings lists the program versions reachable on each of the server's
+// listeners, followed by mappings set by other local services.
+func (s *Server) portMappings() []boundMapping {
+	progs := s.registeredPrograms()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.portMappingsLocked(progs)
+}
+
+// portMappingsLocked is portMappings for the registered programs progs, with
+// s.mu held.
+func (s *Server) portMappingsLocked(progs []programVersion) []boundMapping {
+	mappings := make([]boundMapping, 0)
+	for _, a := range s.addrs {
+		prot, ip, port, ok := addrProtocol(a.Addr)
+		if !ok {
+			continue
+		}
+		for _, pv := range progs {
+			if (pv.prog == portmapServiceID) != a.portmapper {
+				continue
+			}
+			mappings = append(mappings, boundMapping{portMapping{pv.prog, pv.vers, prot, port}, ip})
+		}
+	}
+	for _, m := range s.pmapSet {
+		mappings = append(mappings, boundMapping{portMapping: m})
+	}
+	return mappings
+}
+
+func (s *Server) lookupMapping(prog, vers, prot uint32) (boundMapping, bool) {
+	return findMapping(s.portMappings(), prog, vers, prot)
+}
+
+// findMapping finds the mapping of a program version among mappings, where
+// those of programs served for every version match any version.
+func findMapping(mappings []boundMapping, prog, vers, prot uint32) (boundMapping, bool) {
+	for _, m := range mappings {
+		if m.Prog == prog && (m.Vers == vers || m.Vers == anyVersion) && m.Prot == prot {
+			return m, true
+		}
+	}
+	return boundMapping{}, false
+}
+
+func addrProtocol(addr net.Addr) (prot uint32, ip net.IP, port uint32, ok bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return IPProtoTCP, a.IP, uint32(a.Port), true
+	case *net.UDPAddr:
+		return IPProtoUDP, a.IP, uint32(a.Port), true
+	}
+	return 0, nil, 0, false
+}
+
+func isLoopback(addr net.Addr) bool {
+	_, ip, _, ok := addrProtocol(addr)
+	return ok && ip.IsLoopback()
+}
+
+func onPortmapNull(ctx context.Context, w *Response, userHandle Handler) error {
+	return w.Write([]byte{})
+}
+
+// onPortmapSet records a mapping for another local service. Requests from
+// remote hosts are refused.
+func onPortmapSet(ctx context.Context, w *Response, userHandle Handler) error {
+	var m portMapping
+	if err := xdr.Read(w.req.Body, &m); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	ok := false
+	if isLoopback(w.conn.RemoteAddr()) {
+		s := w.conn.Server
+		progs := s.registeredPrograms()
+		s.mu.Lock()
+		if _, exists := findMapping(s.portMappingsLocked(progs), m.Prog, m.Vers, m.Prot); !exists {
+			s.pmapSet = append(s.pmapSet, m)
+			ok = true
+		}
+		s.mu.Unlock()
+	}
+	return writePortmapResult(w, ok)
+}
+
+// onPortmapUnset removes mappings set for a program version by other local
+// services. Requests from remote hosts are refused.
+func onPortmapUnset(ctx context.Context, w *Response, userHandle Handler) error {
+	var m portMapping
+	if err := xdr.Read(w.req.Body, &m); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	ok := false
+	if isLoopback(w.conn.RemoteAddr()) {
+		s := w.conn.Server
+		s.mu.Lock()
+		kept := s.pmapSet[:0]
+		for _, set := range s.pmapSet {
+			if set.Prog == m.Prog && set.Vers == m.Vers {
+				ok = true
+				continue
+			}
+			kept = append(kept, set)
+		}
+		s.pmapSet = kept
+		s.mu.Unlock()
+	}
+	return writePortmapResult(w, ok)
+}
+
+func onPortmapGetPort(ctx context.Context, w *Response, userHandle Handler) error {
+	var q portMapping
+	if err := xdr.Read(w.req.Body, &q); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	port := uint32(0)
+	if m, ok := w.conn.Server.lookupMapping(q.Prog, q.Vers, q.Prot); ok {
+		port = m.Port
+	}
+	return writePortmapResult(w, port)
+}
+
+func onPortmapDump(ctx context.Context, w *Response, userHandle Handler) error {
+	writer := bytes.NewBuffer([]byte{})
+	for _, m := range w.conn.Server.portMappings() {
+		// "value follows"
+		if err := xdr.Write(writer, true); err != nil {
+			return err
+		}
+		if err := xdr.Write(writer, m.portMapping); err != nil {
+			return err
+		}
+	}
+	if err := xdr.Write(writer, false); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
+
+// rpcbArgs is the rpcb structure used by rpcbind versions 3 and 4.
+type rpcbArgs struct {
+	Prog  uint32
+	Vers  uint32
+	Netid string
+	Addr  string
+	Owner string
+}
+
+// onRpcbindGetAddr answers with the universal address of a program version,
+// or an empty string if it is not available over the requested transport.
+func onRpcbindGetAddr(ctx context.Context, w *Response, userHandle Handler) error {
+	var q rpcbArgs
+	if err := xdr.Read(w.req.Body, &q); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	var prot uint32
+	switch q.Netid {
+	case "tcp", "tcp6":
+		prot = IPProtoTCP
+	case "udp", "udp6":
+		prot = IPProtoUDP
+	}
+
+	uaddr := ""
+	if m, ok := w.conn.Server.lookupMapping(q.Prog, q.Vers, prot); ok {
+		// prefer the address the client reached us on, as the mapped
+		// listener is commonly bound to a wildcard address.
+		_, ip, _, _ := addrProtocol(w.conn.LocalAddr())
+		if ip == nil || ip.IsUnspecified() {
+			ip = m.ip
+		}
+		uaddr = universalAddress(ip, m.Port)
+	}
+	return writePortmapResult(w, uaddr)
+}
+
+// universalAddress formats an IP address and port as an rpcbind universal
+// address, e.g. "192.0.2.1.8.1" for port 2049.
+func universalAddress(ip net.IP, port uint32) string {
+	host := "0.0.0.0"
+	if ip != nil {
+		host = ip.String()
+	}
+	return fmt.Sprintf("%s.%d.%d", host, (port>>8)&0xff, port&0xff)
+}
+
+func writePortmapResult(w *Response, result interface{}) error {
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, result); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
@@ -0,0 +1,121 @@
+package nfs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// dialRPC connects an RPC client to addr. The client binds a random local
+// port, which may already be in use, so the dial is retried on collisions.
+func dialRPC(addr string) (*rpc.Client, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := rpc.DialTCP("tcp", addr, false)
+		if err == nil || attempt == 10 || !errors.Is(err, syscall.EADDRINUSE) {
+			return c, err
+		}
+	}
+}
+
+func TestPortmapper(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pmapListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pmapListener.Close()
+
+	srv := &nfs.Server{Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024)}
+	// a program served for every version.
+	if err := srv.RegisterMessageHandler(400200, 1, func(ctx context.Context, w *nfs.Response, h nfs.Handler) error {
+		return w.Write(nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	go func() {
+		_ = srv.ServePortmapper(pmapListener)
+	}()
+
+	c, err := dialRPC(pmapListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pmap := &rpc.Portmapper{Client: c}
+	nfsPort := listener.Addr().(*net.TCPAddr).Port
+
+	for _, prog := range []uint32{100003, 100005} {
+		port, err := pmap.Getport(rpc.Mapping{Prog: prog, Vers: 3, Prot: rpc.IPProtoTCP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != nfsPort {
+			t.Fatalf("program %d mapped to port %d, expected %d", prog, port, nfsPort)
+		}
+	}
+	if port, err := pmap.Getport(rpc.Mapping{Prog: 100003, Vers: 3, Prot: rpc.IPProtoUDP}); err != nil || port != 0 {
+		t.Fatalf("unexpected udp mapping: %d %v", port, err)
+	}
+
+	type getAddr struct {
+		rpc.Header
+		Prog  uint32
+		Vers  uint32
+		Netid string
+		Addr  string
+		Owner string
+	}
+	res, err := c.Call(&getAddr{
+		Header: rpc.Header{Rpcvers: 2, Prog: rpc.PmapProg, Vers: 4, Proc: uint32(nfs.RpcbindProcGetAddr)},
+		Prog:   100003,
+		Vers:   3,
+		Netid:  "tcp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaddr, err := xdr.ReadOpaque(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("127.0.0.1.%d.%d", nfsPort>>8, nfsPort&0xff); string(uaddr) != expected {
+		t.Fatalf("unexpected universal address %q, expected %q", uaddr, expected)
+	}
+
+	if port, err := pmap.Getport(rpc.Mapping{Prog: 400200, Vers: 7, Prot: rpc.IPProtoTCP}); err != nil || port != nfsPort {
+		t.Fatalf("program served for every version mapped to port %d: %v", port, err)
+	}
+
+	// each listener answers only its own programs.
+	for _, l := range []struct {
+		addr string
+		prog uint32
+	}{{listener.Addr().String(), 100000}, {pmapListener.Addr().String(), 100003}} {
+		conn, err := net.Dial("tcp", l.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFragments(t, conn, rpcCall(1, l.prog, 2, 0, nil), 1<<20)
+		if _, stat, _ := readReplyBody(t, conn); stat != uint32(nfs.ResponseCodeProgUnavailable) {
+			t.Fatalf("program %d answered on %s: %d", l.prog, l.addr, stat)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,70 @@
+package nfs
+
+// PortmapProcedure is the valid RPC calls for version 2 of the portmapper
+// service (rfc1833).
+type PortmapProcedure uint32
+
+// PortmapProcedure Codes
+const (
+	PortmapProcNull PortmapProcedure = iota
+	PortmapProcSet
+	PortmapProcUnset
+	PortmapProcGetPort
+	PortmapProcDump
+	PortmapProcCallIt
+)
+
+func (p PortmapProcedure) String() string {
+	switch p {
+	case PortmapProcNull:
+		return "Null"
+	case PortmapProcSet:
+		return "Set"
+	case PortmapProcUnset:
+		return "Unset"
+	case PortmapProcGetPort:
+		return "GetPort"
+	case PortmapProcDump:
+		return "Dump"
+	case PortmapProcCallIt:
+		return "CallIt"
+	default:
+		return "Unknown"
+	}
+}
+
+// RpcbindProcedure is the valid RPC calls for versions 3 and 4 of the
+// rpcbind service (rfc1833).
+type RpcbindProcedure uint32
+
+// RpcbindProcedure Codes
+const (
+	RpcbindProcNull RpcbindProcedure = iota
+	RpcbindProcSet
+	RpcbindProcUnset
+	RpcbindProcGetAddr
+	RpcbindProcDump
+)
+
+func (r RpcbindProcedure) String() string {
+	switch r {
+	case RpcbindProcNull:
+		return "Null"
+	case RpcbindProcSet:
+		return "Set"
+	case RpcbindProcUnset:
+		return "Unset"
+	case RpcbindProcGetAddr:
+		return "GetAddr"
+	case RpcbindProcDump:
+		return "Dump"
+	default:
+		return "Unknown"
+	}
+}
+
+// Transport protocol numbers used in portmapper mappings.
+const (
+	IPProtoTCP = 6
+	IPProtoUDP = 17
+)
@@ -0,0 +1,286 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// RateLimitKey selects how requests are grouped under a RateLimit.
+type RateLimitKey int
+
+// RateLimitKey values
+const (
+	// RateLimitByClient limits each client IP address.
+	RateLimitByClient RateLimitKey = iota
+	// RateLimitByUID limits each AUTH_UNIX uid. Requests with other
+	// credentials share one budget.
+	RateLimitByUID
+	// RateLimitByExport limits each export. Exports the server has not seen
+	// mounted, and that the Handler does not resolve with ExportResolver,
+	// are told apart by the filesystem of their file handles.
+	RateLimitByExport
+)
+
+// rateLimitBuckets bounds the number of keys tracked for each limit.
+const rateLimitBuckets = 4096
+
+// RateLimit is a token bucket limit applied to NFS requests. Each key gets
+// its own buckets, refilled at OpsPerSecond and BytesPerSecond up to their
+// burst sizes. Only the payload of READ and WRITE counts towards the byte
+// budget. A zero rate leaves that dimension unlimited.
+type RateLimit struct {
+	Key            RateLimitKey
+	OpsPerSecond   float64
+	OpsBurst       int
+	BytesPerSecond float64
+	BytesBurst     int
+	// Delay makes over-limit requests wait for their budget, rather than
+	// being answered with NFS3ERR_JUKEBOX for the client to retry, or with
+	// NFSERR_IO for NFSv2, which has no JUKEBOX.
+	Delay bool
+}
+
+// SetRateLimits replaces the rate limits of the server. It may be called
+// while serving; the budgets of all keys start full.
+func (s *Server) SetRateLimits(limits ...RateLimit) {
+	limiters := make([]*rateLimiter, 0, len(limits))
+	for _, l := range limits {
+		if l.OpsPerSecond <= 0 && l.BytesPerSecond <= 0 {
+			continue
+		}
+		buckets, _ := lru.New[string, *limitBuckets](rateLimitBuckets)
+		limiters = append(limiters, &rateLimiter{RateLimit: l, buckets: buckets})
+	}
+	s.rateLimiters.Store(&limiters)
+}
+
+// RateLimits returns the rate limits currently applied by the server.
+func (s *Server) RateLimits() []RateLimit {
+	limiters := s.rateLimiters.Load()
+	if limiters == nil {
+		return nil
+	}
+	limits := make([]RateLimit, 0, len(*limiters))
+	for _, l := range *limiters {
+		limits = append(limits, l.RateLimit)
+	}
+	return limits
+}
+
+type rateLimiter struct {
+	RateLimit
+	mu      sync.Mutex
+	buckets *lru.Cache[string, *limitBuckets]
+}
+
+type limitBuckets struct {
+	ops   tokenBucket
+	bytes tokenBucket
+}
+
+func (l *rateLimiter) bucketsFor(key string) *limitBuckets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets.Get(key); ok {
+		return b
+	}
+	b := &limitBuckets{
+		ops:   newTokenBucket(l.OpsPerSecond, l.OpsBurst),
+		bytes: newTokenBucket(l.BytesPerSecond, l.BytesBurst),
+	}
+	l.buckets.Add(key, b)
+	return b
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. A zero
+// rate never limits.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = 1
+	}
+	return tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// take removes n tokens. With wait, the bucket may go into debt and take
+// returns how long the caller must wait to have been within budget.
+// Without, it takes nothing and fails if too few tokens are available.
+func (b *tokenBucket) take(n float64, wait bool) (time.Duration, bool) {
+	if b.rate <= 0 || n <= 0 {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if n > b.burst {
+		// a request larger than the burst could never be admitted.
+		n = b.burst
+	}
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	b.tokens -= n
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+// refund returns n tokens that take removed for a request that was then
+// refused.
+func (b *tokenBucket) refund(n float64) {
+	if b.rate <= 0 || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.burst {
+		n = b.burst
+	}
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// bucketCharge is a number of tokens taken from a bucket.
+type bucketCharge struct {
+	bucket *tokenBucket
+	n      float64
+}
+
+// rateLimit applies the server's rate limits to an NFS request, delaying it
+// or failing it with NFS3ERR_JUKEBOX when it is over budget. A request that
+// is refused by any bucket is charged to none of them.
+func (c *conn) rateLimit(ctx context.Context, w *Response) error {
+	limiters := c.Server.rateLimiters.Load()
+	if limiters == nil || len(*limiters) == 0 ||
+		w.req.Header.Prog != nfsServiceID || w.req.Header.Proc == uint32(NFSProcedureNull) {
+		return nil
+	}
+	size := float64(w.req.payloadSize())
+	var charged []bucketCharge
+	var delay time.Duration
+	for _, l := range *limiters {
+		key, ok := w.rateLimitKey(l.Key)
+		if !ok {
+			continue
+		}
+		b := l.bucketsFor(key)
+		opsWait, opsOK := b.ops.take(1, l.Delay)
+		if opsOK {
+			charged = append(charged, bucketCharge{&b.ops, 1})
+		}
+		bytesWait, bytesOK := b.bytes.take(size, l.Delay)
+		if bytesOK {
+			charged = append(charged, bucketCharge{&b.bytes, size})
+		}
+		if !opsOK || !bytesOK {
+			for _, c := range charged {
+				c.bucket.refund(c.n)
+			}
+			Log.Debugf("%v: rate limit exceeded for %s", w.req, key)
+			// NFSv2 has no JUKEBOX, and its replies carry NFSERR_IO instead.
+			return &NFSStatusError{NFSStatusJukebox, nil}
+		}
+		delay = maxDuration(delay, maxDuration(opsWait, bytesWait))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (w *Response) rateLimitKey(key RateLimitKey) (string, bool) {
+	switch key {
+	case RateLimitByClient:
+		return remoteIP(w.conn.Conn), true
+	case RateLimitByUID:
+		if creds := w.req.creds; creds.HasIdentity() {
+			return strconv.FormatUint(uint64(creds.UID), 10), true
+		}
+		return "", true
+	case RateLimitByExport:
+		if policy, ok := w.export(); ok {
+			return policy.dirpath, true
+		}
+		// the export is unknown, as after a restart, so requests are keyed
+		// by the root of the filesystem their handle belongs to.
+		fs := w.filesystem()
+		if fs == nil {
+			return "", false
+		}
+		return "fs:" + string(w.conn.Server.Handler.ToHandle(fs, []string{})), true
+	}
+	return "", false
+}
+
+// payloadSize returns the data size of a READ or WRITE request, which follows
+// the file handle and offset in its arguments. NFSv2 handles are of fixed
+// size, and their WRITE arguments hold the data after two more offsets.
+func (r *Request) payloadSize() uint32 {
+	if r.Header.Prog != nfsServiceID {
+		return 0
+	}
+	if r.Header.Vers == nfsV2Version {
+		var at int
+		switch NFSv2Procedure(r.Header.Proc) {
+		case NFSv2ProcedureRead:
+			at = FHSizeV2 + 4
+		case NFSv2ProcedureWrite:
+			at = FHSizeV2 + 12
+		default:
+			return 0
+		}
+		if len(r.args) < at+4 {
+			return 0
+		}
+		return binary.BigEndian.Uint32(r.args[at:])
+	}
+	if r.Header.Proc != uint32(NFSProcedureRead) && r.Header.Proc != uint32(NFSProcedureWrite) {
+		return 0
+	}
+	args := bytes.NewReader(r.args)
+	if _, err := xdr.ReadOpaque(args); err != nil {
+		return 0
+	}
+	var rest [12]byte
+	if _, err := args.Read(rest[:]); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(rest[8:])
+}
@@ -0,0 +1,188 @@
+package nfs
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	rquotaServiceID  = 100011
+	rquotaVersion    = 1
+	rquotaExtVersion = 2
+)
+
+func init() {
+	for _, vers := range []uint32{rquotaVersion, rquotaExtVersion} {
+		_ = RegisterVersionedMessageHandler(rquotaServiceID, vers, uint32(RQuotaProcNull), onRQuotaNull)
+		_ = RegisterVersionedMessageHandler(rquotaServiceID, vers, uint32(RQuotaProcGetQuota), onGetQuota)
+		_ = RegisterVersionedMessageHandler(rquotaServiceID, vers, uint32(RQuotaProcGetActiveQuota), onGetQuota)
+	}
+}
+
+// rquota is the quota of the protocol, with space in blocks of BSize bytes
+// and times left in seconds.
+type rquota struct {
+	BSize      uint32
+	Active     bool
+	BHardLimit uint32
+	BSoftLimit uint32
+	CurBlocks  uint32
+	FHardLimit uint32
+	FSoftLimit uint32
+	CurFiles   uint32
+	BTimeLeft  uint32
+	FTimeLeft  uint32
+}
+
+// quotaBlockSize is the block size, from 1024 bytes, in which the space of a
+// quota fits the protocol's 32 bit counts.
+func quotaBlockSize(q *Quota) uint64 {
+	bsize := uint64(1024)
+	for _, n := range []uint64{q.HardLimitBytes, q.SoftLimitBytes, q.UsedBytes} {
+		for n/bsize >= math.MaxUint32 {
+			bsize *= 2
+		}
+	}
+	return bsize
+}
+
+func clampUint32(n uint64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+func quotaSeconds(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	return clampUint32(uint64((d + time.Second - 1) / time.Second))
+}
+
+func toRQuota(q *Quota) rquota {
+	bsize := quotaBlockSize(q)
+	return rquota{
+		BSize:      uint32(bsize),
+		Active:     q.Active,
+		BHardLimit: uint32(q.HardLimitBytes / bsize),
+		BSoftLimit: uint32(q.SoftLimitBytes / bsize),
+		CurBlocks:  uint32((q.UsedBytes + bsize - 1) / bsize),
+		FHardLimit: clampUint32(q.HardLimitFiles),
+		FSoftLimit: clampUint32(q.SoftLimitFiles),
+		CurFiles:   clampUint32(q.UsedFiles),
+		BTimeLeft:  quotaSeconds(q.BytesGrace),
+		FTimeLeft:  quotaSeconds(q.FilesGrace),
+	}
+}
+
+func onRQuotaNull(ctx context.Context, w *Response, userHandle Handler) error {
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// onGetQuota reports the quota of a user, or with the extended version, of
+// a user or group, on the export at a path. Callers other than root may
+// only read their own quotas and those of their groups. GETACTIVEQUOTA
+// reports quotas that are not enforced as missing.
+func onGetQuota(ctx context.Context, w *Response, userHandle Handler) error {
+	var args struct {
+		Path string
+		Type uint32
+		ID   uint32
+	}
+	var err error
+	if w.req.Header.Vers == rquotaExtVersion {
+		err = xdr.Read(w.req.Body, &args)
+	} else {
+		var v1 struct {
+			Path string
+			ID   uint32
+		}
+		err = xdr.Read(w.req.Body, &v1)
+		args.Path, args.Type, args.ID = v1.Path, uint32(QuotaUser), v1.ID
+	}
+	if err != nil || len(args.Path) > RQuotaPathLen {
+		return &ResponseCodeGarbageArgsError{}
+	}
+
+	status, q := getQuota(ctx, w, userHandle, args.Path, QuotaType(args.Type), args.ID)
+	if status == RQuotaStatusOk && w.req.Header.Proc == uint32(RQuotaProcGetActiveQuota) && !q.Active {
+		status = RQuotaStatusNoQuota
+	}
+	if status != RQuotaStatusOk {
+		return w.WriteXDR(status)
+	}
+	return w.WriteXDR(&struct {
+		Status RQuotaStatus
+		Quota  rquota
+	}{status, toRQuota(q)})
+}
+
+func getQuota(ctx context.Context, w *Response, userHandle Handler, path string, kind QuotaType, id uint32) (RQuotaStatus, *Quota) {
+	creds := w.req.creds
+	if !creds.HasIdentity() {
+		return RQuotaStatusEPerm, nil
+	}
+	if creds.UID != 0 {
+		if (kind == QuotaUser && id != creds.UID) || (kind == QuotaGroup && !creds.InGroup(id)) {
+			return RQuotaStatusEPerm, nil
+		}
+	}
+	if kind != QuotaUser && kind != QuotaGroup {
+		return RQuotaStatusNoQuota, nil
+	}
+	qh, ok := userHandle.(QuotaHandler)
+	if !ok {
+		return RQuotaStatusNoQuota, nil
+	}
+
+	fs, status := mountedExport(ctx, w, userHandle, path)
+	if status != RQuotaStatusOk {
+		return status, nil
+	}
+	q, err := qh.Quota(ctx, fs, kind, id)
+	if err != nil {
+		Log.Debugf("%v: %v", w.req, err)
+		return RQuotaStatusNoQuota, nil
+	}
+	if q == nil {
+		return RQuotaStatusNoQuota, nil
+	}
+	return RQuotaStatusOk, q
+}
+
+// mountedExport returns the filesystem of the export the caller's host has
+// mounted at dirpath, as its file handles resolve, so that quotas are only
+// reported for exports the host may use.
+func mountedExport(ctx context.Context, w *Response, userHandle Handler, dirpath string) (billy.Filesystem, RQuotaStatus) {
+	s := w.conn.Server
+	host := remoteIP(w.conn.Conn)
+	mounted := false
+	for _, e := range s.mounts.list() {
+		if e.Host == host && e.Dirpath == dirpath {
+			mounted = true
+			break
+		}
+	}
+	if !mounted {
+		return nil, RQuotaStatusNoQuota
+	}
+	status := RQuotaStatusNoQuota
+	for _, fs := range s.exports.mountedAt(dirpath) {
+		a, ok := userHandle.(ExportAuthorizer)
+		if !ok {
+			return fs, RQuotaStatusOk
+		}
+		// exports may present a filesystem for each group of clients.
+		if _, err := a.AuthorizeExport(ctx, w.conn, fs, w.req.creds); err != nil {
+			status = RQuotaStatusEPerm
+			continue
+		}
+		return fs, RQuotaStatusOk
+	}
+	return nil, status
+}
@@ -0,0 +1,104 @@
+package nfs_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+)
+
+type quotaHandler struct {
+	nfs.Handler
+}
+
+func (quotaHandler) Quota(ctx context.Context, fs billy.Filesystem, kind nfs.QuotaType, id uint32) (*nfs.Quota, error) {
+	if kind != nfs.QuotaUser || id != 1001 {
+		return nil, nil
+	}
+	return &nfs.Quota{
+		Active:         true,
+		HardLimitBytes: 1 << 30,
+		SoftLimitBytes: 1 << 29,
+		UsedBytes:      1 << 20,
+		HardLimitFiles: 1000,
+		SoftLimitFiles: 800,
+		UsedFiles:      10,
+		BytesGrace:     time.Minute,
+	}, nil
+}
+
+// rpcUnixCall builds an RPC call message with AUTH_UNIX credentials.
+func rpcUnixCall(xid, prog, vers, proc, uid, gid uint32, args []byte) []byte {
+	cred := append(xdrUint32s(0), xdrOpaque([]byte("client"))...)
+	cred = append(cred, xdrUint32s(uid, gid, 0)...)
+	msg := append(xdrUint32s(xid, 0, 2, prog, vers, proc, 1), xdrOpaque(cred)...)
+	msg = append(msg, xdrUint32s(0, 0)...)
+	return append(msg, args...)
+}
+
+func TestRQuota(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(quotaHandler{helpers.NewNullAuthHandler(mem)}, 1024)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	xid := uint32(0)
+	call := func(vers uint32, proc nfs.RQuotaProcedure, uid uint32, args []byte) (nfs.RQuotaStatus, []byte) {
+		xid++
+		writeFragments(t, c, rpcUnixCall(xid, 100011, vers, uint32(proc), uid, 100, args), 1<<20)
+		_, stat, body := readReplyBody(t, c)
+		if stat != 0 {
+			t.Fatalf("%v failed: %d", proc, stat)
+		}
+		return nfs.RQuotaStatus(binary.BigEndian.Uint32(body)), body[4:]
+	}
+
+	// quotas are only reported for exports the client has mounted.
+	if status, _ := call(1, nfs.RQuotaProcGetQuota, 1001, append(xdrOpaque([]byte("/")), xdrUint32s(1001)...)); status != nfs.RQuotaStatusNoQuota {
+		t.Fatalf("getquota before mount: %v", status)
+	}
+	xid++
+	writeFragments(t, c, rpcUnixCall(xid, 100005, 3, uint32(nfs.MountProcMount), 1001, 100, xdrOpaque([]byte("/"))), 1<<20)
+	if _, stat, res := readReplyBody(t, c); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+
+	status, res := call(1, nfs.RQuotaProcGetQuota, 1001, append(xdrOpaque([]byte("/")), xdrUint32s(1001)...))
+	if status != nfs.RQuotaStatusOk {
+		t.Fatalf("getquota: %v", status)
+	}
+	want := xdrUint32s(1024, 1, 1<<20, 1<<19, 1<<10, 1000, 800, 10, 60, 0)
+	if string(res) != string(want) {
+		t.Fatalf("getquota result: %x", res)
+	}
+
+	if status, _ := call(2, nfs.RQuotaProcGetActiveQuota, 1001, append(xdrOpaque([]byte("/")), xdrUint32s(0, 1001)...)); status != nfs.RQuotaStatusOk {
+		t.Fatalf("ext getactivequota: %v", status)
+	}
+	if status, _ := call(2, nfs.RQuotaProcGetQuota, 1001, append(xdrOpaque([]byte("/")), xdrUint32s(1, 100)...)); status != nfs.RQuotaStatusNoQuota {
+		t.Fatalf("group without quota: %v", status)
+	}
+	if status, _ := call(1, nfs.RQuotaProcGetQuota, 1002, append(xdrOpaque([]byte("/")), xdrUint32s(1001)...)); status != nfs.RQuotaStatusEPerm {
+		t.Fatalf("quota of another user: %v", status)
+	}
+	if status, _ := call(1, nfs.RQuotaProcGetQuota, 0, append(xdrOpaque([]byte("/")), xdrUint32s(1001)...)); status != nfs.RQuotaStatusOk {
+		t.Fatalf("quota read by root: %v", status)
+	}
+}
@@ -0,0 +1,43 @@
+package nfs
+
+// RQuotaProcedure is the valid RPC calls for the remote quota service.
+type RQuotaProcedure uint32
+
+// RQuotaProcedure Codes
+const (
+	RQuotaProcNull RQuotaProcedure = iota
+	RQuotaProcGetQuota
+	RQuotaProcGetActiveQuota
+	RQuotaProcSetQuota
+	RQuotaProcSetActiveQuota
+)
+
+func (r RQuotaProcedure) String() string {
+	switch r {
+	case RQuotaProcNull:
+		return "Null"
+	case RQuotaProcGetQuota:
+		return "GetQuota"
+	case RQuotaProcGetActiveQuota:
+		return "GetActiveQuota"
+	case RQuotaProcSetQuota:
+		return "SetQuota"
+	case RQuotaProcSetActiveQuota:
+		return "SetActiveQuota"
+	default:
+		return "Unknown"
+	}
+}
+
+// RQuotaStatus is the result of a remote quota procedure (gqr_status).
+type RQuotaStatus uint32
+
+// RQuotaStatus Codes
+const (
+	RQuotaStatusOk      RQuotaStatus = 1
+	RQuotaStatusNoQuota RQuotaStatus = 2
+	RQuotaStatusEPerm   RQuotaStatus = 3
+)
+
+// RQuotaPathLen is the maximum size of the path of a quota request.
+const RQuotaPathLen = 1024
@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 // Server is a handle to the listening NFS server.
@@ -14,53 +20,344 @@ type Server struct {
 	Handler
 	ID [8]byte
 	context.Context
+	ServerOptions
+	// DuplicateCacheSize is the number of replies to non-idempotent requests
+	// remembered so that retransmissions are not run twice. Zero means
+	// DefaultDuplicateCacheSize, and a negative value disables the cache.
+	DuplicateCacheSize int
+	// DuplicateCacheTTL is how long replies are remembered for
+	// retransmissions. Zero means DefaultDuplicateCacheTTL.
+	DuplicateCacheTTL time.Duration
+	// Interceptors wrap the handler of every procedure, the first being
+	// outermost. See Interceptor.
+	Interceptors []Interceptor
+	// TLSConfig, if set, allows clients to upgrade connections to TLS with
+	// the AUTH_TLS probe of rfc9289. Client certificates verified during the
+	// handshake are available to handlers through ClientCertificate.
+	TLSConfig *tls.Config
+	// RequireTLS, if set, reports whether the export at dirpath may only be
+	// mounted and accessed over TLS. Requires TLSConfig. File handles of
+	// exports not mounted from the server are refused, unless the Handler
+	// implements ExportResolver.
+	RequireTLS func(dirpath string) bool
+	// CheckPermissions makes the server evaluate the caller's AUTH_UNIX
+	// identity against the mode, owner and group of files before procedures
+	// that look up, read, write, create, remove, rename or change them,
+	// rather than leaving this to the filesystem. Callers without AUTH_UNIX
+	// credentials are treated as uid and gid 65534.
+	CheckPermissions bool
+	// CreationPolicy, if set, returns the policy for the owner and mode of
+	// objects clients create in the export at dirpath, or nil for none.
+	CreationPolicy func(dirpath string) *CreationPolicy
+	// GSSMechanism, if set, accepts RPCSEC_GSS contexts from clients. Calls
+	// made with them carry Credentials with the Principal of the client.
+	GSSMechanism GSSMechanism
+	// MapPrincipal, if set, returns the identity of a principal authenticated
+	// with RPCSEC_GSS, reporting false for principals without one, which are
+	// treated like AUTH_NULL callers.
+	MapPrincipal func(principal string) (uid, gid uint32, gids []uint32, ok bool)
+	// RmtabPath, if set, is a file in which the mount table is kept, one
+	// host:dirpath:0x00000001 line per mount as in the rmtab of Linux, so
+	// that it survives restarts. See Mounts.
+	RmtabPath string
+	// LockManager keeps the locks clients take through the network lock
+	// manager. Nil means a NewMemoryLockManager.
+	LockManager LockManager
+	// CallbackPort, if set, returns the port of an RPC program on a client
+	// host, for calls the server makes to clients, such as to grant blocked
+	// locks. Otherwise the portmapper of the host is asked.
+	CallbackPort func(host string, prog, vers uint32) (int, error)
+	// StatdPath, if set, is a directory in which the network status monitor
+	// keeps the server's state number and the hosts it monitors, so that
+	// after a restart those hosts are told to reclaim their locks.
+	StatdPath string
+	// LockGracePeriod is how long after a restart, when there are hosts to
+	// reclaim locks, that only reclaimed locks are granted. Zero means
+	// DefaultLockGracePeriod, and a negative value disables it.
+	LockGracePeriod time.Duration
+	// ConnState, if set, is called when a client connection changes state.
+	// See the ConnState type for details.
+	ConnState func(net.Conn, ConnState)
+
+	initOnce sync.Once
+	initErr  error
+	workers  chan struct{}
+	drc      *duplicateCache
+	exports  exportTable
+	mounts   mountTable
+	locks    *lockService
+	statd    statusMonitor
+	// gssContexts holds the RPCSEC_GSS contexts of clients, by handle, and
+	// gssPending those still being created.
+	gssContexts *lru.Cache[string, *gssContext]
+	gssPending  *lru.Cache[string, *gssContext]
+
+	rateLimiters atomic.Pointer[[]*rateLimiter]
+
+	// handlers is the dispatch table, replaced whole on registration.
+	handlers    atomic.Pointer[handlerTable]
+	handlersMu  sync.Mutex
+	ownHandlers map[handlerID]bool
+
+	inShutdown  atomic.Bool
+	mu          sync.Mutex
+	listeners   map[net.Listener]struct{}
+	packetConns map[net.PacketConn]struct{}
+	conns       map[*conn]struct{}
+	connsPerIP  map[string]int
+	addrs       []listenAddr
+	// pmapSet holds mappings registered by other local services through
+	// the portmapper.
+	pmapSet []portMapping
 }
 
-// RegisterMessageHandler registers a handler for a specific
-// XDR procedure.
+// ServerOptions holds the limits a Server places on connections and requests.
+// A zero value imposes no limit, unless otherwise noted.
+type ServerOptions struct {
+	// MaxConns bounds the number of open connections. Connections accepted
+	// beyond it are closed immediately.
+	MaxConns int
+	// MaxConnsPerIP bounds the number of open connections from one client
+	// address.
+	MaxConnsPerIP int
+	// ReadHeaderTimeout bounds the time to read a request once its first
+	// byte has arrived, so that clients trickling bytes are disconnected.
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout is how long a connection with no requests in progress
+	// waits for the next request before it is closed.
+	IdleTimeout time.Duration
+	// WriteTimeout bounds the time to write each reply.
+	WriteTimeout time.Duration
+	// MaxRecordSize bounds the size of a reassembled RPC record. Larger
+	// records are rejected with GARBAGE_ARGS. Zero means DefaultMaxRecordSize.
+	MaxRecordSize uint32
+	// MaxConnRequests bounds how many requests from a single connection run
+	// concurrently. Zero means DefaultMaxConnRequests.
+	MaxConnRequests int
+	// MaxRequests bounds how many requests run concurrently across all
+	// connections. Zero means no limit beyond MaxConnRequests.
+	MaxRequests int
+}
+
+// listenAddr is an address the server accepts requests on.
+type listenAddr struct {
+	net.Addr
+	portmapper bool
+}
+
+func (s *Server) trackAddr(addr net.Addr, portmapper bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs = append(s.addrs, listenAddr{addr, portmapper})
+}
+
+// ErrServerClosed is returned by the Serve methods after a call to Shutdown
+// or Close.
+var ErrServerClosed = errors.New("nfs: Server closed")
+
+// ConnState represents the state of a client connection to a server.
+type ConnState int
+
+const (
+	// StateNew is a connection that has been accepted but has not yet sent
+	// a request.
+	StateNew ConnState = iota
+	// StateActive is a connection with at least one request being handled
+	// or a reply not yet written.
+	StateActive
+	// StateIdle is a connection with no outstanding requests.
+	StateIdle
+	// StateClosed is a closed connection. This is a terminal state.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// DefaultMaxConnRequests is the number of requests a Server runs concurrently
+// for one connection when MaxConnRequests is not set.
+const DefaultMaxConnRequests = 16
+
+// DefaultMaxRecordSize is the largest RPC record a Server accepts when
+// MaxRecordSize is not set.
+const DefaultMaxRecordSize = 1 << 25
+
+// recordOverhead bounds the RPC call header and WRITE arguments that precede
+// the data payload in a record.
+const recordOverhead = 1024
+
+// RegisterMessageHandler registers a default handler for a specific
+// XDR procedure, for every version of the program. Default handlers are
+// copied into a Server's own table the first time it dispatches a request
+// or registers a handler, so registration should happen before then.
 func RegisterMessageHandler(protocol uint32, proc uint32, handler HandleFunc) error {
-	if registeredHandlers == nil {
-		registeredHandlers = make(map[registeredHandlerID]HandleFunc)
+	return RegisterVersionedMessageHandler(protocol, anyVersion, proc, handler)
+}
+
+// RegisterVersionedMessageHandler registers a default handler for a specific
+// XDR procedure of one version of a program.
+func RegisterVersionedMessageHandler(protocol uint32, version uint32, proc uint32, handler HandleFunc) error {
+	defaultHandlersMu.Lock()
+	defer defaultHandlersMu.Unlock()
+	id := handlerID{protocol, version, proc}
+	if _, ok := defaultHandlers[id]; ok {
+		return errors.New("already registered")
 	}
-	for k := range registeredHandlers {
-		if k.protocol == protocol && k.proc == proc {
-			return errors.New("already registered")
-		}
+	defaultHandlers[id] = handler
+	return nil
+}
+
+// RegisterMessageHandler registers a handler for a specific XDR procedure on
+// this server only, for every version of the program.
+func (s *Server) RegisterMessageHandler(protocol uint32, proc uint32, handler HandleFunc) error {
+	return s.RegisterVersionedMessageHandler(protocol, anyVersion, proc, handler)
+}
+
+// RegisterVersionedMessageHandler registers a handler for a specific XDR
+// procedure of one version of a program on this server only. It replaces
+// any default handler for the procedure, and may be called while serving.
+func (s *Server) RegisterVersionedMessageHandler(protocol uint32, version uint32, proc uint32, handler HandleFunc) error {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	id := handlerID{protocol, version, proc}
+	if s.ownHandlers[id] {
+		return errors.New("already registered")
+	}
+	current := s.handlerTable()
+	// the table is replaced rather than modified, so lookups need no lock.
+	next := make(handlerTable, len(current)+1)
+	for k, v := range current {
+		next[k] = v
 	}
-	id := registeredHandlerID{protocol, proc}
-	registeredHandlers[id] = handler
+	next[id] = handler
+	s.handlers.Store(&next)
+	if s.ownHandlers == nil {
+		s.ownHandlers = make(map[handlerID]bool)
+	}
+	s.ownHandlers[id] = true
 	return nil
 }
 
 // HandleFunc represents a handler for a specific protocol message.
-type HandleFunc func(ctx context.Context, w *response, userHandler Handler) error
+type HandleFunc func(ctx context.Context, w *Response, userHandler Handler) error
+
+// anyVersion marks handlers registered without a program version.
+const anyVersion = 0
 
-// TODO: store directly as a uint64 for more efficient lookups
-type registeredHandlerID struct {
+// rpcVersion is the version of the RPC protocol spoken (rfc5531).
+const rpcVersion = 2
+
+type handlerID struct {
 	protocol uint32
+	version  uint32
 	proc     uint32
 }
 
-var registeredHandlers map[registeredHandlerID]HandleFunc
+type handlerTable map[handlerID]HandleFunc
+
+var (
+	defaultHandlersMu sync.Mutex
+	defaultHandlers   = make(handlerTable)
+)
+
+// handlerTable returns the server's dispatch table, copying the default
+// handlers on first use.
+func (s *Server) handlerTable() handlerTable {
+	if t := s.handlers.Load(); t != nil {
+		return *t
+	}
+	defaultHandlersMu.Lock()
+	t := make(handlerTable, len(defaultHandlers))
+	for k, v := range defaultHandlers {
+		t[k] = v
+	}
+	defaultHandlersMu.Unlock()
+	s.handlers.CompareAndSwap(nil, &t)
+	return *s.handlers.Load()
+}
+
+// programVersion identifies one version of an RPC program.
+type programVersion struct {
+	prog uint32
+	vers uint32
+}
+
+// registeredPrograms lists the program versions with registered handlers.
+// A program whose handlers were all registered for every version is listed
+// once, with version anyVersion; handlers for every version of a program that
+// also has versioned ones are served on the versions listed for it.
+func (s *Server) registeredPrograms() []programVersion {
+	versioned := make(map[uint32]bool)
+	table := s.handlerTable()
+	for k := range table {
+		if k.version != anyVersion {
+			versioned[k.protocol] = true
+		}
+	}
+	seen := make(map[programVersion]bool)
+	progs := make([]programVersion, 0)
+	for k := range table {
+		pv := programVersion{k.protocol, k.version}
+		if (k.version == anyVersion && versioned[k.protocol]) || seen[pv] {
+			continue
+		}
+		seen[pv] = true
+		progs = append(progs, pv)
+	}
+	sort.Slice(progs, func(i, j int) bool {
+		if progs[i].prog != progs[j].prog {
+			return progs[i].prog < progs[j].prog
+		}
+		return progs[i].vers < progs[j].vers
+	})
+	return progs
+}
 
 // Serve listens on the provided listener port for incoming client requests.
 func (s *Server) Serve(l net.Listener) error {
+	s.trackAddr(l.Addr(), false)
+	return s.serve(l, false)
+}
+
+// serve accepts connections on l, which answer only the portmapper program
+// if portmapper is set, and every other program otherwise.
+func (s *Server) serve(l net.Listener, portmapper bool) error {
 	defer l.Close()
 	baseCtx := context.Background()
 	if s.Context != nil {
 		baseCtx = s.Context
 	}
-	if bytes.Equal(s.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
-		if _, err := rand.Reader.Read(s.ID[:]); err != nil {
-			return err
-		}
+	if err := s.init(); err != nil {
+		return err
 	}
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
 
 	var tempDelay time.Duration
 
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -76,28 +373,314 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 		tempDelay = 0
-		c := s.newConn(conn)
+		c := s.newConn(conn, portmapper)
+		if err := s.addConn(c); err != nil {
+			conn.Close()
+			if err == ErrServerClosed {
+				return err
+			}
+			Log.Warnf("rejecting connection from %v: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		c.setState(StateNew)
 		go c.serve(baseCtx)
 	}
 }
 
-func (s *Server) newConn(nc net.Conn) *conn {
+// Shutdown gracefully shuts down the server. It closes all listeners, then
+// waits for requests in flight to be answered and closes connections as they
+// become idle. If ctx expires first, Shutdown returns the context's error and
+// the remaining connections are left open; Close can be used to end them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	for pc := range s.packetConns {
+		// stop reading while leaving the socket open for pending replies.
+		_ = pc.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections, without waiting
+// for requests in flight. For a graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListenersLocked()
+	for pc := range s.packetConns {
+		if cerr := pc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Conn.Close()
+		s.removeConnLocked(c)
+	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes connections with no outstanding requests, and reports
+// whether the server has quiesced.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := len(s.packetConns) == 0
+	for c := range s.conns {
+		if !c.idle() {
+			quiescent = false
+			continue
+		}
+		c.Conn.Close()
+		s.removeConnLocked(c)
+	}
+	return quiescent
+}
+
+// trackListener adds or removes a listener from the set closed on shutdown.
+// Adding fails once the server is shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackPacketConn(pc net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		if s.packetConns == nil {
+			s.packetConns = make(map[net.PacketConn]struct{})
+		}
+		s.packetConns[pc] = struct{}{}
+	} else {
+		delete(s.packetConns, pc)
+	}
+	return true
+}
+
+// errConnLimit is returned by addConn when a connection limit is reached.
+var errConnLimit = errors.New("connection limit reached")
+
+// addConn tracks a new connection, enforcing the connection limits.
+func (s *Server) addConn(c *conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return errConnLimit
+	}
+	ip := remoteIP(c.Conn)
+	if s.MaxConnsPerIP > 0 && s.connsPerIP[ip] >= s.MaxConnsPerIP {
+		return errConnLimit
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+		s.connsPerIP = make(map[string]int)
+	}
+	s.conns[c] = struct{}{}
+	s.connsPerIP[ip]++
+	return nil
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeConnLocked(c)
+}
+
+func (s *Server) removeConnLocked(c *conn) {
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	delete(s.conns, c)
+	ip := remoteIP(c.Conn)
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// remoteIP returns the host part of a connection's remote address.
+func remoteIP(nc net.Conn) string {
+	addr := nc.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// init prepares state shared by all of the server's listeners.
+func (s *Server) init() error {
+	s.initOnce.Do(func() {
+		if bytes.Equal(s.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
+			if _, err := rand.Reader.Read(s.ID[:]); err != nil {
+				s.initErr = err
+				return
+			}
+		}
+		if s.MaxRequests > 0 {
+			s.workers = make(chan struct{}, s.MaxRequests)
+		}
+		if s.DuplicateCacheSize >= 0 {
+			s.drc = newDuplicateCache(s.DuplicateCacheSize, s.DuplicateCacheTTL)
+		}
+		if s.GSSMechanism != nil {
+			s.gssContexts, _ = lru.New[string, *gssContext](gssMaxContexts)
+			s.gssPending, _ = lru.New[string, *gssContext](gssMaxPending)
+		}
+		s.locks = &lockService{manager: s.LockManager, monitored: make(map[string]func())}
+		if s.locks.manager == nil {
+			s.locks.manager = NewMemoryLockManager()
+		}
+		hosts, err := s.statd.load(s.StatdPath)
+		if err != nil {
+			s.initErr = err
+			return
+		}
+		if len(hosts) > 0 {
+			grace := s.LockGracePeriod
+			if grace == 0 {
+				grace = DefaultLockGracePeriod
+			}
+			s.locks.graceEnd = time.Now().Add(grace)
+			go s.notifyRestart(hosts)
+		}
+		if s.RmtabPath != "" {
+			if err := s.mounts.load(s.RmtabPath); err != nil {
+				s.initErr = err
+				return
+			}
+		}
+	})
+	return s.initErr
+}
+
+// acquireWorker blocks until the server-wide request limit allows another
+// request to run.
+func (s *Server) acquireWorker(ctx context.Context) error {
+	if s.workers == nil {
+		return nil
+	}
+	select {
+	case s.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) releaseWorker() {
+	if s.workers != nil {
+		<-s.workers
+	}
+}
+
+func (s *Server) maxConnRequests() int {
+	if s.MaxConnRequests <= 0 {
+		return DefaultMaxConnRequests
+	}
+	return s.MaxConnRequests
+}
+
+func (s *Server) maxRecordSize() uint32 {
+	if s.MaxRecordSize == 0 {
+		return DefaultMaxRecordSize
+	}
+	return s.MaxRecordSize
+}
+
+func (s *Server) newConn(nc net.Conn, portmapper bool) *conn {
 	c := &conn{
-		Server: s,
-		Conn:   nc,
+		Server:     s,
+		Conn:       nc,
+		portmapper: portmapper,
 	}
 	return c
 }
 
-// TODO: keep an immutable map for each server instance to have less
-// chance of races.
-func (s *Server) handlerFor(prog uint32, proc uint32) HandleFunc {
-	for k, v := range registeredHandlers {
-		if k.protocol == prog && k.proc == proc {
-			return v
+// handlerFor finds the handler for a call, or the error to reject it with
+// when the RPC version, program, program version or procedure is not served.
+func (s *Server) handlerFor(rpcVers uint32, prog uint32, vers uint32, proc uint32) (HandleFunc, error) {
+	if rpcVers != rpcVersion {
+		return nil, &RPCMismatchError{Low: rpcVersion, High: rpcVersion}
+	}
+	table := s.handlerTable()
+	if h, ok := table[handlerID{prog, vers, proc}]; ok {
+		return h, nil
+	}
+	if h, ok := table[handlerID{prog, anyVersion, proc}]; ok {
+		return h, nil
+	}
+
+	low, high, servesProg, servesVers := uint32(0), uint32(0), false, false
+	for id := range table {
+		if id.protocol != prog {
+			continue
+		}
+		if id.version == vers || id.version == anyVersion {
+			servesVers = true
 		}
+		if !servesProg || id.version < low {
+			low = id.version
+		}
+		if !servesProg || id.version > high {
+			high = id.version
+		}
+		servesProg = true
 	}
-	return nil
+	switch {
+	case !servesProg:
+		return nil, &ResponseCodeProgUnavailableError{}
+	case !servesVers:
+		return nil, &ProgMismatchError{Low: low, High: high}
+	}
+	return nil, &ResponseCodeProcUnavailableError{}
 }
 
 // Serve is a singleton listener paralleling http.Serve
@@ -0,0 +1,273 @@
+package nfs_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+)
+
+func TestServerHandler(t *testing.T) {
+	const prog, vers, proc = 400100, 1, 1
+	increment := func(ctx context.Context, w *nfs.Response, h nfs.Handler) error {
+		n, err := xdr.ReadUint32(w.Request().Body)
+		if err != nil {
+			return &nfs.ResponseCodeGarbageArgsError{}
+		}
+		return w.WriteXDR(n + 1)
+	}
+
+	withProg := &nfs.Server{}
+	if err := withProg.RegisterVersionedMessageHandler(prog, vers, proc, increment); err != nil {
+		t.Fatal(err)
+	}
+	if err := withProg.RegisterVersionedMessageHandler(prog, vers, proc, increment); err == nil {
+		t.Fatal("duplicate registration was accepted")
+	}
+	args := binary.BigEndian.AppendUint32(nil, 41)
+
+	c := serveMem(t, withProg)
+	writeFragments(t, c, rpcCall(1, prog, vers, proc, args), 1<<20)
+	_, stat, res := readReplyBody(t, bufio.NewReader(c))
+	if stat != 0 || len(res) != 4 || binary.BigEndian.Uint32(res) != 42 {
+		t.Fatalf("unexpected reply: %d %x", stat, res)
+	}
+
+	// the handler is not visible to other servers.
+	c = serveMem(t, &nfs.Server{})
+	writeFragments(t, c, rpcCall(2, prog, vers, proc, args), 1<<20)
+	if _, stat, _ := readReplyBody(t, bufio.NewReader(c)); stat == 0 {
+		t.Fatal("handler registered on one server answered on another")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	type observed struct {
+		xid    uint32
+		proc   uint32
+		status nfs.NFSStatus
+	}
+	seen := make(chan observed, 4)
+	srv := &nfs.Server{Interceptors: []nfs.Interceptor{
+		func(ctx context.Context, w *nfs.Response, h nfs.Handler, next nfs.HandleFunc) error {
+			err := next(ctx, w, h)
+			if status, ok := w.NFSStatus(); ok {
+				seen <- observed{w.Request().XID(), w.Request().Header.Proc, status}
+			}
+			return err
+		},
+		func(ctx context.Context, w *nfs.Response, h nfs.Handler, next nfs.HandleFunc) error {
+			req := w.Request()
+			if req.Header.Prog == 100003 && req.Header.Proc == uint32(nfs.NFSProcedureLookup) {
+				return &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusAccess}
+			}
+			return next(ctx, w, h)
+		},
+	}}
+	c := serveMem(t, srv)
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+
+	writeFragments(t, c, rpcCall(2, 100003, 3, uint32(nfs.NFSProcedureFSInfo), xdrOpaque(fh)), 1<<20)
+	if _, stat, res := readReplyBody(t, r); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("fsinfo failed: %d %x", stat, res)
+	}
+	if o := <-seen; o != (observed{2, uint32(nfs.NFSProcedureFSInfo), nfs.NFSStatusOk}) {
+		t.Fatalf("unexpected observation: %+v", o)
+	}
+
+	writeFragments(t, c, rpcCall(3, 100003, 3, uint32(nfs.NFSProcedureLookup), append(xdrOpaque(fh), xdrOpaque([]byte("x"))...)), 1<<20)
+	_, stat, res = readReplyBody(t, r)
+	// the failure carries an empty post_op_attr, as lookup replies do.
+	if stat != 0 || len(res) != 8 || binary.BigEndian.Uint32(res) != uint32(nfs.NFSStatusAccess) {
+		t.Fatalf("lookup was not refused: %d %x", stat, res)
+	}
+	if o := <-seen; o != (observed{3, uint32(nfs.NFSProcedureLookup), nfs.NFSStatusAccess}) {
+		t.Fatalf("unexpected observation: %+v", o)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := &nfs.Server{}
+	srv.SetRateLimits(nfs.RateLimit{Key: nfs.RateLimitByClient, OpsPerSecond: 0.001, OpsBurst: 2})
+	c := serveMem(t, srv)
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+
+	fsinfo := func(xid uint32) nfs.NFSStatus {
+		writeFragments(t, c, rpcCall(xid, 100003, 3, uint32(nfs.NFSProcedureFSInfo), xdrOpaque(fh)), 1<<20)
+		_, stat, res := readReplyBody(t, r)
+		if stat != 0 {
+			t.Fatalf("fsinfo failed: %d", stat)
+		}
+		return nfs.NFSStatus(binary.BigEndian.Uint32(res))
+	}
+	for xid := uint32(2); xid < 4; xid++ {
+		if status := fsinfo(xid); status != nfs.NFSStatusOk {
+			t.Fatalf("request within burst failed: %v", status)
+		}
+	}
+	if status := fsinfo(4); status != nfs.NFSStatusJukebox {
+		t.Fatalf("request over limit was answered with %v", status)
+	}
+
+	srv.SetRateLimits()
+	if status := fsinfo(5); status != nfs.NFSStatusOk {
+		t.Fatalf("request after removing limits failed: %v", status)
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	c := serveMem(t, &nfs.Server{})
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100003, 4, 0, nil), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	// PROG_MISMATCH, low 2, high 3.
+	if stat != 2 || len(res) != 8 ||
+		binary.BigEndian.Uint32(res) != 2 || binary.BigEndian.Uint32(res[4:]) != 3 {
+		t.Fatalf("unexpected reply to nfs v4: %d %x", stat, res)
+	}
+
+	writeFragments(t, c, rpcCall(2, 100099, 1, 0, nil), 1<<20)
+	if _, stat, _ := readReplyBody(t, r); stat != uint32(nfs.ResponseCodeProgUnavailable) {
+		t.Fatalf("unexpected reply to unknown program: %d", stat)
+	}
+
+	writeFragments(t, c, rpcCall(3, 100003, 3, 99, nil), 1<<20)
+	// PROC_UNAVAIL.
+	if _, stat, _ := readReplyBody(t, r); stat != 3 {
+		t.Fatalf("unexpected reply to unknown procedure: %d", stat)
+	}
+
+	call := rpcCall(4, 100003, 3, 0, nil)
+	binary.BigEndian.PutUint32(call[8:], 3)
+	writeFragments(t, c, call, 1<<20)
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	// MSG_DENIED, RPC_MISMATCH, low 2, high 2.
+	want := []uint32{4, 1, 1, 0, 2, 2}
+	if len(reply) != 4*len(want) {
+		t.Fatalf("unexpected reply to rpc v3: %x", reply)
+	}
+	for i, v := range want {
+		if got := binary.BigEndian.Uint32(reply[4*i:]); got != v {
+			t.Fatalf("unexpected reply to rpc v3: %x", reply)
+		}
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	srv := &nfs.Server{}
+	srv.SetRateLimits(nfs.RateLimit{Key: nfs.RateLimitByClient, OpsPerSecond: 0.001, OpsBurst: 3, BytesPerSecond: 0.001, BytesBurst: 10})
+	c := serveMem(t, srv)
+	r := bufio.NewReader(c)
+
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, r)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+
+	call := func(xid uint32, proc nfs.NFSProcedure, args []byte) nfs.NFSStatus {
+		writeFragments(t, c, rpcCall(xid, 100003, 3, uint32(proc), append(xdrOpaque(fh), args...)), 1<<20)
+		_, stat, res := readReplyBody(t, r)
+		if stat != 0 {
+			t.Fatalf("%v failed: %d", proc, stat)
+		}
+		return nfs.NFSStatus(binary.BigEndian.Uint32(res))
+	}
+	read := xdrUint32s(0, 0, 8)
+	if status := call(2, nfs.NFSProcedureRead, read); status == nfs.NFSStatusJukebox {
+		t.Fatalf("read within budget was refused")
+	}
+	if status := call(3, nfs.NFSProcedureRead, read); status != nfs.NFSStatusJukebox {
+		t.Fatalf("read over the byte budget was answered with %v", status)
+	}
+	// the refused read took none of the two remaining operations.
+	for xid := uint32(4); xid < 6; xid++ {
+		if status := call(xid, nfs.NFSProcedureFSInfo, nil); status != nfs.NFSStatusOk {
+			t.Fatalf("request within the operation budget failed: %v", status)
+		}
+	}
+}
+
+func TestRateLimitByExport(t *testing.T) {
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024)
+	dial := func(srv *nfs.Server) net.Conn {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// handles are obtained from one server, and used on another that never
+	// saw their export mounted, as after a restart.
+	c := dial(&nfs.Server{Handler: handler})
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	writeFragments(t, c, rpcCall(2, 100005, 1, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res = readReplyBody(t, c)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount v1 failed: %d %x", stat, res)
+	}
+	fhV2 := res[4:]
+
+	srv := &nfs.Server{Handler: handler}
+	srv.SetRateLimits(nfs.RateLimit{Key: nfs.RateLimitByExport, OpsPerSecond: 0.001, OpsBurst: 1})
+	c = dial(srv)
+	for i, want := range []nfs.NFSStatus{nfs.NFSStatusOk, nfs.NFSStatusJukebox} {
+		xid := uint32(3 + i)
+		writeFragments(t, c, rpcCall(xid, 100003, 3, uint32(nfs.NFSProcedureFSInfo), xdrOpaque(fh)), 1<<20)
+		_, stat, res := readReplyBody(t, c)
+		if status := nfs.NFSStatus(binary.BigEndian.Uint32(res)); stat != 0 || status != want {
+			t.Fatalf("fsinfo %d was answered with %d %v", xid, stat, status)
+		}
+	}
+	// NFSv2 requests over the limit are answered too, with NFSERR_IO.
+	writeFragments(t, c, rpcCall(5, 100003, 2, uint32(nfs.NFSv2ProcedureGetAttr), fhV2), 1<<20)
+	_, stat, res = readReplyBody(t, c)
+	if status := nfs.NFSStatus(binary.BigEndian.Uint32(res)); stat != 0 || status != nfs.NFSStatusIO {
+		t.Fatalf("nfsv2 getattr over the limit was answered with %d %v", stat, status)
+	}
+}
@@ -0,0 +1,79 @@
+package nfs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// startTLSVerifier is the verifier of a reply accepting an AUTH_TLS probe (rfc9289).
+var startTLSVerifier = rpc.Auth{Flavor: uint32(AuthFlavorNull), Body: []byte("STARTTLS")}
+
+// isTLSProbe reports whether the request is a NULL call with AUTH_TLS
+// credentials, by which a client asks to upgrade the connection to TLS.
+func (r *Request) isTLSProbe() bool {
+	return r.Header.Proc == 0 && r.Header.Cred.Flavor == uint32(AuthFlavorTLS)
+}
+
+// startTLS answers an AUTH_TLS probe and performs the TLS handshake. Replies
+// to requests received before the probe are sent in cleartext first.
+func (c *conn) startTLS(ctx context.Context, cancel context.CancelFunc, w *Response) error {
+	c.inFlight.Wait()
+
+	w.verf = &startTLSVerifier
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		c.endRequest()
+		return err
+	}
+	if err := w.finish(ctx); err != nil {
+		c.endRequest()
+		return err
+	}
+	c.stopWrites()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if t := c.Server.ReadHeaderTimeout; t > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(t))
+	}
+	tlsConn := tls.Server(c.Conn, c.Server.TLSConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.tlsConn = tlsConn
+	c.startWrites(ctx, cancel)
+	return nil
+}
+
+type tlsStateKey struct{}
+
+// TLSConnectionState returns the state of the TLS session a request was
+// received over, or nil if the request was sent in cleartext.
+func TLSConnectionState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state
+}
+
+// ClientCertificate returns the verified certificate the client presented
+// during the TLS handshake of the connection a request was received over,
+// or nil if there is none.
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	state := TLSConnectionState(ctx)
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// withTLSState attaches the connection's TLS session state to ctx.
+func (c *conn) withTLSState(ctx context.Context) context.Context {
+	if c.tlsConn == nil {
+		return ctx
+	}
+	state := c.tlsConn.ConnectionState()
+	return context.WithValue(ctx, tlsStateKey{}, &state)
+}
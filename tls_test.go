@@ -0,0 +1,150 @@
+package nfs_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+)
+
+// selfSigned returns a certificate for name that is its own authority.
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// certMountHandler records the client certificate seen by Mount.
+type certMountHandler struct {
+	nfs.Handler
+	client chan string
+}
+
+func (h *certMountHandler) Mount(ctx context.Context, c net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	if cert := nfs.ClientCertificate(ctx); cert != nil {
+		h.client <- cert.Subject.CommonName
+	} else {
+		h.client <- ""
+	}
+	return h.Handler.Mount(ctx, c, req)
+}
+
+func TestStartTLS(t *testing.T) {
+	serverCert, serverX509 := selfSigned(t, "server.test")
+	clientCert, clientX509 := selfSigned(t, "client.test")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(serverX509)
+
+	handler := &certMountHandler{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024),
+		client:  make(chan string, 2),
+	}
+	srv := &nfs.Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		},
+		RequireTLS: func(dirpath string) bool { return dirpath == "/" },
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	// mounting the export in cleartext is refused.
+	writeFragments(t, c, rpcCall(1, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	if _, stat, res := readReplyBody(t, r); stat != 0 || binary.BigEndian.Uint32(res) != uint32(nfs.MountStatusErrAcces) {
+		t.Fatalf("cleartext mount was not refused: %d %x", stat, res)
+	}
+
+	probe := rpcCall(2, 100003, 3, 0, nil)
+	binary.BigEndian.PutUint32(probe[24:], uint32(nfs.AuthFlavorTLS))
+	writeFragments(t, c, probe, 1<<20)
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 32 || string(reply[20:28]) != "STARTTLS" || binary.BigEndian.Uint32(reply[28:]) != 0 {
+		t.Fatalf("unexpected reply to tls probe: %x", reply)
+	}
+
+	tc := tls.Client(c, &tls.Config{
+		ServerName:   "server.test",
+		RootCAs:      serverCAs,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tr := bufio.NewReader(tc)
+	writeFragments(t, tc, rpcCall(3, 100005, 3, 1, xdrOpaque([]byte("/"))), 1<<20)
+	_, stat, res := readReplyBody(t, tr)
+	if stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("mount over tls failed: %d %x", stat, res)
+	}
+	fh := res[8 : 8+binary.BigEndian.Uint32(res[4:])]
+	if name := <-handler.client; name != "client.test" {
+		t.Fatalf("mount saw client certificate %q", name)
+	}
+
+	writeFragments(t, tc, rpcCall(4, 100003, 3, uint32(nfs.NFSProcedureFSInfo), xdrOpaque(fh)), 1<<20)
+	if _, stat, res := readReplyBody(t, tr); stat != 0 || binary.BigEndian.Uint32(res) != 0 {
+		t.Fatalf("fsinfo over tls failed: %d %x", stat, res)
+	}
+}